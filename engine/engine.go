@@ -118,6 +118,11 @@ func (this *EngineConfig) Project(name string) *ConfProject {
 	return p
 }
 
+func (this *EngineConfig) HasProject(name string) bool {
+	_, present := this.projects[name]
+	return present
+}
+
 // For Filter to generate new pack
 func (this *EngineConfig) PipelinePack(msgLoopCount int) *PipelinePack {
 	if msgLoopCount++; msgLoopCount > Globals().MaxMsgLoops {
@@ -157,6 +162,12 @@ func (this *EngineConfig) LoadConfigFile(fn string) *EngineConfig {
 
 	globals.Printf("Starting engine with %d/%d CPUs...", maxProcs, totalCpus)
 
+	globals.TimeZone, err = time.LoadLocation(this.String("timezone",
+		DEFAULT_TIMEZONE))
+	if err != nil {
+		panic(err)
+	}
+
 	// 'projects' section
 	for i := 0; i < len(this.List("projects", nil)); i++ {
 		section, err := this.Section(fmt.Sprintf("projects[%d]", i))
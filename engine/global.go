@@ -13,6 +13,9 @@ const (
 	STOP    = "stop"
 	SIGUSR1 = "user1"
 	SIGUSR2 = "user2"
+
+	TIME_FORMAT      = "01-02 15:04:05"
+	DEFAULT_TIMEZONE = "Asia/Shanghai"
 )
 
 var (
@@ -39,6 +42,8 @@ type GlobalConfigStruct struct {
 	MaxMsgLoops int
 	MaxPackIdle time.Duration
 
+	TimeZone *time.Location // projects default to it
+
 	sigChan chan os.Signal
 }
 
@@ -52,6 +57,14 @@ func (this *GlobalConfigStruct) Kill(sig os.Signal) {
 	}(sig)
 }
 
+func (this *GlobalConfigStruct) Now() time.Time {
+	return time.Now().In(this.TimeZone)
+}
+
+func (this *GlobalConfigStruct) TimeToString(t time.Time) string {
+	return t.In(this.TimeZone).Format(TIME_FORMAT)
+}
+
 func DefaultGlobals() *GlobalConfigStruct {
 	idle, _ := time.ParseDuration("2m")
 	return &GlobalConfigStruct{
@@ -64,6 +77,7 @@ func DefaultGlobals() *GlobalConfigStruct {
 		MaxMsgLoops:     4,
 		MaxPackIdle:     idle,
 		StartedAt:       time.Now(),
+		TimeZone:        time.Local,
 		Logger:          log.New(os.Stdout, "", log.Ldate|log.Lshortfile|log.Ltime),
 	}
 }
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/funkygao/golib/bjtime"
 	"github.com/gorilla/mux"
 	"io"
 	"net"
@@ -72,7 +71,7 @@ func (this *EngineConfig) handleHttpQuery(w http.ResponseWriter, req *http.Reque
 			packs := make([]string, 0, globals.RecyclePoolSize)
 			for _, pack := range this.diagnosticTrackers[poolName].packs {
 				s := fmt.Sprintf("[%s]%s",
-					bjtime.TimeToString(pack.diagnostics.LastAccess),
+					globals.TimeToString(pack.diagnostics.LastAccess),
 					*pack)
 				packs = append(packs, s)
 			}
@@ -4,14 +4,16 @@ import (
 	conf "github.com/funkygao/jsconf"
 	"log"
 	"os"
+	"time"
 )
 
 type ConfProject struct {
 	*log.Logger
 
-	Name        string `json:"name"`
-	IndexPrefix string `json:"index_prefix"`
-	ShowError   bool   `json:"show_error"`
+	Name        string         `json:"name"`
+	IndexPrefix string         `json:"index_prefix"`
+	ShowError   bool           `json:"show_error"`
+	TimeZone    *time.Location `json:"-"` // nil means local
 }
 
 func (this *ConfProject) fromConfig(c *conf.Conf) {
@@ -21,6 +23,13 @@ func (this *ConfProject) fromConfig(c *conf.Conf) {
 	}
 	this.IndexPrefix = c.String("index_prefix", this.Name)
 	this.ShowError = c.Bool("show_error", true)
+	this.TimeZone = Globals().TimeZone
+	if tz := c.String("timezone", ""); tz != "" {
+		var err error
+		if this.TimeZone, err = time.LoadLocation(tz); err != nil {
+			panic(err)
+		}
+	}
 
 	logfile := c.String("logfile", "var/"+this.Name+".log")
 	logWriter, err := os.OpenFile(logfile, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
@@ -39,6 +48,22 @@ func (this *ConfProject) fromConfig(c *conf.Conf) {
 	this.Logger = log.New(logWriter, "", logOptions)
 }
 
+// Location for alarm hours, rendering, index names and buckets
+func (this *ConfProject) Location() *time.Location {
+	if this.TimeZone == nil {
+		return time.Local
+	}
+	return this.TimeZone
+}
+
+func (this *ConfProject) Now() time.Time {
+	return time.Now().In(this.Location())
+}
+
+func (this *ConfProject) TimeToString(t time.Time) string {
+	return t.In(this.Location()).Format(TIME_FORMAT)
+}
+
 func (this *ConfProject) Start() {
 	this.Println("Started")
 }
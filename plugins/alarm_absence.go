@@ -0,0 +1,99 @@
+package plugins
+
+import (
+	"fmt"
+	"github.com/funkygao/dpipe/engine"
+	conf "github.com/funkygao/jsconf"
+	"strings"
+	"time"
+)
+
+// Expect a log stream to keep flowing, alarm when it goes silent
+type alarmExpect struct {
+	title            string
+	ident            string // empty matches all
+	camelName        string
+	area             string
+	window           time.Duration
+	minCount         int
+	severity         int
+	recoverySeverity int
+
+	count       int
+	windowStart time.Time
+	absent      bool
+	absentSince time.Time
+}
+
+func (this *alarmExpect) load(section *conf.Conf) {
+	this.ident = section.String("ident", "")
+	this.camelName = section.String("camel_name", "")
+	this.area = section.String("area", "")
+	if this.ident == "" && this.camelName == "" && this.area == "" {
+		panic("expect must have 'ident', 'camel_name' or 'area'")
+	}
+	this.title = section.String("title", "")
+	if this.title == "" {
+		parts := make([]string, 0, 3)
+		for _, kv := range [][2]string{{"ident", this.ident},
+			{"camelName", this.camelName}, {"area", this.area}} {
+			if kv[1] != "" {
+				parts = append(parts, kv[0]+"="+kv[1])
+			}
+		}
+		this.title = "Absent " + strings.Join(parts, " ")
+	}
+	this.window = time.Duration(section.Int("window", 300)) * time.Second
+	this.minCount = section.Int("min_count", 1)
+	this.severity = section.Int("severity", 100)
+	this.recoverySeverity = section.Int("recovery_severity", this.severity)
+}
+
+func (this *alarmExpect) observe(pack *engine.PipelinePack) {
+	if (this.ident == "" || this.ident == pack.Ident) &&
+		(this.camelName == "" || this.camelName == pack.Logfile.CamelCaseName()) &&
+		(this.area == "" || this.area == pack.Message.Area) {
+		this.count += 1
+	}
+}
+
+// Called periodically, the alarm repeats each window while absent
+func (this *alarmExpect) check(now time.Time) (msg alarmMailMessage, fire bool) {
+	if this.windowStart.IsZero() {
+		// 1st window starts with the first check
+		this.windowStart = now
+		return
+	}
+	if now.Sub(this.windowStart) < this.window {
+		return
+	}
+
+	count := this.count
+	this.count = 0
+	this.windowStart = now
+
+	switch {
+	case count < this.minCount:
+		if !this.absent {
+			this.absent = true
+			this.absentSince = now.Add(-this.window)
+		}
+		msg = alarmMailMessage{worker: this.title, severity: this.severity,
+			key: alarmKeyOf(this.title, "absent"), receivedAt: now,
+			msg: fmt.Sprintf("%d messages in %s, expected %d, silent since %s",
+				count, this.window, this.minCount,
+				this.absentSince.Format(engine.TIME_FORMAT))}
+		fire = true
+
+	case this.absent:
+		msg = alarmMailMessage{worker: this.title,
+			severity: this.recoverySeverity,
+			key:      alarmKeyOf(this.title, "recovered"), receivedAt: now,
+			msg: fmt.Sprintf("recovered with %d messages in %s after silent %s",
+				count, this.window, now.Sub(this.absentSince)-this.window)}
+		fire = this.recoverySeverity > 0
+		this.absent = false
+	}
+
+	return
+}
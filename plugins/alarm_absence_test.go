@@ -0,0 +1,55 @@
+package plugins
+
+import (
+	"github.com/funkygao/assert"
+	"github.com/funkygao/dpipe/engine"
+	"testing"
+	"time"
+)
+
+func TestAlarmExpect(t *testing.T) {
+	e := &alarmExpect{title: "Absent ident=rs", ident: "rs", window: time.Minute,
+		minCount: 2, severity: 100, recoverySeverity: 10}
+	pack := engine.NewPipelinePack(nil)
+	pack.Ident = "rs"
+	other := engine.NewPipelinePack(nil)
+	other.Ident = "es"
+
+	t0 := time.Unix(1388600000, 0)
+	_, fire := e.check(t0)
+	assert.Equal(t, false, fire)
+
+	e.observe(pack)
+	e.observe(pack)
+	_, fire = e.check(t0.Add(30 * time.Second))
+	assert.Equal(t, false, fire) // window not finished
+	_, fire = e.check(t0.Add(time.Minute))
+	assert.Equal(t, false, fire)
+
+	// only 1 matched message in next window
+	e.observe(pack)
+	e.observe(other)
+	e.observe(other)
+	msg, fire := e.check(t0.Add(2 * time.Minute))
+	assert.Equal(t, true, fire)
+	assert.Equal(t, 100, msg.severity)
+	assert.Equal(t, "Absent ident=rs", msg.worker)
+	absentKey := msg.key
+
+	// keeps alarming while absent
+	msg, fire = e.check(t0.Add(3 * time.Minute))
+	assert.Equal(t, true, fire)
+	assert.Equal(t, absentKey, msg.key)
+
+	e.observe(pack)
+	e.observe(pack)
+	msg, fire = e.check(t0.Add(4 * time.Minute))
+	assert.Equal(t, true, fire)
+	assert.Equal(t, 10, msg.severity)
+	assert.NotEqual(t, absentKey, msg.key)
+
+	e.observe(pack)
+	e.observe(pack)
+	_, fire = e.check(t0.Add(5 * time.Minute))
+	assert.Equal(t, false, fire)
+}
@@ -0,0 +1,239 @@
+package plugins
+
+import (
+	"encoding/gob"
+	"fmt"
+	conf "github.com/funkygao/jsconf"
+	"math"
+	"os"
+	"time"
+)
+
+const (
+	DETECTOR_CHANGE   = "change"   // relative change against last window
+	DETECTOR_EWMA     = "ewma"     // ewma mean with standard deviation band
+	DETECTOR_SEASONAL = "seasonal" // ewma baseline of the same hour of week
+)
+
+// Exponentially weighted moving mean and variance
+type ewmaState struct {
+	Mean float64
+	Var  float64
+	N    int
+}
+
+func (this *ewmaState) update(x, alpha float64) {
+	if this.N == 0 {
+		this.Mean = x
+	} else {
+		diff := x - this.Mean
+		incr := alpha * diff
+		this.Mean += incr
+		this.Var = (1 - alpha) * (this.Var + diff*incr)
+	}
+	this.N += 1
+}
+
+// Counts have poisson noise, so the band is never narrower than sqrt(mean)
+func (this *ewmaState) band(sigma float64) float64 {
+	return sigma * math.Max(math.Sqrt(this.Var), math.Sqrt(this.Mean))
+}
+
+type seasonalBucket struct {
+	ewmaState
+	Weeks    int // distinct weeks learned
+	LastWeek int64
+}
+
+// Learned baseline of an alarm key
+type detectorState struct {
+	Last     float64
+	Overall  ewmaState
+	Buckets  map[int]*seasonalBucket // key is hour of week
+	LastSeen time.Time
+}
+
+// Tells whether a window's amount of an alarm key is abnormal
+type anomalyDetector struct {
+	typ         string
+	percent     float64 // change detector threshold
+	alpha       float64
+	sigma       float64
+	warmup      int // observations before alarming
+	seasonWeeks int // weeks before a seasonal bucket is trusted
+	minVolume   float64
+	stateTtl    time.Duration
+	maxKeys     int
+
+	states map[string]*detectorState
+	dirty  bool
+}
+
+func newAnomalyDetector() *anomalyDetector {
+	return &anomalyDetector{typ: DETECTOR_CHANGE, percent: 1.5, alpha: 0.3,
+		sigma: 3, warmup: 10, seasonWeeks: 2, minVolume: 10,
+		stateTtl: 8 * 24 * time.Hour, maxKeys: 100000,
+		states: make(map[string]*detectorState)}
+}
+
+// abnormal_percent and abnormal_base keep their meaning
+func (this *anomalyDetector) load(config *conf.Conf) {
+	this.typ = config.String("detector", DETECTOR_CHANGE)
+	switch this.typ {
+	case DETECTOR_CHANGE, DETECTOR_EWMA, DETECTOR_SEASONAL:
+	default:
+		panic("invalid detector: " + this.typ)
+	}
+	this.percent = config.Float("abnormal_percent", 1.5)
+	this.minVolume = float64(config.Int("min_volume", config.Int("abnormal_base", 10)))
+	this.alpha = config.Float("ewma_alpha", 0.3)
+	if this.alpha <= 0 || this.alpha > 1 {
+		panic(fmt.Sprintf("invalid ewma_alpha: %v", this.alpha))
+	}
+	this.sigma = config.Float("sigma", 3)
+	this.warmup = config.Int("warmup", 10)
+	this.seasonWeeks = config.Int("season_weeks", 2)
+	this.stateTtl = time.Duration(config.Int("detector_state_ttl", 8*86400)) * time.Second
+	this.maxKeys = config.Int("detector_max_keys", 100000)
+}
+
+// Check the amount against the learned baseline then learn it
+func (this *anomalyDetector) observe(key string, amount float64,
+	t time.Time) (abnormal bool, expected float64) {
+	state, present := this.states[key]
+	if !present {
+		state = &detectorState{Buckets: make(map[int]*seasonalBucket)}
+		this.states[key] = state
+	}
+
+	var (
+		band  float64
+		ready bool
+	)
+	switch this.typ {
+	case DETECTOR_CHANGE:
+		expected, ready = state.Last, present
+		band = expected * this.percent
+
+	case DETECTOR_EWMA:
+		expected, ready = state.Overall.Mean, state.Overall.N >= this.warmup
+		band = state.Overall.band(this.sigma)
+
+	case DETECTOR_SEASONAL:
+		// fallback to overall baseline till the hour of week is learned
+		baseline := &state.Overall
+		if bucket, present := state.Buckets[hourOfWeek(t)]; present &&
+			bucket.Weeks >= this.seasonWeeks {
+			baseline = &bucket.ewmaState
+		}
+		expected, ready = baseline.Mean, baseline.N >= this.warmup
+		band = baseline.band(this.sigma)
+	}
+
+	if ready && amount >= this.minVolume {
+		abnormal = math.Abs(amount-expected) >= band
+	}
+
+	this.learn(state, amount, t)
+	return
+}
+
+func (this *anomalyDetector) learn(state *detectorState, amount float64,
+	t time.Time) {
+	state.Last = amount
+	state.LastSeen = t
+	state.Overall.update(amount, this.alpha)
+	if this.typ == DETECTOR_SEASONAL {
+		how := hourOfWeek(t)
+		bucket, present := state.Buckets[how]
+		if !present {
+			bucket = &seasonalBucket{}
+			state.Buckets[how] = bucket
+		}
+		if week := weekNumber(t); week != bucket.LastWeek {
+			bucket.Weeks += 1
+			bucket.LastWeek = week
+		}
+		bucket.update(amount, this.alpha)
+	}
+
+	this.dirty = true
+}
+
+// Forget keys not seen for long, if still too many start over
+func (this *anomalyDetector) prune(now time.Time) (pruned int) {
+	for key, state := range this.states {
+		if now.Sub(state.LastSeen) > this.stateTtl {
+			delete(this.states, key)
+			pruned += 1
+		}
+	}
+
+	if len(this.states) > this.maxKeys {
+		pruned += len(this.states)
+		this.states = make(map[string]*detectorState)
+	}
+
+	if pruned > 0 {
+		this.dirty = true
+	}
+	return
+}
+
+func (this *anomalyDetector) dump(fn string) error {
+	tmp := fn + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(this.states)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	this.dirty = false
+	return nil
+}
+
+// Restore the baselines learned by last run, missing file is not an error
+func (this *anomalyDetector) loadState(fn string) error {
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	states := make(map[string]*detectorState)
+	if err = gob.NewDecoder(f).Decode(&states); err != nil {
+		return err
+	}
+	for _, state := range states {
+		if state.Buckets == nil {
+			state.Buckets = make(map[int]*seasonalBucket)
+		}
+	}
+
+	this.states = states
+	this.dirty = false
+	return nil
+}
+
+func hourOfWeek(t time.Time) int {
+	return int(t.Weekday())*24 + t.Hour()
+}
+
+// Weeks since epoch, starting on Sunday as time.Weekday does
+func weekNumber(t time.Time) int64 {
+	_, offset := t.Zone()
+	days := (t.Unix() + int64(offset)) / 86400
+	return (days + 4) / 7 // 1970-01-01 is Thursday
+}
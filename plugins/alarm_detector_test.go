@@ -0,0 +1,104 @@
+package plugins
+
+import (
+	"github.com/funkygao/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChangeDetector(t *testing.T) {
+	d := newAnomalyDetector()
+	t0 := time.Unix(1388600000, 0)
+
+	abnormal, _ := d.observe("k", 20, t0)
+	assert.Equal(t, false, abnormal)
+	abnormal, expected := d.observe("k", 60, t0)
+	assert.Equal(t, true, abnormal)
+	assert.Equal(t, float64(20), expected)
+	abnormal, _ = d.observe("k", 61, t0)
+	assert.Equal(t, false, abnormal)
+
+	// min volume guard
+	abnormal, _ = d.observe("k", 5, t0)
+	assert.Equal(t, false, abnormal)
+}
+
+func TestEwmaDetector(t *testing.T) {
+	d := newAnomalyDetector()
+	d.typ = DETECTOR_EWMA
+	t0 := time.Unix(1388600000, 0)
+
+	// still warming up
+	for i := 0; i < d.warmup; i++ {
+		abnormal, _ := d.observe("k", float64(100+i%3), t0)
+		assert.Equal(t, false, abnormal)
+	}
+
+	abnormal, _ := d.observe("k", 110, t0)
+	assert.Equal(t, false, abnormal) // within noise band
+	abnormal, expected := d.observe("k", 400, t0)
+	assert.Equal(t, true, abnormal)
+	assert.Equal(t, true, expected > 95 && expected < 115)
+
+	abnormal, _ = d.observe("k", 5, t0)
+	assert.Equal(t, false, abnormal) // below min volume
+}
+
+func TestSeasonalDetector(t *testing.T) {
+	d := newAnomalyDetector()
+	d.typ = DETECTOR_SEASONAL
+	d.warmup = 2
+	monday := time.Date(2014, 1, 6, 0, 0, 0, 0, time.UTC)
+
+	// quiet at 3am, busy at 9pm for two weeks
+	for week := 0; week < 2; week++ {
+		for day := 0; day < 7; day++ {
+			base := monday.AddDate(0, 0, week*7+day)
+			for i := 0; i < 3; i++ {
+				d.observe("k", 20, base.Add(3*time.Hour))
+				d.observe("k", 500, base.Add(21*time.Hour))
+			}
+		}
+	}
+
+	monday = monday.AddDate(0, 0, 14)
+	abnormal, expected := d.observe("k", 500, monday.Add(21*time.Hour))
+	assert.Equal(t, false, abnormal)
+	assert.Equal(t, true, expected > 490)
+	abnormal, expected = d.observe("k", 500, monday.Add(3*time.Hour))
+	assert.Equal(t, true, abnormal)
+	assert.Equal(t, true, expected < 30)
+}
+
+func TestDetectorPersist(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "alarm_detector")
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "detector.gob")
+	t0 := time.Unix(1388600000, 0)
+
+	d := newAnomalyDetector()
+	assert.Equal(t, nil, d.loadState(fn))
+	d.observe("k", 20, t0)
+	d.observe("stale", 20, t0.Add(-10*24*time.Hour))
+	assert.Equal(t, 1, d.prune(t0))
+	assert.Equal(t, nil, d.dump(fn))
+	assert.Equal(t, false, d.dirty)
+
+	d = newAnomalyDetector()
+	assert.Equal(t, nil, d.loadState(fn))
+	assert.Equal(t, 1, len(d.states))
+	abnormal, expected := d.observe("k", 60, t0)
+	assert.Equal(t, true, abnormal)
+	assert.Equal(t, float64(20), expected)
+}
+
+func TestWeekNumber(t *testing.T) {
+	sat := time.Date(2014, 1, 4, 23, 0, 0, 0, time.UTC)
+	sun := time.Date(2014, 1, 5, 1, 0, 0, 0, time.UTC)
+	assert.Equal(t, weekNumber(sat)+1, weekNumber(sun))
+	assert.Equal(t, weekNumber(sun), weekNumber(sun.AddDate(0, 0, 6)))
+	assert.Equal(t, 1, hourOfWeek(sun))
+}
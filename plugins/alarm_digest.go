@@ -0,0 +1,395 @@
+package plugins
+
+import (
+	"encoding/gob"
+	"fmt"
+	"github.com/funkygao/dpipe/engine"
+	conf "github.com/funkygao/jsconf"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	DIGEST_DAILY  = "daily"
+	DIGEST_WEEKLY = "weekly"
+
+	digestMaxFingerprints = 1000 // per worker per period
+)
+
+const defaultAlarmDigestText = `ALS[{{.Project}}] {{.Period}} alarm digest {{.From}} ~ {{.To}}
+{{.Count}} alarms ({{.CountDelta}}), severity {{.SeveritySum}} ({{.SeverityDelta}})
+{{range .Workers}}
+== {{.Worker}}: {{.Count}} alarms ({{.CountDelta}}), severity {{.SeveritySum}} ({{.SeverityDelta}})
+peak hour {{.PeakHour}} with {{.PeakCount}} alarms
+areas:{{range .Areas}} {{.Area}}={{.Count}}{{end}}
+{{range .Top}}{{printf "%6d" .Count}} [{{printf "%6d" .SeveritySum}}] {{.Msg}}
+{{end}}{{end}}
+====
+dpipe
+`
+
+const defaultAlarmDigestHtml = `<html><body style="font-family: monospace">
+<h3>ALS[{{.Project}}] {{.Period}} alarm digest {{.From}} ~ {{.To}}</h3>
+<p>{{.Count}} alarms ({{.CountDelta}}), severity {{.SeveritySum}} ({{.SeverityDelta}})</p>
+{{range .Workers}}
+<h4>{{.Worker}}: {{.Count}} alarms ({{.CountDelta}}), severity {{.SeveritySum}} ({{.SeverityDelta}})</h4>
+<p>peak hour {{.PeakHour}} with {{.PeakCount}} alarms<br/>
+areas:{{range .Areas}} {{.Area}}={{.Count}}{{end}}</p>
+<table border="1" cellspacing="0" cellpadding="3">
+<tr><th>count</th><th>severity</th><th>alarm</th></tr>
+{{range .Top}}<tr><td align="right">{{.Count}}</td><td align="right">{{.SeveritySum}}</td><td>{{.Msg}}</td></tr>
+{{end}}</table>
+{{end}}
+<p>dpipe</p>
+</body></html>
+`
+
+type alarmRollupFingerprint struct {
+	Msg         string // the latest
+	Count       int
+	SeveritySum int
+}
+
+type alarmRollupWorker struct {
+	Count        int
+	SeveritySum  int
+	Areas        map[string]int
+	Hours        map[int64]int // key is unix hour
+	Fingerprints map[string]*alarmRollupFingerprint
+}
+
+// Alarms of a digest period
+type alarmRollup struct {
+	Start   time.Time
+	Workers map[string]*alarmRollupWorker
+}
+
+func newAlarmRollup(start time.Time) *alarmRollup {
+	return &alarmRollup{Start: start, Workers: make(map[string]*alarmRollupWorker)}
+}
+
+func (this *alarmRollup) add(msg alarmMailMessage) {
+	worker, present := this.Workers[msg.worker]
+	if !present {
+		worker = &alarmRollupWorker{Areas: make(map[string]int),
+			Hours:        make(map[int64]int),
+			Fingerprints: make(map[string]*alarmRollupFingerprint)}
+		this.Workers[msg.worker] = worker
+	}
+
+	worker.Count += 1
+	worker.SeveritySum += msg.severity
+	if msg.area != "" {
+		worker.Areas[msg.area] += 1
+	}
+	worker.Hours[msg.receivedAt.Unix()/3600] += 1
+
+	fp, present := worker.Fingerprints[msg.fingerprint]
+	if !present {
+		if len(worker.Fingerprints) >= digestMaxFingerprints {
+			return
+		}
+		fp = &alarmRollupFingerprint{}
+		worker.Fingerprints[msg.fingerprint] = fp
+	}
+	fp.Msg = msg.msg
+	fp.Count += 1
+	fp.SeveritySum += msg.severity
+}
+
+func (this *alarmRollup) totals() (count, severitySum int) {
+	for _, worker := range this.Workers {
+		count += worker.Count
+		severitySum += worker.SeveritySum
+	}
+	return
+}
+
+// Data passed to the digest templates
+type alarmDigestReport struct {
+	Project       string
+	Period        string
+	From          string
+	To            string
+	Count         int
+	CountDelta    string
+	SeveritySum   int
+	SeverityDelta string
+	Workers       []*alarmDigestWorker
+}
+
+type alarmDigestWorker struct {
+	Worker        string
+	Count         int
+	CountDelta    string
+	SeveritySum   int
+	SeverityDelta string
+	PeakHour      string
+	PeakCount     int
+	Areas         []alarmDigestArea
+	Top           []alarmRollupFingerprint
+}
+
+type alarmDigestArea struct {
+	Area  string
+	Count int
+}
+
+// Report of the rollup with trends against the previous period
+func (this *alarmRollup) report(project, period string, prev *alarmRollup,
+	end time.Time, topN int) *alarmDigestReport {
+	if prev == nil {
+		prev = newAlarmRollup(this.Start)
+	}
+
+	r := &alarmDigestReport{Project: project, Period: period,
+		From: this.Start.Format(engine.TIME_FORMAT), To: end.Format(engine.TIME_FORMAT),
+		Workers: make([]*alarmDigestWorker, 0, len(this.Workers))}
+	var prevCount, prevSeverity int
+	r.Count, r.SeveritySum = this.totals()
+	prevCount, prevSeverity = prev.totals()
+	r.CountDelta = trendDelta(r.Count, prevCount)
+	r.SeverityDelta = trendDelta(r.SeveritySum, prevSeverity)
+
+	for name, worker := range this.Workers {
+		w := &alarmDigestWorker{Worker: name, Count: worker.Count,
+			SeveritySum: worker.SeveritySum,
+			Areas:       make([]alarmDigestArea, 0, len(worker.Areas)),
+			Top:         make([]alarmRollupFingerprint, 0, len(worker.Fingerprints))}
+		prevWorker, present := prev.Workers[name]
+		if !present {
+			prevWorker = &alarmRollupWorker{}
+		}
+		w.CountDelta = trendDelta(worker.Count, prevWorker.Count)
+		w.SeverityDelta = trendDelta(worker.SeveritySum, prevWorker.SeveritySum)
+
+		var peak int64
+		for hour, count := range worker.Hours {
+			if count > w.PeakCount || (count == w.PeakCount && hour < peak) {
+				peak, w.PeakCount = hour, count
+			}
+		}
+		w.PeakHour = time.Unix(peak*3600, 0).In(end.Location()).Format(
+			engine.TIME_FORMAT)
+
+		for area, count := range worker.Areas {
+			w.Areas = append(w.Areas, alarmDigestArea{Area: area, Count: count})
+		}
+		sort.Sort(alarmDigestAreas(w.Areas))
+
+		for _, fp := range worker.Fingerprints {
+			w.Top = append(w.Top, *fp)
+		}
+		sort.Sort(alarmRollupFingerprints(w.Top))
+		if topN > 0 && len(w.Top) > topN {
+			w.Top = w.Top[:topN]
+		}
+
+		r.Workers = append(r.Workers, w)
+	}
+	sort.Sort(alarmDigestWorkers(r.Workers))
+
+	return r
+}
+
+func trendDelta(cur, prev int) string {
+	switch {
+	case prev == 0 && cur == 0:
+		return "-"
+	case prev == 0:
+		return "new"
+	}
+	return fmt.Sprintf("%+d%%", (cur-prev)*100/prev)
+}
+
+// Scheduled daily and weekly digest of a project's alarms
+type alarmDigest struct {
+	recipients []string
+	daily      bool
+	weekly     bool
+	hour       int          // send at or after this hour
+	weekday    time.Weekday // weekly digest day
+	topN       int
+	checkpoint string
+	template   *alarmMailTemplate
+
+	state alarmDigestState
+	dirty bool
+}
+
+type alarmDigestState struct {
+	Day        *alarmRollup
+	PrevDay    *alarmRollup
+	Week       *alarmRollup
+	PrevWeek   *alarmRollup
+	LastDaily  time.Time // when sent
+	LastWeekly time.Time
+}
+
+func (this *alarmDigest) load(section *conf.Conf, projectName string,
+	recipients []string) {
+	this.recipients = recipients
+	if rcpts := splitRecipients(section.String("recipients", "")); len(rcpts) > 0 {
+		this.recipients = rcpts
+	}
+	if len(this.recipients) == 0 {
+		panic("alarm digest can't have no recipients")
+	}
+	this.daily = section.Bool("daily", true)
+	this.weekly = section.Bool("weekly", true)
+	this.hour = section.Int("hour", 9)
+	this.weekday = time.Weekday(section.Int("weekday", int(time.Monday)))
+	this.topN = section.Int("top_n", 10)
+	this.checkpoint = section.String("checkpoint",
+		fmt.Sprintf("var/alarm_digest.%s.gob", projectName))
+
+	var err error
+	this.template, err = loadAlarmTemplate(section.String("text_template", ""),
+		section.String("html_template", ""), defaultAlarmDigestText,
+		defaultAlarmDigestHtml, section.Bool("html", true))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Restore the rollups of last run, a fresh start waits for the next schedule
+func (this *alarmDigest) restore(now time.Time) error {
+	this.state = alarmDigestState{Day: newAlarmRollup(now),
+		Week: newAlarmRollup(now), LastDaily: now, LastWeekly: now}
+
+	f, err := os.Open(this.checkpoint)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var state alarmDigestState
+	if err = gob.NewDecoder(f).Decode(&state); err != nil {
+		return err
+	}
+	if state.Day != nil && state.Week != nil {
+		this.state = state
+	}
+	return nil
+}
+
+func (this *alarmDigest) dump() error {
+	if !this.dirty {
+		return nil
+	}
+
+	tmp := this.checkpoint + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(this.state)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, this.checkpoint)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	this.dirty = false
+	return nil
+}
+
+func (this *alarmDigest) add(msg alarmMailMessage) {
+	this.state.Day.add(msg)
+	this.state.Week.add(msg)
+	this.dirty = true
+}
+
+// Reports due at now, the reported periods are rolled over
+func (this *alarmDigest) due(project string, now time.Time) []*alarmDigestReport {
+	reports := make([]*alarmDigestReport, 0)
+	if now.Hour() < this.hour {
+		return reports
+	}
+
+	state := &this.state
+	if this.daily && !sameDay(state.LastDaily, now) {
+		reports = append(reports, state.Day.report(project, DIGEST_DAILY,
+			state.PrevDay, now, this.topN))
+		state.PrevDay, state.Day = state.Day, newAlarmRollup(now)
+		state.LastDaily = now
+		this.dirty = true
+	}
+
+	if now.Weekday() == this.weekday && !sameDay(state.LastWeekly, now) {
+		if this.weekly {
+			reports = append(reports, state.Week.report(project, DIGEST_WEEKLY,
+				state.PrevWeek, now, this.topN))
+		}
+		state.PrevWeek, state.Week = state.Week, newAlarmRollup(now)
+		state.LastWeekly = now
+		this.dirty = true
+	}
+
+	return reports
+}
+
+func sameDay(t1, t2 time.Time) bool {
+	y1, m1, d1 := t1.Date()
+	y2, m2, d2 := t2.Date()
+	return y1 == y2 && m1 == m2 && d1 == d2
+}
+
+type alarmDigestWorkers []*alarmDigestWorker
+
+func (this alarmDigestWorkers) Len() int {
+	return len(this)
+}
+
+func (this alarmDigestWorkers) Less(i, j int) bool {
+	if this[i].SeveritySum == this[j].SeveritySum {
+		return this[i].Worker < this[j].Worker
+	}
+	return this[i].SeveritySum > this[j].SeveritySum
+}
+
+func (this alarmDigestWorkers) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+}
+
+type alarmDigestAreas []alarmDigestArea
+
+func (this alarmDigestAreas) Len() int {
+	return len(this)
+}
+
+func (this alarmDigestAreas) Less(i, j int) bool {
+	if this[i].Count == this[j].Count {
+		return this[i].Area < this[j].Area
+	}
+	return this[i].Count > this[j].Count
+}
+
+func (this alarmDigestAreas) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+}
+
+type alarmRollupFingerprints []alarmRollupFingerprint
+
+func (this alarmRollupFingerprints) Len() int {
+	return len(this)
+}
+
+func (this alarmRollupFingerprints) Less(i, j int) bool {
+	if this[i].SeveritySum == this[j].SeveritySum {
+		return this[i].Msg < this[j].Msg
+	}
+	return this[i].SeveritySum > this[j].SeveritySum
+}
+
+func (this alarmRollupFingerprints) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+}
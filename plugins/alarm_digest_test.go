@@ -0,0 +1,97 @@
+package plugins
+
+import (
+	"github.com/funkygao/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrendDelta(t *testing.T) {
+	assert.Equal(t, "-", trendDelta(0, 0))
+	assert.Equal(t, "new", trendDelta(3, 0))
+	assert.Equal(t, "+50%", trendDelta(15, 10))
+	assert.Equal(t, "-100%", trendDelta(0, 10))
+}
+
+func TestAlarmRollupReport(t *testing.T) {
+	t0 := time.Date(2014, 2, 10, 9, 0, 0, 0, time.UTC)
+	prev := newAlarmRollup(t0.AddDate(0, 0, -1))
+	prev.add(alarmMailMessage{worker: "MongoError", fingerprint: "fp1",
+		area: "us", severity: 10, receivedAt: t0.Add(-time.Hour)})
+
+	cur := newAlarmRollup(t0)
+	for i, area := range []string{"us", "de", "us"} {
+		cur.add(alarmMailMessage{worker: "MongoError", fingerprint: "fp1",
+			area: area, msg: area + " refused", severity: 10,
+			receivedAt: t0.Add(time.Duration(i) * time.Minute)})
+	}
+	cur.add(alarmMailMessage{worker: "MongoError", fingerprint: "fp2",
+		msg: "timeout", severity: 50, receivedAt: t0.Add(2 * time.Hour)})
+	cur.add(alarmMailMessage{worker: "Kernal", fingerprint: "fp3",
+		msg: "oom", severity: 5, receivedAt: t0})
+
+	r := cur.report("rs", DIGEST_DAILY, prev, t0.AddDate(0, 0, 1), 1)
+	assert.Equal(t, 5, r.Count)
+	assert.Equal(t, "+400%", r.CountDelta)
+	assert.Equal(t, 85, r.SeveritySum)
+	assert.Equal(t, 2, len(r.Workers))
+
+	w := r.Workers[0]
+	assert.Equal(t, "MongoError", w.Worker)
+	assert.Equal(t, 4, w.Count)
+	assert.Equal(t, "+300%", w.CountDelta)
+	assert.Equal(t, 3, w.PeakCount)
+	assert.Equal(t, []alarmDigestArea{{"us", 2}, {"de", 1}}, w.Areas)
+	assert.Equal(t, []alarmRollupFingerprint{{"timeout", 1, 50}}, w.Top)
+	assert.Equal(t, "new", r.Workers[1].CountDelta)
+
+	tpl, err := loadAlarmTemplate("", "", defaultAlarmDigestText,
+		defaultAlarmDigestHtml, true)
+	assert.Equal(t, nil, err)
+	text, html, err := tpl.render(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, strings.Contains(text,
+		"== MongoError: 4 alarms (+300%), severity 80 (+700%)"))
+	assert.Equal(t, true, strings.Contains(text, "areas: us=2 de=1"))
+	assert.Equal(t, true, strings.Contains(html, "<td>timeout</td>"))
+}
+
+func TestAlarmDigestSchedule(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "alarm_digest")
+	defer os.RemoveAll(dir)
+
+	d := &alarmDigest{daily: true, weekly: true, hour: 9, weekday: time.Monday,
+		topN: 10, checkpoint: filepath.Join(dir, "digest.gob")}
+	sun := time.Date(2014, 2, 9, 15, 0, 0, 0, time.UTC)
+	assert.Equal(t, nil, d.restore(sun))
+	d.add(alarmMailMessage{worker: "MongoError", severity: 10, receivedAt: sun})
+
+	// fresh start waits for the next schedule
+	assert.Equal(t, 0, len(d.due("rs", sun.Add(time.Hour))))
+	mon := sun.Add(15 * time.Hour) // 06:00
+	assert.Equal(t, 0, len(d.due("rs", mon)))
+
+	// restart keeps the rollups
+	assert.Equal(t, nil, d.dump())
+	d = &alarmDigest{daily: true, weekly: true, hour: 9, weekday: time.Monday,
+		topN: 10, checkpoint: d.checkpoint}
+	assert.Equal(t, nil, d.restore(mon))
+
+	reports := d.due("rs", mon.Add(4*time.Hour))
+	assert.Equal(t, 2, len(reports))
+	assert.Equal(t, DIGEST_DAILY, reports[0].Period)
+	assert.Equal(t, 1, reports[0].Count)
+	assert.Equal(t, DIGEST_WEEKLY, reports[1].Period)
+	assert.Equal(t, 1, reports[1].Count)
+
+	// sent once a day
+	assert.Equal(t, 0, len(d.due("rs", mon.Add(5*time.Hour))))
+	reports = d.due("rs", mon.Add(28*time.Hour))
+	assert.Equal(t, 1, len(reports))
+	assert.Equal(t, 0, reports[0].Count)
+	assert.Equal(t, "-100%", reports[0].CountDelta)
+}
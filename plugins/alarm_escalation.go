@@ -0,0 +1,125 @@
+package plugins
+
+import (
+	"fmt"
+	conf "github.com/funkygao/jsconf"
+	"time"
+)
+
+// Tier paged when an alarm keeps firing or stays unacked
+type alarmEscalationTier struct {
+	recipients []string
+	windows    int           // fired this many windows, 0 means disabled
+	ackTimeout time.Duration // unacked this long since first fired, 0 means disabled
+}
+
+func (this *alarmEscalationTier) load(section *conf.Conf) {
+	this.recipients = splitRecipients(section.String("recipients", ""))
+	if len(this.recipients) == 0 {
+		panic("escalation tier can't have no recipients")
+	}
+	this.windows = section.Int("windows", 0)
+	this.ackTimeout = time.Duration(section.Int("ack_timeout", 0)) * time.Second
+	if this.windows <= 0 && this.ackTimeout <= 0 {
+		panic("escalation tier needs 'windows' or 'ack_timeout'")
+	}
+}
+
+func (this *alarmEscalationTier) due(alarm *alarmEscalated, now time.Time) bool {
+	return (this.windows > 0 && alarm.windows >= this.windows) ||
+		(this.ackTimeout > 0 && now.Sub(alarm.first) >= this.ackTimeout)
+}
+
+// An alarm key under escalation
+type alarmEscalated struct {
+	msg     alarmMailMessage // the latest
+	first   time.Time
+	last    time.Time
+	windows int // times fired
+	tier    int // tiers paged, 0 means only the mail recipients
+}
+
+// Alarms to page, key is index of the escalation tiers
+type alarmPages map[int][]alarmMailMessage
+
+// Escalation policy of a project's alarm mail, the mail recipients are
+// tier 1. During suppress hours only alarms of wake severity are mailed
+// at once and escalated, the others wait for the morning.
+type alarmEscalation struct {
+	tiers          []*alarmEscalationTier // tier 2 and on
+	resetAfter     time.Duration          // alarm idle this long starts over at tier 1
+	wakeSeverity   int                    // 0 means never wake
+	wakeRecipients []string
+	wakeInterval   time.Duration
+
+	alarms map[string]*alarmEscalated // key is alarm key
+}
+
+func (this *alarmEscalation) load(section *conf.Conf, recipients []string) {
+	this.tiers = make([]*alarmEscalationTier, 0)
+	for i := 0; i < len(section.List("tiers", nil)); i++ {
+		tierSection, err := section.Section(fmt.Sprintf("tiers[%d]", i))
+		if err != nil {
+			panic(err)
+		}
+
+		tier := new(alarmEscalationTier)
+		tier.load(tierSection)
+		this.tiers = append(this.tiers, tier)
+	}
+
+	this.resetAfter = time.Duration(section.Int("reset_after", 3600)) * time.Second
+	this.wakeSeverity = section.Int("wake_severity", 0)
+	this.wakeRecipients = splitRecipients(section.String("wake_recipients", ""))
+	if len(this.wakeRecipients) == 0 {
+		this.wakeRecipients = recipients
+	}
+	this.wakeInterval = time.Duration(section.Int("wake_interval", 300)) * time.Second
+	this.alarms = make(map[string]*alarmEscalated)
+}
+
+func (this *alarmEscalation) wakes(msg alarmMailMessage) bool {
+	return this.wakeSeverity > 0 && msg.severity >= this.wakeSeverity
+}
+
+// Track a fired alarm, returns the tiers it reached by persisting
+func (this *alarmEscalation) observe(msg alarmMailMessage, now time.Time) alarmPages {
+	alarm, present := this.alarms[msg.key]
+	if !present || now.Sub(alarm.last) >= this.resetAfter {
+		alarm = &alarmEscalated{first: now}
+		this.alarms[msg.key] = alarm
+	}
+	alarm.msg = msg
+	alarm.last = now
+	alarm.windows += 1
+
+	pages := make(alarmPages)
+	this.escalate(alarm, now, pages)
+	return pages
+}
+
+// Escalate alarms not acked in time and forget the muted or idle ones
+func (this *alarmEscalation) check(now time.Time, suppressed bool,
+	muted func(alarmMailMessage, time.Time) bool) alarmPages {
+	pages := make(alarmPages)
+	for key, alarm := range this.alarms {
+		if now.Sub(alarm.last) >= this.resetAfter || muted(alarm.msg, now) {
+			delete(this.alarms, key)
+			continue
+		}
+
+		if !suppressed || this.wakes(alarm.msg) {
+			this.escalate(alarm, now, pages)
+		}
+	}
+
+	return pages
+}
+
+func (this *alarmEscalation) escalate(alarm *alarmEscalated, now time.Time,
+	pages alarmPages) {
+	for alarm.tier < len(this.tiers) && this.tiers[alarm.tier].due(alarm, now) {
+		pages[alarm.tier] = append(pages[alarm.tier], alarm.msg)
+		alarm.tier += 1
+	}
+}
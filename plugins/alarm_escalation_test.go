@@ -0,0 +1,75 @@
+package plugins
+
+import (
+	"github.com/funkygao/assert"
+	"testing"
+	"time"
+)
+
+func newTestAlarmEscalation() *alarmEscalation {
+	return &alarmEscalation{
+		tiers: []*alarmEscalationTier{
+			{recipients: []string{"oncall"}, windows: 3, ackTimeout: 10 * time.Minute},
+			{recipients: []string{"boss"}, ackTimeout: 30 * time.Minute},
+		},
+		resetAfter: time.Hour, wakeSeverity: 100,
+		alarms: make(map[string]*alarmEscalated)}
+}
+
+func TestAlarmEscalationWindows(t *testing.T) {
+	e := newTestAlarmEscalation()
+	t0 := time.Now()
+	msg := alarmMailMessage{worker: "MongoError", key: "k1", severity: 10}
+
+	assert.Equal(t, 0, len(e.observe(msg, t0)))
+	assert.Equal(t, 0, len(e.observe(msg, t0.Add(time.Minute))))
+	pages := e.observe(msg, t0.Add(2*time.Minute))
+	assert.Equal(t, 1, len(pages))
+	assert.Equal(t, 1, len(pages[0]))
+	// paged once per tier
+	assert.Equal(t, 0, len(e.observe(msg, t0.Add(3*time.Minute))))
+
+	// idle long enough and it starts over
+	assert.Equal(t, 0, len(e.observe(msg, t0.Add(2*time.Hour))))
+	assert.Equal(t, 1, e.alarms["k1"].windows)
+	assert.Equal(t, 0, e.alarms["k1"].tier)
+}
+
+func TestAlarmEscalationAckTimeout(t *testing.T) {
+	e := newTestAlarmEscalation()
+	t0 := time.Now()
+	notMuted := func(alarmMailMessage, time.Time) bool { return false }
+	e.observe(alarmMailMessage{key: "k1", severity: 10}, t0)
+	e.observe(alarmMailMessage{key: "k2", severity: 10}, t0)
+	e.observe(alarmMailMessage{key: "k3", severity: 200}, t0)
+
+	assert.Equal(t, 0, len(e.check(t0.Add(5*time.Minute), false, notMuted)))
+
+	// acked alarm is forgotten
+	pages := e.check(t0.Add(10*time.Minute), false,
+		func(msg alarmMailMessage, now time.Time) bool {
+			return msg.key == "k2"
+		})
+	assert.Equal(t, 1, len(pages))
+	assert.Equal(t, 2, len(pages[0]))
+	assert.Equal(t, 2, len(e.alarms))
+
+	// only alarms of wake severity escalate during suppress hours
+	pages = e.check(t0.Add(30*time.Minute), true, notMuted)
+	assert.Equal(t, 1, len(pages[1]))
+	assert.Equal(t, "k3", pages[1][0].key)
+	pages = e.check(t0.Add(31*time.Minute), false, notMuted)
+	assert.Equal(t, 1, len(pages[1]))
+	assert.Equal(t, "k1", pages[1][0].key)
+
+	assert.Equal(t, 0, len(e.check(t0.Add(2*time.Hour), false, notMuted)))
+	assert.Equal(t, 0, len(e.alarms))
+}
+
+func TestAlarmEscalationWakes(t *testing.T) {
+	e := newTestAlarmEscalation()
+	assert.Equal(t, false, e.wakes(alarmMailMessage{severity: 99}))
+	assert.Equal(t, true, e.wakes(alarmMailMessage{severity: 100}))
+	e.wakeSeverity = 0
+	assert.Equal(t, false, e.wakes(alarmMailMessage{severity: 1000}))
+}
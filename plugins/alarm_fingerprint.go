@@ -0,0 +1,167 @@
+package plugins
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const alarmGroupMaxAreas = 50
+
+// Fingerprint of an alarm ignores its area and the volatile parts of its
+// fields, so the same error from many areas or with different ids merges
+type alarmFingerprinter struct {
+	normalizers []string // applied in order
+}
+
+func newAlarmFingerprinter(names []string) *alarmFingerprinter {
+	for _, name := range names {
+		if _, present := normalizers[name]; !present {
+			panic("unknown normalizer: " + name)
+		}
+	}
+
+	return &alarmFingerprinter{normalizers: names}
+}
+
+// Alarms without fields fingerprint by their key
+func (this *alarmFingerprinter) fingerprint(msg alarmMailMessage) string {
+	if len(msg.fields) == 0 {
+		return msg.key
+	}
+
+	var buf bytes.Buffer
+	for i, field := range msg.fields {
+		if i > 0 {
+			buf.WriteByte(0)
+		}
+		buf.WriteString(this.normalize(field))
+	}
+	return alarmKeyOf(msg.worker, buf.String())
+}
+
+func (this *alarmFingerprinter) normalize(s string) string {
+	for _, name := range this.normalizers {
+		s = normalizers[name].ReplaceAllString(s, "?")
+	}
+	return s
+}
+
+func alarmFieldString(val interface{}) string {
+	switch v := val.(type) {
+	case string:
+		return v
+	case []byte: // sql backend text column
+		return string(v)
+	}
+	return fmt.Sprint(val)
+}
+
+func alarmFieldStrings(vals []interface{}) []string {
+	r := make([]string, 0, len(vals))
+	for _, val := range vals {
+		r = append(r, alarmFieldString(val))
+	}
+	return r
+}
+
+// Alarms of the same fingerprint
+type alarmGroup struct {
+	Fingerprint string    `json:"fingerprint"`
+	Worker      string    `json:"worker"`
+	Msg         string    `json:"msg"` // the latest
+	Count       int       `json:"count"`
+	SeveritySum int       `json:"severity_sum"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	Areas       []string  `json:"areas"`
+}
+
+func (this *alarmGroup) addArea(area string) {
+	if area == "" || len(this.Areas) >= alarmGroupMaxAreas {
+		return
+	}
+
+	i := sort.SearchStrings(this.Areas, area)
+	if i < len(this.Areas) && this.Areas[i] == area {
+		return
+	}
+	this.Areas = append(this.Areas, "")
+	copy(this.Areas[i+1:], this.Areas[i:])
+	this.Areas[i] = area
+}
+
+// Recent alarm groups of a project for the http api
+type alarmGrouper struct {
+	sync.Mutex
+
+	ttl    time.Duration // group forgotten after idle this long
+	groups map[string]*alarmGroup
+}
+
+func newAlarmGrouper(ttl time.Duration) *alarmGrouper {
+	return &alarmGrouper{ttl: ttl, groups: make(map[string]*alarmGroup)}
+}
+
+func (this *alarmGrouper) add(msg alarmMailMessage) {
+	this.Lock()
+	defer this.Unlock()
+
+	group, present := this.groups[msg.fingerprint]
+	if !present {
+		group = &alarmGroup{Fingerprint: msg.fingerprint, Worker: msg.worker,
+			FirstSeen: msg.receivedAt, Areas: make([]string, 0)}
+		this.groups[msg.fingerprint] = group
+	}
+
+	group.Msg = msg.msg
+	group.Count += 1
+	group.SeveritySum += msg.severity
+	group.LastSeen = msg.receivedAt
+	group.addArea(msg.area)
+}
+
+func (this *alarmGrouper) refresh(now time.Time) {
+	this.Lock()
+	defer this.Unlock()
+
+	for fp, group := range this.groups {
+		if now.Sub(group.LastSeen) >= this.ttl {
+			delete(this.groups, fp)
+		}
+	}
+}
+
+// Most severe first
+func (this *alarmGrouper) list() []alarmGroup {
+	this.Lock()
+	defer this.Unlock()
+
+	groups := make([]alarmGroup, 0, len(this.groups))
+	for _, group := range this.groups {
+		g := *group
+		g.Areas = append([]string{}, group.Areas...)
+		groups = append(groups, g)
+	}
+	sort.Sort(alarmGroups(groups))
+	return groups
+}
+
+type alarmGroups []alarmGroup
+
+func (this alarmGroups) Len() int {
+	return len(this)
+}
+
+func (this alarmGroups) Less(i, j int) bool {
+	if this[i].SeveritySum == this[j].SeveritySum {
+		return this[i].LastSeen.After(this[j].LastSeen)
+	}
+	return this[i].SeveritySum > this[j].SeveritySum
+}
+
+func (this alarmGroups) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+}
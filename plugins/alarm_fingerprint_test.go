@@ -0,0 +1,62 @@
+package plugins
+
+import (
+	"github.com/funkygao/assert"
+	"testing"
+	"time"
+)
+
+func TestAlarmNormalizers(t *testing.T) {
+	f := newAlarmFingerprinter([]string{"uuid", "email", "ip", "hex", "digit"})
+	assert.Equal(t, "user ? of ? not found at ?, obj ? ? code ?",
+		f.normalize("user 3f2504e0-4f89-11d3-9a0c-0305e82c3301 of peng.gao@funplusgame.com not found at 10.0.1.12:27017, obj 52f5c0e9a1b2c3d4e5f60718 0x1f code 11000"))
+	assert.Equal(t, "deadline exceeded", f.normalize("deadline exceeded"))
+
+	assert.Equal(t, nil, registerNormalizer("order_id_test", `ORD\d+`))
+	assert.NotEqual(t, nil, registerNormalizer("order_id_test", `ORD\d+`))
+	assert.NotEqual(t, nil, registerNormalizer("bad_test", `(`))
+}
+
+func TestAlarmFingerprint(t *testing.T) {
+	f := newAlarmFingerprinter([]string{"hex", "digit"})
+	us := alarmMailMessage{worker: "MongoError", key: "k1", area: "us",
+		fields: []string{"E11000 duplicate key 52f5c0e9a1b2c3d4e5f60718"}}
+	de := alarmMailMessage{worker: "MongoError", key: "k2", area: "de",
+		fields: []string{"E11000 duplicate key 52f5c0e9a1b2c3d4e5f60799"}}
+	assert.Equal(t, f.fingerprint(us), f.fingerprint(de))
+
+	de.worker = "BizError"
+	assert.NotEqual(t, f.fingerprint(us), f.fingerprint(de))
+
+	// absence and rule alarms have no fields
+	assert.Equal(t, "k3", f.fingerprint(alarmMailMessage{key: "k3"}))
+
+	assert.Equal(t, []string{"12", "a", "0.5"},
+		alarmFieldStrings([]interface{}{int64(12), []byte("a"), 0.5}))
+}
+
+func TestAlarmGrouper(t *testing.T) {
+	g := newAlarmGrouper(time.Hour)
+	t0 := time.Unix(1388600000, 0)
+	for i, area := range []string{"us", "de", "us", "br"} {
+		g.add(alarmMailMessage{worker: "MongoError", fingerprint: "fp1",
+			area: area, msg: area + " timeout", severity: 10,
+			receivedAt: t0.Add(time.Duration(i) * time.Minute)})
+	}
+	g.add(alarmMailMessage{worker: "Kernal", fingerprint: "fp2", severity: 5,
+		receivedAt: t0.Add(30 * time.Minute)})
+
+	groups := g.list()
+	assert.Equal(t, 2, len(groups))
+	assert.Equal(t, "fp1", groups[0].Fingerprint)
+	assert.Equal(t, 4, groups[0].Count)
+	assert.Equal(t, 40, groups[0].SeveritySum)
+	assert.Equal(t, []string{"br", "de", "us"}, groups[0].Areas)
+	assert.Equal(t, t0, groups[0].FirstSeen)
+	assert.Equal(t, t0.Add(3*time.Minute), groups[0].LastSeen)
+	assert.Equal(t, "br timeout", groups[0].Msg)
+	assert.Equal(t, 0, len(groups[1].Areas))
+
+	g.refresh(t0.Add(65 * time.Minute))
+	assert.Equal(t, 1, len(g.list()))
+}
@@ -0,0 +1,192 @@
+package plugins
+
+import (
+	"bytes"
+	"github.com/funkygao/dpipe/engine"
+	htemplate "html/template"
+	"io/ioutil"
+	"strings"
+	ttemplate "text/template"
+	"time"
+)
+
+const defaultAlarmMailText = `{{if .Note}}{{.Note}}
+
+{{end}}{{range .Groups}}== {{.Worker}}: {{.Count}} alarms, severity {{.SeveritySum}}
+{{range .Alarms}}{{.Time}}[{{printf "%4d" .Severity}}]{{if .High}} !!!{{end}} {{.Msg}}{{if gt .Count 1}} (x{{.Count}} {{.FirstSeen}} ~ {{.LastSeen}}{{if .Areas}}, areas: {{.AreaList}}{{end}}){{end}}
+{{end}}
+{{end}}{{if .Dropped}}{{.Dropped}} alarms of lowest severity dropped on queue overflow
+{{end}}====
+dpipe
+`
+
+const defaultAlarmMailHtml = `<html><body style="font-family: monospace">
+<h3>ALS[{{.Project}}] alarms at {{.Time}}</h3>
+{{if .Note}}<p><b>{{.Note}}</b></p>{{end}}
+{{range .Groups}}
+<h4>{{.Worker}}: {{.Count}} alarms, severity {{.SeveritySum}}</h4>
+<table border="1" cellspacing="0" cellpadding="3">
+<tr><th>time</th><th>severity</th><th>alarm</th><th>count</th><th>first ~ last seen</th><th>areas</th></tr>
+{{range .Alarms}}<tr{{if .High}} style="color: #fff; background: #d9534f; font-weight: bold"{{end}}>
+<td>{{.Time}}</td><td align="right">{{.Severity}}</td><td>{{.Msg}}</td>
+<td align="right">{{.Count}}</td><td>{{if gt .Count 1}}{{.FirstSeen}} ~ {{.LastSeen}}{{end}}</td><td>{{.AreaList}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Dropped}}<p>{{.Dropped}} alarms of lowest severity dropped on queue overflow</p>{{end}}
+<p>dpipe</p>
+</body></html>
+`
+
+type alarmMailItem struct {
+	Time     string
+	Severity int // sum of the merged alarms
+	Msg      string
+	Abnormal bool
+	High     bool // severity highlighted
+	Count    int  // alarms merged by fingerprint
+	Areas    []string
+
+	fingerprint string
+	first, last time.Time
+}
+
+func (this alarmMailItem) FirstSeen() string {
+	return this.first.Format(engine.TIME_FORMAT)
+}
+
+func (this alarmMailItem) LastSeen() string {
+	return this.last.Format(engine.TIME_FORMAT)
+}
+
+func (this alarmMailItem) AreaList() string {
+	return strings.Join(this.Areas, ",")
+}
+
+// Alarms of a worker
+type alarmMailGroup struct {
+	Worker      string
+	Count       int
+	SeveritySum int
+	Alarms      []*alarmMailItem
+}
+
+// Data passed to the mail templates
+type alarmMail struct {
+	Project string
+	Time    string
+	Dropped int    // lowest severity alarms dropped due to queue overflow
+	Note    string // why the mail is sent if not the regular one
+	Groups  []*alarmMailGroup
+}
+
+// Groups are ordered by their most severe alarm if alarms added in
+// severity order, alarms of the same fingerprint are merged into one
+func (this *alarmMail) add(worker string, item alarmMailItem) {
+	var group *alarmMailGroup
+	for _, g := range this.Groups {
+		if g.Worker == worker {
+			group = g
+			break
+		}
+	}
+	if group == nil {
+		group = &alarmMailGroup{Worker: worker}
+		this.Groups = append(this.Groups, group)
+	}
+
+	group.Count += 1
+	group.SeveritySum += item.Severity
+	if item.Count == 0 {
+		item.Count = 1
+	}
+
+	if item.fingerprint != "" {
+		for _, merged := range group.Alarms {
+			if merged.fingerprint != item.fingerprint {
+				continue
+			}
+
+			merged.Count += item.Count
+			merged.Severity += item.Severity
+			merged.High = merged.High || item.High
+			merged.Abnormal = merged.Abnormal || item.Abnormal
+			if item.first.Before(merged.first) {
+				merged.first = item.first
+			}
+			if item.last.After(merged.last) {
+				merged.last = item.last
+			}
+			for _, area := range item.Areas {
+				if !stringsContain(merged.Areas, area) {
+					merged.Areas = append(merged.Areas, area)
+				}
+			}
+			return
+		}
+	}
+
+	group.Alarms = append(group.Alarms, &item)
+}
+
+type alarmMailTemplate struct {
+	text *ttemplate.Template
+	html *htemplate.Template // nil means text only mail
+}
+
+// Empty file means the built-in template
+func newAlarmMailTemplate(textFile, htmlFile string,
+	withHtml bool) (*alarmMailTemplate, error) {
+	return loadAlarmTemplate(textFile, htmlFile, defaultAlarmMailText,
+		defaultAlarmMailHtml, withHtml)
+}
+
+func loadAlarmTemplate(textFile, htmlFile, defaultText, defaultHtml string,
+	withHtml bool) (this *alarmMailTemplate, err error) {
+	this = new(alarmMailTemplate)
+	body := defaultText
+	if textFile != "" {
+		var data []byte
+		if data, err = ioutil.ReadFile(textFile); err != nil {
+			return
+		}
+		body = string(data)
+	}
+	if this.text, err = ttemplate.New("text").Parse(body); err != nil {
+		return
+	}
+
+	if !withHtml {
+		return
+	}
+
+	body = defaultHtml
+	if htmlFile != "" {
+		var data []byte
+		if data, err = ioutil.ReadFile(htmlFile); err != nil {
+			return
+		}
+		body = string(data)
+	}
+	this.html, err = htemplate.New("html").Parse(body)
+	return
+}
+
+// data is *alarmMail or *alarmDigestReport
+func (this *alarmMailTemplate) render(data interface{}) (text, html string,
+	err error) {
+	var buf bytes.Buffer
+	if err = this.text.Execute(&buf, data); err != nil {
+		return
+	}
+	text = buf.String()
+
+	if this.html != nil {
+		buf.Reset()
+		if err = this.html.Execute(&buf, data); err != nil {
+			return
+		}
+		html = buf.String()
+	}
+
+	return
+}
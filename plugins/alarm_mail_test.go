@@ -0,0 +1,71 @@
+package plugins
+
+import (
+	"github.com/funkygao/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlarmMailTemplate(t *testing.T) {
+	mail := &alarmMail{Project: "rs", Time: "01-02 03:04:05"}
+	mail.add("MongoError", alarmMailItem{Time: "03:04:01", Severity: 30,
+		Msg: "us connection refused", High: true})
+	mail.add("SlowResp", alarmMailItem{Time: "03:04:02", Severity: 10,
+		Msg: "us /pay <slow>"})
+	mail.add("MongoError", alarmMailItem{Time: "03:04:03", Severity: 5,
+		Msg: "de timeout"})
+	assert.Equal(t, 2, len(mail.Groups))
+	assert.Equal(t, 35, mail.Groups[0].SeveritySum)
+
+	tpl, err := newAlarmMailTemplate("", "", true)
+	assert.Equal(t, nil, err)
+	text, html, err := tpl.render(mail)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `== MongoError: 2 alarms, severity 35
+03:04:01[  30] !!! us connection refused
+03:04:03[   5] de timeout
+
+== SlowResp: 1 alarms, severity 10
+03:04:02[  10] us /pay <slow>
+
+====
+dpipe
+`, text)
+	assert.Equal(t, true, strings.Contains(html, "us /pay &lt;slow&gt;"))
+	assert.Equal(t, 1, strings.Count(html, "background: #d9534f"))
+
+	tpl, _ = newAlarmMailTemplate("", "", false)
+	_, html, _ = tpl.render(mail)
+	assert.Equal(t, "", html)
+}
+
+func TestAlarmMailMergeFingerprint(t *testing.T) {
+	t0 := time.Unix(1388600000, 0)
+	mail := &alarmMail{Project: "rs"}
+	mail.add("MongoError", alarmMailItem{Severity: 30, Msg: "us refused",
+		Areas: []string{"us"}, fingerprint: "fp1", first: t0, last: t0})
+	mail.add("MongoError", alarmMailItem{Severity: 20, Msg: "de refused",
+		Areas: []string{"de"}, fingerprint: "fp1", High: true,
+		first: t0.Add(-time.Minute), last: t0.Add(-time.Minute)})
+	mail.add("MongoError", alarmMailItem{Severity: 10, Msg: "us refused",
+		Areas: []string{"us"}, fingerprint: "fp1",
+		first: t0.Add(time.Minute), last: t0.Add(time.Minute)})
+	mail.add("MongoError", alarmMailItem{Severity: 5, Msg: "us timeout",
+		Areas: []string{"us"}, fingerprint: "fp2", first: t0, last: t0})
+
+	group := mail.Groups[0]
+	assert.Equal(t, 4, group.Count)
+	assert.Equal(t, 65, group.SeveritySum)
+	assert.Equal(t, 2, len(group.Alarms))
+
+	merged := group.Alarms[0]
+	assert.Equal(t, "us refused", merged.Msg)
+	assert.Equal(t, 3, merged.Count)
+	assert.Equal(t, 60, merged.Severity)
+	assert.Equal(t, true, merged.High)
+	assert.Equal(t, "us,de", merged.AreaList())
+	assert.Equal(t, t0.Add(-time.Minute), merged.first)
+	assert.Equal(t, t0.Add(time.Minute), merged.last)
+	assert.Equal(t, 1, group.Alarms[1].Count)
+}
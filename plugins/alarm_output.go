@@ -1,23 +1,28 @@
 package plugins
 
 import (
-	"bytes"
-	"container/heap"
+	"errors"
 	"fmt"
 	"github.com/funkygao/dpipe/engine"
-	"github.com/funkygao/golib/bjtime"
 	"github.com/funkygao/golib/observer"
-	"github.com/funkygao/golib/pqueue"
 	conf "github.com/funkygao/jsconf"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
 	"sync"
 	"time"
 )
 
 type alarmMailMessage struct {
-	msg        string
-	severity   int
-	abnormal   bool
-	receivedAt time.Time
+	worker      string // title of the alarm worker
+	msg         string
+	key         string // identity of the alarm for silencing and ack
+	area        string
+	fields      []string // fingerprint source besides worker
+	fingerprint string
+	severity    int
+	abnormal    bool
+	receivedAt  time.Time
 }
 
 func (this alarmMailMessage) String() string {
@@ -25,18 +30,34 @@ func (this alarmMailMessage) String() string {
 }
 
 type alarmProjectMailConf struct {
-	recipients        string
+	recipients        []string
 	severityPoolSize  int
 	severityThreshold int
+	highlightSeverity int
 	suppressHours     []int
 	interval          int
+	template          *alarmMailTemplate
+	escalation        *alarmEscalation // nil if no escalation
+
+	maxQueueSize       int
+	checkpoint         string // pending alarms are persisted here
+	checkpointInterval time.Duration
 }
 
 type alarmProjectConf struct {
 	name     string
 	mailConf alarmProjectMailConf
 	workers  map[string]*alarmWorker // key is camelName
+	webhooks []*alarmWebhook
+	expects  []*alarmExpect
+	rules    []*alarmRule
+	silencer *alarmSilencer
+
+	fingerprinter *alarmFingerprinter
+	grouper       *alarmGrouper
+	digest        *alarmDigest // nil if no digest
 
+	alarmChan chan alarmMailMessage // from all the workers
 	emailChan chan alarmMailMessage
 	stopChan  chan interface{}
 }
@@ -53,14 +74,87 @@ func (this *alarmProjectConf) fromConfig(config *conf.Conf) {
 		this.mailConf.severityPoolSize = mailSection.Int("severity_pool_size", 100)
 		this.mailConf.severityThreshold = mailSection.Int("severity_threshold", 8)
 		this.mailConf.suppressHours = mailSection.IntList("suppress_hours", nil)
-		this.mailConf.recipients = mailSection.String("recipients", "")
-		if this.mailConf.recipients == "" {
+		this.mailConf.recipients = splitRecipients(mailSection.String("recipients", ""))
+		if len(this.mailConf.recipients) == 0 {
 			panic("mail alarm can't have no recipients")
 		}
 		this.mailConf.interval = mailSection.Int("interval", 300)
+		this.mailConf.highlightSeverity = mailSection.Int("highlight_severity", 20)
+		this.mailConf.maxQueueSize = mailSection.Int("max_queue_size", 10000)
+		this.mailConf.checkpoint = mailSection.String("checkpoint",
+			fmt.Sprintf("var/alarm_mail.%s.gob", this.name))
+		this.mailConf.checkpointInterval = time.Duration(
+			mailSection.Int("checkpoint_interval", 60)) * time.Second
+		this.mailConf.template, err = newAlarmMailTemplate(
+			mailSection.String("text_template", ""),
+			mailSection.String("html_template", ""),
+			mailSection.Bool("html", true))
+		if err != nil {
+			panic(err)
+		}
+		if section, err := mailSection.Section("escalation"); err == nil {
+			this.mailConf.escalation = new(alarmEscalation)
+			this.mailConf.escalation.load(section, this.mailConf.recipients)
+		}
+	}
+
+	if section, err := config.Section("alarm_digest"); err == nil {
+		this.digest = new(alarmDigest)
+		this.digest.load(section, this.name, this.mailConf.recipients)
+	}
+
+	this.webhooks = make([]*alarmWebhook, 0)
+	for i := 0; i < len(config.List("webhooks", nil)); i++ {
+		section, err := config.Section(fmt.Sprintf("webhooks[%d]", i))
+		if err != nil {
+			panic(err)
+		}
+
+		hook := new(alarmWebhook)
+		hook.load(section)
+		this.webhooks = append(this.webhooks, hook)
 	}
 
-	this.emailChan = make(chan alarmMailMessage)
+	this.expects = make([]*alarmExpect, 0)
+	for i := 0; i < len(config.List("expects", nil)); i++ {
+		section, err := config.Section(fmt.Sprintf("expects[%d]", i))
+		if err != nil {
+			panic(err)
+		}
+
+		expect := new(alarmExpect)
+		expect.load(section)
+		this.expects = append(this.expects, expect)
+	}
+
+	this.rules = make([]*alarmRule, 0)
+	for i := 0; i < len(config.List("rules", nil)); i++ {
+		section, err := config.Section(fmt.Sprintf("rules[%d]", i))
+		if err != nil {
+			panic(err)
+		}
+
+		rule := new(alarmRule)
+		rule.load(section)
+		this.rules = append(this.rules, rule)
+	}
+
+	this.fingerprinter = newAlarmFingerprinter(config.StringList(
+		"fingerprint_normalizers", []string{"uuid", "email", "ip", "hex", "digit"}))
+	this.grouper = newAlarmGrouper(time.Duration(
+		config.Int("group_ttl", 3600)) * time.Second)
+
+	this.silencer = newAlarmSilencer(config.String("silence_file",
+		fmt.Sprintf("var/alarm_silence.%s.json", this.name)),
+		time.Duration(config.Int("ack_ttl", 3600))*time.Second)
+	if err := this.silencer.load(); err != nil {
+		panic(err)
+	}
+
+	this.alarmChan = make(chan alarmMailMessage)
+	if len(this.mailConf.recipients) > 0 {
+		this.emailChan = make(chan alarmMailMessage)
+	}
 	workersMutex := new(sync.Mutex)
 	this.workers = make(map[string]*alarmWorker)
 	for i := 0; i < len(config.List("workers", nil)); i++ {
@@ -70,22 +164,42 @@ func (this *alarmProjectConf) fromConfig(config *conf.Conf) {
 		}
 
 		worker := &alarmWorker{projName: this.name,
-			emailChan: this.emailChan, workersMutex: workersMutex}
+			alarmChan: this.alarmChan, workersMutex: workersMutex}
 		worker.init(section, this.stopChan)
 		this.workers[worker.conf.camelName] = worker
 	}
-	if len(this.workers) == 0 {
+	if len(this.workers) == 0 && len(this.expects) == 0 && len(this.rules) == 0 {
 		panic(fmt.Sprintf("%s empty 'workers'", this.name))
 	}
 }
 
 type AlarmOutput struct {
 	projects map[string]alarmProjectConf // key is project name
+	mailer   *mailer
 	stopChan chan interface{}
+	senderWg *sync.WaitGroup
 }
 
 func (this *AlarmOutput) Init(config *conf.Conf) {
 	this.stopChan = make(chan interface{})
+	this.senderWg = new(sync.WaitGroup)
+	this.mailer = newMailer()
+	if section, err := config.Section("smtp"); err == nil {
+		this.mailer.load(section)
+	}
+	// custom normalizers must be ready before the workers init
+	for i := 0; i < len(config.List("normalizers", nil)); i++ {
+		section, err := config.Section(fmt.Sprintf("normalizers[%d]", i))
+		if err != nil {
+			panic(err)
+		}
+
+		if err = registerNormalizer(section.String("name", ""),
+			section.String("pattern", "")); err != nil {
+			panic(err)
+		}
+	}
+
 	this.projects = make(map[string]alarmProjectConf)
 	for i := 0; i < len(config.List("projects", nil)); i++ {
 		section, err := config.Section(fmt.Sprintf("projects[%d]", i))
@@ -108,14 +222,28 @@ func (this *AlarmOutput) Init(config *conf.Conf) {
 
 func (this *AlarmOutput) Run(r engine.OutputRunner, h engine.PluginHelper) error {
 	var (
-		pack       *engine.PipelinePack
-		reloadChan = make(chan interface{})
-		ok         = true
-		inChan     = r.InChan()
+		pack        *engine.PipelinePack
+		reloadChan  = make(chan interface{})
+		ok          = true
+		inChan      = r.InChan()
+		checkTicker = time.NewTicker(time.Second)
 	)
 
+	defer checkTicker.Stop()
+
 	for name, project := range this.projects {
-		go this.runSendAlarmsWatchdog(h.Project(name), project)
+		for _, hook := range project.webhooks {
+			this.senderWg.Add(1)
+			go hook.run(h.Project(name), this.senderWg)
+		}
+
+		if project.emailChan != nil {
+			this.senderWg.Add(1)
+			go this.runSendAlarmsWatchdog(h.Project(name), project)
+		}
+
+		this.senderWg.Add(1)
+		go this.runAlarmDispatcher(h.Project(name), project)
 	}
 
 	// start all the workers
@@ -127,6 +255,15 @@ func (this *AlarmOutput) Run(r engine.OutputRunner, h engine.PluginHelper) error
 		}
 	}
 
+	h.RegisterHttpApi("/alarm/{project}/{action}", func(w http.ResponseWriter,
+		req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return this.handleHttpRequest(w, req, params)
+	}).Methods("GET", "POST", "PUT", "DELETE")
+	h.RegisterHttpApi("/alarm/{project}/{action}/{id}", func(w http.ResponseWriter,
+		req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return this.handleHttpRequest(w, req, params)
+	}).Methods("PUT", "DELETE")
+
 	observer.Subscribe(engine.RELOAD, reloadChan)
 
 LOOP:
@@ -135,6 +272,9 @@ LOOP:
 		case <-reloadChan:
 			// TODO
 
+		case <-checkTicker.C:
+			this.checkWindows(h)
+
 		case pack, ok = <-inChan:
 			if !ok {
 				break LOOP
@@ -155,34 +295,241 @@ LOOP:
 	}
 
 	for _, project := range this.projects {
-		close(project.emailChan)
+		close(project.alarmChan)
 	}
 
+	// wait for the batched webhook alarms sent and mail queue persisted
+	this.senderWg.Wait()
+
 	return nil
 }
 
+// Fan out alarms of a project to the mail watchdog and webhooks unless
+// silenced or acked
+func (this *AlarmOutput) runAlarmDispatcher(project *engine.ConfProject,
+	config alarmProjectConf) {
+	defer this.senderWg.Done()
+
+	refreshTicker := time.NewTicker(time.Minute)
+	defer refreshTicker.Stop()
+
+	if config.digest != nil {
+		if err := config.digest.restore(project.Now()); err != nil {
+			project.Printf("alarm digest restore: %v", err)
+		}
+	}
+
+LOOP:
+	for {
+		select {
+		case <-refreshTicker.C:
+			if err := config.silencer.refresh(time.Now()); err != nil {
+				project.Printf("alarm silence: %v", err)
+			}
+			config.grouper.refresh(time.Now())
+			if config.digest != nil {
+				this.sendDigests(project, config.digest)
+			}
+
+		case alarmMessage, ok := <-config.alarmChan:
+			if !ok {
+				break LOOP
+			}
+
+			// rendered in the project timezone by all the channels
+			alarmMessage.receivedAt = alarmMessage.receivedAt.In(project.Location())
+			alarmMessage.fingerprint = config.fingerprinter.fingerprint(alarmMessage)
+			config.grouper.add(alarmMessage)
+			if config.digest != nil {
+				config.digest.add(alarmMessage)
+			}
+			if config.silencer.silenced(alarmMessage, time.Now()) {
+				continue
+			}
+
+			if config.emailChan != nil {
+				config.emailChan <- alarmMessage
+			}
+
+			for _, hook := range config.webhooks {
+				if hook.accept(alarmMessage) {
+					hook.feed(alarmMessage)
+				}
+			}
+		}
+	}
+
+	if config.emailChan != nil {
+		close(config.emailChan)
+	}
+	for _, hook := range config.webhooks {
+		close(hook.inChan)
+	}
+	if config.digest != nil {
+		if err := config.digest.dump(); err != nil {
+			project.Printf("alarm digest dump: %v", err)
+		}
+	}
+}
+
+func (this *AlarmOutput) sendDigests(project *engine.ConfProject,
+	digest *alarmDigest) {
+	for _, report := range digest.due(project.Name, project.Now()) {
+		text, html, err := digest.template.render(report)
+		if err != nil {
+			project.Printf("alarm digest: %v", err)
+			continue
+		}
+
+		go func(subject string) {
+			if err := this.mailer.send(digest.recipients, subject, text,
+				html); err != nil {
+				project.Printf("alarm digest=> %v: %v", digest.recipients, err)
+			}
+		}(fmt.Sprintf("ALS[%s] %s alarm digest", project.Name, report.Period))
+	}
+
+	if err := digest.dump(); err != nil {
+		project.Printf("alarm digest dump: %v", err)
+	}
+}
+
 func (this *AlarmOutput) handlePack(pack *engine.PipelinePack,
 	h engine.PluginHelper) {
-	if worker, present := this.projects[pack.Project].
-		workers[pack.Logfile.CamelCaseName()]; present {
+	project, present := this.projects[pack.Project]
+	if !present {
+		return
+	}
+
+	for _, expect := range project.expects {
+		expect.observe(pack)
+	}
+	for _, rule := range project.rules {
+		rule.observe(pack)
+	}
+
+	if worker, present := project.workers[pack.Logfile.CamelCaseName()]; present {
 		worker.inject(pack.Message, h.Project(pack.Project))
 	}
 }
 
+// Absence and rule alarms go the same way as worker alarms
+func (this *AlarmOutput) checkWindows(h engine.PluginHelper) {
+	for name, project := range this.projects {
+		now := h.Project(name).Now()
+		for _, expect := range project.expects {
+			if msg, fire := expect.check(now); fire {
+				project.alarmChan <- msg
+			}
+		}
+
+		for _, rule := range project.rules {
+			if msg, fire := rule.check(now); fire {
+				project.alarmChan <- msg
+			}
+		}
+	}
+}
+
+// GET    /alarm/{project}/active
+// GET    /alarm/{project}/silence
+// POST   /alarm/{project}/silence {"worker", "pattern", "duration", "comment"}
+// DELETE /alarm/{project}/silence/{id}
+// PUT    /alarm/{project}/ack/{key} {"comment"}
+// GET    /alarm/{project}/history
+// GET    /alarm/{project}/groups
+func (this *AlarmOutput) handleHttpRequest(w http.ResponseWriter,
+	req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	globals := engine.Globals()
+	if globals.Verbose {
+		globals.Println(req.Method, req.URL.Path)
+	}
+
+	project, present := this.projects[vars["project"]]
+	if !present {
+		return nil, errors.New("project not found: " + vars["project"])
+	}
+
+	var (
+		silencer = project.silencer
+		output   = make(map[string]interface{})
+		now      = time.Now()
+		id       = vars["id"]
+	)
+	switch vars["action"] + " " + req.Method {
+	case "active GET":
+		output["alarms"] = silencer.activeAlarms()
+
+	case "silence GET":
+		output["silences"] = silencer.activeSilences()
+
+	case "silence POST":
+		worker, _ := params["worker"].(string)
+		pattern, _ := params["pattern"].(string)
+		comment, _ := params["comment"].(string)
+		duration, _ := params["duration"].(float64) // in seconds
+		s, err := silencer.silence(worker, pattern,
+			time.Duration(duration)*time.Second, comment, now)
+		if err != nil {
+			return nil, err
+		}
+		output["silence"] = s
+
+	case "silence DELETE":
+		silenceId, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if err = silencer.unsilence(silenceId, now); err != nil {
+			return nil, err
+		}
+		output["msg"] = "ok"
+
+	case "ack PUT":
+		comment, _ := params["comment"].(string)
+		ack, err := silencer.ack(id, comment, now)
+		if err != nil {
+			return nil, err
+		}
+		output["ack"] = ack
+
+	case "history GET":
+		output["history"] = silencer.silenceHistory()
+
+	case "groups GET":
+		output["groups"] = project.grouper.list()
+
+	default:
+		return nil, fmt.Errorf("invalid request: %s %s", req.Method,
+			req.URL.Path)
+	}
+
+	return output, nil
+}
+
 func (this *AlarmOutput) runSendAlarmsWatchdog(project *engine.ConfProject,
 	config alarmProjectConf) {
+	defer this.senderWg.Done()
+
 	var (
-		mailQueue   = pqueue.New()
-		mailBody    bytes.Buffer
-		lastSending time.Time
-		mailLine    interface{}
+		mailConf         = config.mailConf
+		mailQueue        = newAlarmQueue(mailConf.maxQueueSize)
+		lastSending      time.Time
+		checkpointTicker = time.NewTicker(mailConf.checkpointInterval)
+		escalation       = mailConf.escalation
+		escalateTicker   = time.NewTicker(10 * time.Second)
+		wakeQueue        = newAlarmQueue(mailConf.maxQueueSize)
+		lastWaking       time.Time
 	)
 
+	defer checkpointTicker.Stop()
+	defer escalateTicker.Stop()
+
 	suppressedHour := func(hour int) bool {
 		// At night we are sleeping and will never checkout the alarms
 		// So queue it up till we've got up from bed
-		// FIXME will the mail queue overflow?
-		for _, h := range config.mailConf.suppressHours {
+		for _, h := range mailConf.suppressHours {
 			if hour == h {
 				return true
 			}
@@ -191,50 +538,160 @@ func (this *AlarmOutput) runSendAlarmsWatchdog(project *engine.ConfProject,
 		return false
 	}
 
-	heap.Init(mailQueue)
+	wake := func() {
+		if wakeQueue.Len() == 0 ||
+			(!lastWaking.IsZero() && time.Since(lastWaking) < escalation.wakeInterval) {
+			return
+		}
 
-	for alarmMessage := range config.emailChan {
-		if alarmMessage.severity < config.mailConf.severityThreshold {
-			// ignore little severity messages
-			continue
+		this.sendAlarmMail(project, mailConf, wakeQueue, escalation.wakeRecipients,
+			"urgent alarms", "Alarms of severity no less than "+
+				strconv.Itoa(escalation.wakeSeverity)+" during suppress hours")
+		lastWaking = time.Now()
+	}
+
+	dump := func() {
+		if !mailQueue.dirty {
+			return
 		}
 
-		// enque
-		heap.Push(mailQueue,
-			&pqueue.Item{
-				Value: fmt.Sprintf("%s[%4d] %s\n",
-					bjtime.TimeToString(alarmMessage.receivedAt),
-					alarmMessage.severity, alarmMessage.msg),
-				Priority: alarmMessage.severity})
+		if err := mailQueue.dump(mailConf.checkpoint); err != nil {
+			project.Printf("alarm mail queue dump: %v", err)
+		}
+	}
 
-		// check if send it out now
-		if !suppressedHour(bjtime.NowBj().Hour()) &&
-			mailQueue.PrioritySum() >= config.mailConf.severityPoolSize {
-			if !lastSending.IsZero() &&
-				time.Since(lastSending).Seconds() < float64(config.mailConf.interval) {
-				// we can't send too many emails in emergancy
+	// the alarms queued up before last shutdown
+	if err := mailQueue.load(mailConf.checkpoint); err != nil {
+		project.Printf("alarm mail queue load: %v", err)
+	} else if mailQueue.Len() > 0 {
+		project.Printf("alarm mail queue reloaded %d alarms", mailQueue.Len())
+	}
+
+LOOP:
+	for {
+		select {
+		case <-checkpointTicker.C:
+			dump()
+
+		case <-escalateTicker.C:
+			if escalation != nil {
+				this.sendEscalations(project, mailConf, escalation.check(time.Now(),
+					suppressedHour(project.Now().Hour()), config.silencer.muted))
+				wake()
+			}
+
+		case alarmMessage, ok := <-config.emailChan:
+			if !ok {
+				break LOOP
+			}
+
+			if alarmMessage.severity < mailConf.severityThreshold {
+				// ignore little severity messages
 				continue
 			}
 
-			// gather mail body content
-			for {
-				if mailQueue.Len() == 0 {
-					break
+			suppressed := suppressedHour(project.Now().Hour())
+			if escalation != nil {
+				if !suppressed || escalation.wakes(alarmMessage) {
+					this.sendEscalations(project, mailConf,
+						escalation.observe(alarmMessage, time.Now()))
 				}
 
-				mailLine = heap.Pop(mailQueue)
-				mailBody.WriteString(mailLine.(*pqueue.Item).Value.(string))
+				if suppressed && escalation.wakes(alarmMessage) {
+					// too urgent to wait till morning
+					wakeQueue.add(alarmMessage)
+					wake()
+					continue
+				}
 			}
 
-			go Sendmail(config.mailConf.recipients,
-				fmt.Sprintf("ALS[%s] alarms", project.Name), mailBody.String())
+			mailQueue.add(alarmMessage)
 
-			project.Printf("alarm sent=> %s", config.mailConf.recipients)
+			// check if send it out now
+			if suppressed || mailQueue.severitySum() < mailConf.severityPoolSize {
+				continue
+			}
+			if !lastSending.IsZero() &&
+				time.Since(lastSending).Seconds() < float64(mailConf.interval) {
+				// we can't send too many emails in emergancy
+				continue
+			}
 
-			mailBody.Reset()
+			this.sendAlarmMail(project, mailConf, mailQueue, mailConf.recipients,
+				"alarms", "")
 			lastSending = time.Now()
 		}
 	}
+
+	// urgent alarms not sent yet wait in the mail queue
+	for _, msg := range wakeQueue.drain() {
+		mailQueue.add(msg)
+	}
+	dump()
+	if mailQueue.Len() > 0 {
+		project.Printf("alarm mail queue persisted %d alarms", mailQueue.Len())
+	}
+}
+
+// Mail escalated alarms to their tiers
+func (this *AlarmOutput) sendEscalations(project *engine.ConfProject,
+	mailConf alarmProjectMailConf, pages alarmPages) {
+	for i, msgs := range pages {
+		queue := newAlarmQueue(0)
+		for _, msg := range msgs {
+			queue.add(msg)
+		}
+
+		this.sendAlarmMail(project, mailConf, queue,
+			mailConf.escalation.tiers[i].recipients,
+			fmt.Sprintf("escalated alarms (tier %d)", i+2),
+			fmt.Sprintf("Escalated to tier %d for still firing or not acked, "+
+				"ack them by PUT /alarm/%s/ack/{key}, keys listed by GET /alarm/%s/active",
+				i+2, project.Name, project.Name))
+	}
+}
+
+func (this *AlarmOutput) sendAlarmMail(project *engine.ConfProject,
+	mailConf alarmProjectMailConf, mailQueue *alarmQueue, recipients []string,
+	subject, note string) {
+	// gather mail body content, most severe first
+	mail := &alarmMail{Project: project.Name, Dropped: mailQueue.droppedN,
+		Time: project.TimeToString(time.Now()), Note: note}
+	for _, msg := range mailQueue.drain() {
+		item := alarmMailItem{
+			Time:     project.TimeToString(msg.receivedAt),
+			Severity: msg.severity,
+			Msg:      msg.msg,
+			Abnormal: msg.abnormal,
+			High:     msg.severity >= mailConf.highlightSeverity,
+			Areas:    make([]string, 0, 1),
+
+			fingerprint: msg.fingerprint,
+			first:       msg.receivedAt,
+			last:        msg.receivedAt,
+		}
+		if msg.area != "" {
+			item.Areas = append(item.Areas, msg.area)
+		}
+		mail.add(msg.worker, item)
+	}
+
+	text, html, err := mailConf.template.render(mail)
+	if err != nil {
+		project.Printf("alarm mail: %v", err)
+		return
+	}
+
+	go func(to []string) {
+		if err := this.mailer.send(to,
+			fmt.Sprintf("ALS[%s] %s", project.Name, subject),
+			text, html); err != nil {
+			project.Printf("alarm mail=> %v: %v", to, err)
+			return
+		}
+
+		project.Printf("alarm sent=> %v, dropped: %d", to, mail.Dropped)
+	}(recipients)
 }
 
 func init() {
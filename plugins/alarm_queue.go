@@ -0,0 +1,158 @@
+package plugins
+
+import (
+	"container/heap"
+	"encoding/gob"
+	"os"
+	"sort"
+	"time"
+)
+
+// Bounded alarm queue that drops the lowest severity alarm on overflow.
+// It's a min heap of severity, older alarm is less if same severity.
+type alarmQueue struct {
+	items    []alarmMailMessage
+	maxSize  int
+	sum      int // sum of severity
+	droppedN int
+	dirty    bool // changed since last dump
+}
+
+func newAlarmQueue(maxSize int) *alarmQueue {
+	return &alarmQueue{items: make([]alarmMailMessage, 0), maxSize: maxSize}
+}
+
+func (this *alarmQueue) Len() int {
+	return len(this.items)
+}
+
+func (this *alarmQueue) Less(i, j int) bool {
+	if this.items[i].severity == this.items[j].severity {
+		return this.items[i].receivedAt.Before(this.items[j].receivedAt)
+	}
+	return this.items[i].severity < this.items[j].severity
+}
+
+func (this *alarmQueue) Swap(i, j int) {
+	this.items[i], this.items[j] = this.items[j], this.items[i]
+}
+
+func (this *alarmQueue) Push(x interface{}) {
+	this.items = append(this.items, x.(alarmMailMessage))
+}
+
+func (this *alarmQueue) Pop() interface{} {
+	n := len(this.items)
+	item := this.items[n-1]
+	this.items = this.items[:n-1]
+	return item
+}
+
+// Enqueue an alarm, if full the lowest severity one is dropped
+func (this *alarmQueue) add(msg alarmMailMessage) {
+	this.dirty = true
+	if this.maxSize > 0 && len(this.items) >= this.maxSize {
+		if msg.severity <= this.items[0].severity {
+			this.droppedN += 1
+			return
+		}
+
+		dropped := heap.Pop(this).(alarmMailMessage)
+		this.sum -= dropped.severity
+		this.droppedN += 1
+	}
+
+	heap.Push(this, msg)
+	this.sum += msg.severity
+}
+
+func (this *alarmQueue) severitySum() int {
+	return this.sum
+}
+
+// Dequeue all, most severe first, and reset the dropped counter
+func (this *alarmQueue) drain() []alarmMailMessage {
+	sort.Sort(sort.Reverse(this))
+	items := this.items
+
+	this.items = make([]alarmMailMessage, 0)
+	this.sum = 0
+	this.droppedN = 0
+	this.dirty = true
+	return items
+}
+
+// gob needs exported fields
+type alarmQueueItem struct {
+	Worker      string
+	Msg         string
+	Key         string
+	Area        string
+	Fingerprint string
+	Severity    int
+	Abnormal    bool
+	ReceivedAt  time.Time
+}
+
+type alarmQueueCheckpoint struct {
+	Items    []alarmQueueItem
+	DroppedN int
+}
+
+func (this *alarmQueue) dump(fn string) error {
+	chkpnt := alarmQueueCheckpoint{DroppedN: this.droppedN,
+		Items: make([]alarmQueueItem, 0, len(this.items))}
+	for _, msg := range this.items {
+		chkpnt.Items = append(chkpnt.Items, alarmQueueItem{Worker: msg.worker,
+			Msg: msg.msg, Key: msg.key, Area: msg.area,
+			Fingerprint: msg.fingerprint, Severity: msg.severity, Abnormal: msg.abnormal,
+			ReceivedAt: msg.receivedAt})
+	}
+
+	// write then rename, a crash while dumping never corrupts the last one
+	tmp := fn + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(chkpnt)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	this.dirty = false
+	return nil
+}
+
+// Reload the alarms dumped by last run, missing file is not an error
+func (this *alarmQueue) load(fn string) error {
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var chkpnt alarmQueueCheckpoint
+	if err = gob.NewDecoder(f).Decode(&chkpnt); err != nil {
+		return err
+	}
+
+	for _, item := range chkpnt.Items {
+		this.add(alarmMailMessage{worker: item.Worker, msg: item.Msg, key: item.Key,
+			area: item.Area, fingerprint: item.Fingerprint,
+			severity: item.Severity, abnormal: item.Abnormal,
+			receivedAt: item.ReceivedAt})
+	}
+	this.droppedN += chkpnt.DroppedN
+	this.dirty = false
+	return nil
+}
@@ -0,0 +1,67 @@
+package plugins
+
+import (
+	"github.com/funkygao/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func severities(msgs []alarmMailMessage) []int {
+	r := make([]int, 0, len(msgs))
+	for _, msg := range msgs {
+		r = append(r, msg.severity)
+	}
+	return r
+}
+
+func TestAlarmQueueOverflow(t *testing.T) {
+	q := newAlarmQueue(3)
+	t0 := time.Unix(1388600000, 0)
+	for i, severity := range []int{5, 3, 8, 3, 1, 9} {
+		q.add(alarmMailMessage{msg: "x", severity: severity,
+			receivedAt: t0.Add(time.Duration(i) * time.Second)})
+	}
+
+	assert.Equal(t, 3, q.Len())
+	assert.Equal(t, 22, q.severitySum())
+	assert.Equal(t, 3, q.droppedN)
+
+	assert.Equal(t, []int{9, 8, 5}, severities(q.drain()))
+	assert.Equal(t, 0, q.Len())
+	assert.Equal(t, 0, q.severitySum())
+	assert.Equal(t, 0, q.droppedN)
+}
+
+func TestAlarmQueueDumpLoad(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "alarm_queue")
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "alarm.gob")
+
+	q := newAlarmQueue(2)
+	t0 := time.Unix(1388600000, 0)
+	q.add(alarmMailMessage{worker: "MongoError", msg: "refused", severity: 7,
+		abnormal: true, receivedAt: t0})
+	q.add(alarmMailMessage{worker: "SlowResp", msg: "/pay", severity: 3,
+		receivedAt: t0})
+	q.add(alarmMailMessage{worker: "SlowResp", msg: "/login", severity: 1,
+		receivedAt: t0})
+	assert.Equal(t, true, q.dirty)
+	assert.Equal(t, nil, q.dump(fn))
+	assert.Equal(t, false, q.dirty)
+
+	reloaded := newAlarmQueue(2)
+	assert.Equal(t, nil, reloaded.load(fn))
+	assert.Equal(t, 10, reloaded.severitySum())
+	assert.Equal(t, 1, reloaded.droppedN)
+	msgs := reloaded.drain()
+	assert.Equal(t, "MongoError", msgs[0].worker)
+	assert.Equal(t, "refused", msgs[0].msg)
+	assert.Equal(t, true, msgs[0].abnormal)
+	assert.Equal(t, true, t0.Equal(msgs[0].receivedAt))
+
+	// missing checkpoint file is a fresh start
+	assert.Equal(t, nil, newAlarmQueue(2).load(filepath.Join(dir, "none")))
+}
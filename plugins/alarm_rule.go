@@ -0,0 +1,239 @@
+package plugins
+
+import (
+	"fmt"
+	"github.com/funkygao/als"
+	"github.com/funkygao/dpipe/engine"
+	conf "github.com/funkygao/jsconf"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A named aggregate of the packs matched within the rule window
+type alarmRuleSeries struct {
+	name      string
+	ident     string // empty matches all
+	camelName string
+	field     string // numeric field, empty for count
+	agg       string // count | sum | avg | min | max | p<N>
+	quantile  float64
+	samples   int // cap of the percentile reservoir
+
+	n      int
+	sum    float64
+	min    float64
+	max    float64
+	values []float64
+}
+
+func (this *alarmRuleSeries) load(section *conf.Conf) {
+	this.name = section.String("name", "")
+	if this.name == "" {
+		panic("rule series must have 'name'")
+	}
+	this.ident = section.String("ident", "")
+	this.camelName = section.String("camel_name", "")
+	if this.ident == "" && this.camelName == "" {
+		panic(this.name + " series must have 'ident' or 'camel_name'")
+	}
+	this.field = section.String("field", "")
+	this.agg = section.String("agg", "count")
+	switch {
+	case this.agg == "count":
+	case this.agg == "sum", this.agg == "avg", this.agg == "min", this.agg == "max":
+	case strings.HasPrefix(this.agg, "p"):
+		q, err := strconv.ParseFloat(this.agg[1:], 64)
+		if err != nil || q <= 0 || q > 100 {
+			panic("invalid percentile: " + this.agg)
+		}
+		this.quantile = q / 100
+	default:
+		panic("invalid agg: " + this.agg)
+	}
+	if this.agg != "count" && this.field == "" {
+		panic(this.name + " series must have 'field' for " + this.agg)
+	}
+	this.samples = section.Int("samples", 10000)
+}
+
+func (this *alarmRuleSeries) observe(pack *engine.PipelinePack) {
+	if (this.ident != "" && this.ident != pack.Ident) ||
+		(this.camelName != "" && this.camelName != pack.Logfile.CamelCaseName()) {
+		return
+	}
+
+	if this.field == "" {
+		this.n += 1
+		return
+	}
+
+	val, err := pack.Message.FieldValue(this.field, als.KEY_TYPE_FLOAT)
+	if err != nil {
+		return
+	}
+	x, ok := windowFloat(val)
+	if !ok {
+		return
+	}
+	this.add(x)
+}
+
+func (this *alarmRuleSeries) add(x float64) {
+	this.n += 1
+	this.sum += x
+	if this.n == 1 || x < this.min {
+		this.min = x
+	}
+	if this.n == 1 || x > this.max {
+		this.max = x
+	}
+
+	if this.quantile == 0 {
+		return
+	}
+	// reservoir sampling keeps memory bounded
+	if len(this.values) < this.samples {
+		this.values = append(this.values, x)
+	} else if j := rand.Intn(this.n); j < this.samples {
+		this.values[j] = x
+	}
+}
+
+// Aggregate of the window, NaN if no value for other than count and sum
+func (this *alarmRuleSeries) value() float64 {
+	switch this.agg {
+	case "count":
+		return float64(this.n)
+	case "sum":
+		return this.sum
+	}
+
+	if this.n == 0 {
+		return math.NaN()
+	}
+
+	switch this.agg {
+	case "avg":
+		return this.sum / float64(this.n)
+	case "min":
+		return this.min
+	case "max":
+		return this.max
+	}
+
+	sort.Float64s(this.values)
+	i := int(math.Ceil(this.quantile*float64(len(this.values)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return this.values[i]
+}
+
+func (this *alarmRuleSeries) reset() {
+	this.n = 0
+	this.sum, this.min, this.max = 0, 0, 0
+	this.values = this.values[:0]
+}
+
+// Threshold or ratio rule over the series of a window
+type alarmRule struct {
+	title    string
+	window   time.Duration
+	series   []*alarmRuleSeries
+	rawExpr  string
+	expr     ruleExpr
+	value    ruleExpr
+	severity int
+	message  *fieldTemplate
+
+	windowStart time.Time
+}
+
+func (this *alarmRule) load(section *conf.Conf) {
+	this.title = section.String("title", "")
+	if this.title == "" {
+		panic("rule must have 'title'")
+	}
+	this.window = time.Duration(section.Int("window", 300)) * time.Second
+	this.severity = section.Int("severity", 100)
+
+	this.series = make([]*alarmRuleSeries, 0)
+	names := make([]string, 0)
+	for i := 0; i < len(section.List("series", nil)); i++ {
+		s, err := section.Section(fmt.Sprintf("series[%d]", i))
+		if err != nil {
+			panic(err)
+		}
+
+		series := new(alarmRuleSeries)
+		series.load(s)
+		this.series = append(this.series, series)
+		names = append(names, series.name)
+	}
+	if len(this.series) == 0 {
+		panic(this.title + " empty 'series'")
+	}
+
+	var err error
+	this.rawExpr = section.String("expr", "")
+	if this.expr, this.value, err = parseRuleExpr(this.rawExpr, names); err != nil {
+		panic(err)
+	}
+
+	this.message = newFieldTemplate(section.String("message",
+		"{value} on "+this.rawExpr))
+	for _, field := range this.message.fields() {
+		if field != "value" && !stringsContain(names, field) {
+			panic(this.title + " unknown message placeholder: " + field)
+		}
+	}
+}
+
+func (this *alarmRule) observe(pack *engine.PipelinePack) {
+	for _, series := range this.series {
+		series.observe(pack)
+	}
+}
+
+// Evaluate the rule when the window ends, then restart the window
+func (this *alarmRule) check(now time.Time) (msg alarmMailMessage, fire bool) {
+	if this.windowStart.IsZero() {
+		this.windowStart = now
+		return
+	}
+	if now.Sub(this.windowStart) < this.window {
+		return
+	}
+
+	this.windowStart = now
+	vars := make(map[string]float64, len(this.series)+1)
+	for _, series := range this.series {
+		vars[series.name] = series.value()
+		series.reset()
+	}
+
+	if !ruleTrue(this.expr(vars)) {
+		return
+	}
+
+	vars["value"] = this.value(vars)
+	text, _ := this.message.render(func(field string) (string, error) {
+		return strconv.FormatFloat(vars[field], 'g', 4, 64), nil
+	})
+	return alarmMailMessage{worker: this.title, msg: text,
+		key: alarmKeyOf(this.title, this.rawExpr), severity: this.severity,
+		receivedAt: now}, true
+}
+
+func stringsContain(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,249 @@
+package plugins
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Compiled rule expression, booleans are 1 and 0.
+// Division by zero yields NaN which never fires.
+type ruleExpr func(vars map[string]float64) float64
+
+// Rule expression grammar:
+//
+//	expr   := cond (("and" | "or") cond)*
+//	cond   := arith [(">" | ">=" | "<" | "<=" | "==" | "!=") arith]
+//	arith  := term (("+" | "-") term)*
+//	term   := factor (("*" | "/") factor)*
+//	factor := number | name | "(" expr ")" | "-" factor
+type ruleExprParser struct {
+	tokens []string
+	pos    int
+	names  map[string]bool // valid variable names
+	lhs    ruleExpr        // left side of the first comparison
+}
+
+// Parse the expression, value is the left side of the 1st comparison
+// for the alarm message
+func parseRuleExpr(s string, names []string) (expr, value ruleExpr, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("expr %s: %v", s, r)
+		}
+	}()
+
+	this := &ruleExprParser{tokens: tokenizeRuleExpr(s),
+		names: make(map[string]bool)}
+	for _, name := range names {
+		this.names[name] = true
+	}
+
+	expr = this.expr()
+	if this.pos < len(this.tokens) {
+		panic("unexpected " + this.tokens[this.pos])
+	}
+	value = this.lhs
+	if value == nil {
+		value = expr
+	}
+	return
+}
+
+func tokenizeRuleExpr(s string) []string {
+	tokens := make([]string, 0)
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case strings.ContainsRune("<>=!", c):
+			if i+1 < len(s) && s[i+1] == '=' {
+				tokens = append(tokens, s[i:i+2])
+				i += 2
+			} else {
+				tokens = append(tokens, s[i:i+1])
+				i++
+			}
+
+		case strings.ContainsRune("+-*/()", c):
+			tokens = append(tokens, s[i:i+1])
+			i++
+
+		default:
+			j := i
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) &&
+				!strings.ContainsRune("<>=!+-*/()", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+
+	return tokens
+}
+
+func (this *ruleExprParser) peek() string {
+	if this.pos < len(this.tokens) {
+		return this.tokens[this.pos]
+	}
+	return ""
+}
+
+func (this *ruleExprParser) next() string {
+	token := this.peek()
+	if token == "" {
+		panic("unexpected end")
+	}
+	this.pos++
+	return token
+}
+
+func (this *ruleExprParser) expr() ruleExpr {
+	left := this.cond()
+	for {
+		op := this.peek()
+		if op != "and" && op != "or" {
+			return left
+		}
+
+		this.next()
+		l, r := left, this.cond()
+		if op == "and" {
+			left = func(vars map[string]float64) float64 {
+				return ruleBool(ruleTrue(l(vars)) && ruleTrue(r(vars)))
+			}
+		} else {
+			left = func(vars map[string]float64) float64 {
+				return ruleBool(ruleTrue(l(vars)) || ruleTrue(r(vars)))
+			}
+		}
+	}
+}
+
+func (this *ruleExprParser) cond() ruleExpr {
+	l := this.arith()
+	op := this.peek()
+	switch op {
+	case ">", ">=", "<", "<=", "==", "!=":
+	default:
+		return l
+	}
+
+	this.next()
+	r := this.arith()
+	if this.lhs == nil {
+		this.lhs = l
+	}
+	return func(vars map[string]float64) float64 {
+		a, b := l(vars), r(vars)
+		switch op {
+		case ">":
+			return ruleBool(a > b)
+		case ">=":
+			return ruleBool(a >= b)
+		case "<":
+			return ruleBool(a < b)
+		case "<=":
+			return ruleBool(a <= b)
+		case "==":
+			return ruleBool(a == b)
+		}
+		return ruleBool(a != b && !math.IsNaN(a) && !math.IsNaN(b))
+	}
+}
+
+func (this *ruleExprParser) arith() ruleExpr {
+	left := this.term()
+	for {
+		op := this.peek()
+		if op != "+" && op != "-" {
+			return left
+		}
+
+		this.next()
+		l, r := left, this.term()
+		if op == "+" {
+			left = func(vars map[string]float64) float64 {
+				return l(vars) + r(vars)
+			}
+		} else {
+			left = func(vars map[string]float64) float64 {
+				return l(vars) - r(vars)
+			}
+		}
+	}
+}
+
+func (this *ruleExprParser) term() ruleExpr {
+	left := this.factor()
+	for {
+		op := this.peek()
+		if op != "*" && op != "/" {
+			return left
+		}
+
+		this.next()
+		l, r := left, this.factor()
+		if op == "*" {
+			left = func(vars map[string]float64) float64 {
+				return l(vars) * r(vars)
+			}
+		} else {
+			left = func(vars map[string]float64) float64 {
+				d := r(vars)
+				if d == 0 {
+					return math.NaN()
+				}
+				return l(vars) / d
+			}
+		}
+	}
+}
+
+func (this *ruleExprParser) factor() ruleExpr {
+	token := this.next()
+	switch token {
+	case "(":
+		e := this.expr()
+		if this.next() != ")" {
+			panic("missing )")
+		}
+		return e
+
+	case "-":
+		f := this.factor()
+		return func(vars map[string]float64) float64 {
+			return -f(vars)
+		}
+	}
+
+	if x, err := strconv.ParseFloat(token, 64); err == nil {
+		return func(vars map[string]float64) float64 {
+			return x
+		}
+	}
+
+	if !this.names[token] {
+		panic("unknown name " + token)
+	}
+	return func(vars map[string]float64) float64 {
+		return vars[token]
+	}
+}
+
+// NaN is false, so that an empty window never fires
+func ruleTrue(v float64) bool {
+	return v != 0 && !math.IsNaN(v)
+}
+
+func ruleBool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,101 @@
+package plugins
+
+import (
+	"github.com/funkygao/assert"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseRuleExpr(t *testing.T) {
+	names := []string{"errors", "pv", "p95"}
+	vars := map[string]float64{"errors": 30, "pv": 1000, "p95": 1.2}
+
+	expr, value, err := parseRuleExpr("errors / pv > 0.02", names)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, float64(1), expr(vars))
+	assert.Equal(t, 0.03, value(vars))
+
+	expr, _, _ = parseRuleExpr("pv >= 100 and (p95>1.5 or errors*2-1 >= 59)", names)
+	assert.Equal(t, float64(1), expr(vars))
+	expr, _, _ = parseRuleExpr("pv >= 100 and p95>1.5", names)
+	assert.Equal(t, float64(0), expr(vars))
+	expr, _, _ = parseRuleExpr("-errors < -29", names)
+	assert.Equal(t, float64(1), expr(vars))
+
+	// division by zero never fires
+	expr, value, _ = parseRuleExpr("errors / pv != 1", names)
+	assert.Equal(t, float64(0), expr(map[string]float64{"errors": 1}))
+	assert.Equal(t, true, math.IsNaN(value(map[string]float64{"errors": 1})))
+
+	for _, bad := range []string{"uv > 1", "errors >", "(errors > 1", "errors > 1 )", ""} {
+		_, _, err = parseRuleExpr(bad, names)
+		assert.NotEqual(t, nil, err)
+	}
+}
+
+func TestAlarmRuleSeries(t *testing.T) {
+	s := &alarmRuleSeries{agg: "p95", quantile: 0.95, samples: 1000}
+	assert.Equal(t, true, math.IsNaN(s.value()))
+	for i := 100; i >= 1; i-- {
+		s.add(float64(i))
+	}
+	assert.Equal(t, float64(95), s.value())
+
+	s.agg = "avg"
+	assert.Equal(t, 50.5, s.value())
+	s.agg = "max"
+	assert.Equal(t, float64(100), s.value())
+	s.agg = "min"
+	assert.Equal(t, float64(1), s.value())
+
+	s.reset()
+	s.agg = "count"
+	assert.Equal(t, float64(0), s.value())
+
+	// reservoir is bounded
+	s.samples = 10
+	for i := 0; i < 1000; i++ {
+		s.add(float64(i))
+	}
+	assert.Equal(t, 10, len(s.values))
+	assert.Equal(t, float64(1000), s.value())
+}
+
+func TestAlarmRuleCheck(t *testing.T) {
+	errors := &alarmRuleSeries{name: "errors", agg: "count"}
+	pv := &alarmRuleSeries{name: "pv", agg: "count"}
+	expr, value, _ := parseRuleExpr("errors / pv > 0.02", []string{"errors", "pv"})
+	r := &alarmRule{title: "ErrorRate", window: time.Minute, severity: 50,
+		series: []*alarmRuleSeries{errors, pv}, rawExpr: "errors / pv > 0.02",
+		expr: expr, value: value,
+		message: newFieldTemplate("error rate {value}: {errors}/{pv}")}
+
+	t0 := time.Unix(1388600000, 0)
+	_, fire := r.check(t0)
+	assert.Equal(t, false, fire)
+
+	errors.n, pv.n = 5, 100
+	_, fire = r.check(t0.Add(30 * time.Second))
+	assert.Equal(t, false, fire) // window not finished
+	msg, fire := r.check(t0.Add(time.Minute))
+	assert.Equal(t, true, fire)
+	assert.Equal(t, "error rate 0.05: 5/100", msg.msg)
+	assert.Equal(t, 50, msg.severity)
+	assert.Equal(t, 0, errors.n) // window restarted
+
+	errors.n, pv.n = 1, 100
+	_, fire = r.check(t0.Add(2 * time.Minute))
+	assert.Equal(t, false, fire)
+
+	// bare ratio on an empty window is NaN
+	r.expr, r.value, _ = parseRuleExpr("errors / pv", []string{"errors", "pv"})
+	errors.n, pv.n = 0, 0
+	_, fire = r.check(t0.Add(3 * time.Minute))
+	assert.Equal(t, false, fire)
+
+	r.expr, r.value, _ = parseRuleExpr("errors / pv or pv > 10",
+		[]string{"errors", "pv"})
+	_, fire = r.check(t0.Add(4 * time.Minute))
+	assert.Equal(t, false, fire)
+}
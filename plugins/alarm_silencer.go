@@ -0,0 +1,374 @@
+package plugins
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ALARM_SILENCE = "silence"
+	ALARM_ACK     = "ack"
+)
+
+// A silence mutes alarms of a worker and/or matching a pattern till
+// Until, an ack mutes an alarm key till it stops firing
+type alarmSilence struct {
+	Id      int64     `json:"id"`
+	Kind    string    `json:"kind"`
+	Worker  string    `json:"worker,omitempty"`
+	Pattern string    `json:"pattern,omitempty"`
+	Key     string    `json:"key,omitempty"`
+	Comment string    `json:"comment,omitempty"`
+	Created time.Time `json:"created"`
+	Until   time.Time `json:"until"`
+
+	re *regexp.Regexp
+}
+
+func (this *alarmSilence) compile() (err error) {
+	if this.Pattern != "" {
+		this.re, err = regexp.Compile(this.Pattern)
+	}
+	return
+}
+
+func (this *alarmSilence) match(msg alarmMailMessage) bool {
+	if this.Kind == ALARM_ACK {
+		return this.Key == msg.key
+	}
+
+	if this.Worker != "" && this.Worker != msg.worker {
+		return false
+	}
+	return this.re == nil || this.re.MatchString(msg.msg)
+}
+
+// An alarm key that fired recently
+type alarmActive struct {
+	Key       string    `json:"key"`
+	Worker    string    `json:"worker"`
+	Msg       string    `json:"msg"` // the latest
+	Severity  int       `json:"severity"`
+	Count     int       `json:"count"`
+	Muted     int       `json:"muted"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Acked     bool      `json:"acked"`
+}
+
+type alarmSilencerState struct {
+	NextId   int64
+	Silences []*alarmSilence
+	Acks     []*alarmSilence
+	History  []*alarmSilence
+}
+
+// Silences and acks of a project, persisted in a json file
+type alarmSilencer struct {
+	sync.Mutex
+
+	file        string
+	activeTtl   time.Duration // idle alarm key is forgotten and its ack cleared
+	historySize int
+
+	nextId   int64
+	silences []*alarmSilence
+	acks     map[string]*alarmSilence // key is alarm key
+	history  []*alarmSilence
+	active   map[string]*alarmActive
+}
+
+func newAlarmSilencer(file string, activeTtl time.Duration) *alarmSilencer {
+	return &alarmSilencer{file: file, activeTtl: activeTtl, historySize: 1000,
+		nextId: 1, silences: make([]*alarmSilence, 0),
+		acks: make(map[string]*alarmSilence), history: make([]*alarmSilence, 0),
+		active: make(map[string]*alarmActive)}
+}
+
+// Record the alarm as active and tell if it's muted
+func (this *alarmSilencer) silenced(msg alarmMailMessage, now time.Time) bool {
+	this.Lock()
+	defer this.Unlock()
+
+	active, present := this.active[msg.key]
+	if !present {
+		active = &alarmActive{Key: msg.key, Worker: msg.worker, FirstSeen: now}
+		this.active[msg.key] = active
+	}
+	active.Msg = msg.msg
+	active.Severity = msg.severity
+	active.Count += 1
+	active.LastSeen = now
+
+	if this.isMuted(msg, now) {
+		active.Muted += 1
+		return true
+	}
+	return false
+}
+
+// Tell if the alarm is acked or silenced without recording it
+func (this *alarmSilencer) muted(msg alarmMailMessage, now time.Time) bool {
+	this.Lock()
+	defer this.Unlock()
+
+	return this.isMuted(msg, now)
+}
+
+func (this *alarmSilencer) isMuted(msg alarmMailMessage, now time.Time) bool {
+	if _, acked := this.acks[msg.key]; acked {
+		return true
+	}
+	for _, s := range this.silences {
+		if now.Before(s.Until) && s.match(msg) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (this *alarmSilencer) silence(worker, pattern string, duration time.Duration,
+	comment string, now time.Time) (*alarmSilence, error) {
+	if worker == "" && pattern == "" {
+		return nil, errors.New("silence must have worker or pattern")
+	}
+	if duration <= 0 {
+		return nil, errors.New("invalid duration")
+	}
+
+	s := &alarmSilence{Kind: ALARM_SILENCE, Worker: worker, Pattern: pattern,
+		Comment: comment, Created: now, Until: now.Add(duration)}
+	if err := s.compile(); err != nil {
+		return nil, err
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	s.Id = this.nextId
+	this.nextId += 1
+	this.silences = append(this.silences, s)
+	return s, this.save()
+}
+
+// Lift a silence before it expires
+func (this *alarmSilencer) unsilence(id int64, now time.Time) error {
+	this.Lock()
+	defer this.Unlock()
+
+	for _, s := range this.silences {
+		if s.Id == id {
+			s.Until = now
+			this.expire(now)
+			return this.save()
+		}
+	}
+
+	return fmt.Errorf("silence %d not found", id)
+}
+
+func (this *alarmSilencer) ack(key, comment string, now time.Time) (*alarmSilence,
+	error) {
+	this.Lock()
+	defer this.Unlock()
+
+	active, present := this.active[key]
+	if !present {
+		return nil, fmt.Errorf("alarm %s not active", key)
+	}
+	if ack, present := this.acks[key]; present {
+		return ack, nil
+	}
+
+	ack := &alarmSilence{Id: this.nextId, Kind: ALARM_ACK, Worker: active.Worker,
+		Key: key, Comment: comment, Created: now}
+	this.nextId += 1
+	this.acks[key] = ack
+	active.Acked = true
+	return ack, this.save()
+}
+
+// Move expired silences and acks of idle keys to history
+func (this *alarmSilencer) expire(now time.Time) (changed bool) {
+	silences := this.silences[:0]
+	for _, s := range this.silences {
+		if now.Before(s.Until) {
+			silences = append(silences, s)
+		} else {
+			this.archive(s)
+			changed = true
+		}
+	}
+	this.silences = silences
+
+	for key, active := range this.active {
+		if now.Sub(active.LastSeen) < this.activeTtl {
+			continue
+		}
+
+		delete(this.active, key)
+		if ack, present := this.acks[key]; present {
+			ack.Until = now
+			this.archive(ack)
+			delete(this.acks, key)
+			changed = true
+		}
+	}
+
+	// acks restored from file whose key never fired again
+	for key, ack := range this.acks {
+		if _, present := this.active[key]; !present &&
+			now.Sub(ack.Created) >= this.activeTtl {
+			ack.Until = now
+			this.archive(ack)
+			delete(this.acks, key)
+			changed = true
+		}
+	}
+
+	return
+}
+
+func (this *alarmSilencer) archive(s *alarmSilence) {
+	this.history = append(this.history, s)
+	if len(this.history) > this.historySize {
+		this.history = this.history[len(this.history)-this.historySize:]
+	}
+}
+
+// Periodical housekeeping
+func (this *alarmSilencer) refresh(now time.Time) error {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.expire(now) {
+		return this.save()
+	}
+	return nil
+}
+
+func (this *alarmSilencer) activeAlarms() []*alarmActive {
+	this.Lock()
+	defer this.Unlock()
+
+	alarms := make([]*alarmActive, 0, len(this.active))
+	for _, active := range this.active {
+		a := *active
+		alarms = append(alarms, &a)
+	}
+	sort.Sort(alarmActives(alarms))
+	return alarms
+}
+
+func (this *alarmSilencer) activeSilences() []*alarmSilence {
+	this.Lock()
+	defer this.Unlock()
+
+	r := make([]*alarmSilence, 0, len(this.silences)+len(this.acks))
+	r = appendSilenceCopies(r, this.silences)
+	for _, ack := range this.acks {
+		s := *ack
+		r = append(r, &s)
+	}
+	return r
+}
+
+func (this *alarmSilencer) silenceHistory() []*alarmSilence {
+	this.Lock()
+	defer this.Unlock()
+
+	return appendSilenceCopies(make([]*alarmSilence, 0, len(this.history)),
+		this.history)
+}
+
+// Copies are safe to encode after the lock is released
+func appendSilenceCopies(r, silences []*alarmSilence) []*alarmSilence {
+	for _, silence := range silences {
+		s := *silence
+		r = append(r, &s)
+	}
+	return r
+}
+
+// Caller holds the lock
+func (this *alarmSilencer) save() error {
+	if this.file == "" {
+		return nil
+	}
+
+	state := alarmSilencerState{NextId: this.nextId, Silences: this.silences,
+		History: this.history, Acks: make([]*alarmSilence, 0, len(this.acks))}
+	for _, ack := range this.acks {
+		state.Acks = append(state.Acks, ack)
+	}
+	data, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp := this.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, this.file)
+}
+
+// Missing file is a fresh start
+func (this *alarmSilencer) load() error {
+	if this.file == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(this.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var state alarmSilencerState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	for _, s := range state.Silences {
+		if err = s.compile(); err != nil {
+			return err
+		}
+	}
+	this.nextId = state.NextId
+	this.silences = state.Silences
+	this.history = state.History
+	for _, ack := range state.Acks {
+		this.acks[ack.Key] = ack
+	}
+	return nil
+}
+
+type alarmActives []*alarmActive
+
+func (this alarmActives) Len() int {
+	return len(this)
+}
+
+func (this alarmActives) Less(i, j int) bool {
+	if this[i].Worker == this[j].Worker {
+		return this[i].LastSeen.After(this[j].LastSeen)
+	}
+	return this[i].Worker < this[j].Worker
+}
+
+func (this alarmActives) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+}
@@ -0,0 +1,101 @@
+package plugins
+
+import (
+	"github.com/funkygao/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAlarmSilence(t *testing.T) {
+	s := newAlarmSilencer("", time.Hour)
+	t0 := time.Unix(1388600000, 0)
+	slow := alarmMailMessage{worker: "slow", key: "k1", msg: "us timeout 3s", severity: 5}
+	fatal := alarmMailMessage{worker: "fatal", key: "k2", msg: "db down", severity: 9}
+
+	_, err := s.silence("", "", time.Minute, "", t0)
+	assert.NotEqual(t, nil, err)
+	_, err = s.silence("", "(", time.Minute, "", t0)
+	assert.NotEqual(t, nil, err)
+
+	byWorker, err := s.silence("slow", "", time.Minute, "deploying", t0)
+	assert.Equal(t, int64(1), byWorker.Id)
+	assert.Equal(t, nil, err)
+	byPattern, err := s.silence("", "^db", 10*time.Minute, "", t0)
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, true, s.silenced(slow, t0))
+	assert.Equal(t, true, s.silenced(fatal, t0))
+	assert.Equal(t, false, s.silenced(slow, t0.Add(2*time.Minute)))
+	assert.Equal(t, nil, s.unsilence(byPattern.Id, t0.Add(3*time.Minute)))
+	assert.Equal(t, false, s.silenced(fatal, t0.Add(3*time.Minute)))
+	assert.NotEqual(t, nil, s.unsilence(byPattern.Id, t0))
+
+	alarms := s.activeAlarms()
+	assert.Equal(t, 2, len(alarms))
+	assert.Equal(t, "fatal", alarms[0].Worker)
+	assert.Equal(t, 2, alarms[0].Count)
+	assert.Equal(t, 1, alarms[0].Muted)
+
+	assert.Equal(t, nil, s.refresh(t0.Add(3*time.Minute)))
+	assert.Equal(t, 0, len(s.activeSilences()))
+	assert.Equal(t, 2, len(s.silenceHistory()))
+}
+
+func TestAlarmAck(t *testing.T) {
+	s := newAlarmSilencer("", time.Hour)
+	t0 := time.Unix(1388600000, 0)
+	msg := alarmMailMessage{worker: "slow", key: "k1", msg: "us timeout 3s", severity: 5}
+
+	_, err := s.ack("k1", "", t0)
+	assert.NotEqual(t, nil, err) // not fired yet
+
+	assert.Equal(t, false, s.silenced(msg, t0))
+	_, err = s.ack("k1", "looking", t0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, s.silenced(msg, t0.Add(50*time.Minute)))
+	assert.Equal(t, true, s.activeAlarms()[0].Acked)
+
+	// still firing, ack holds
+	s.refresh(t0.Add(100 * time.Minute))
+	assert.Equal(t, true, s.silenced(msg, t0.Add(100*time.Minute)))
+
+	// quiet for ack ttl, ack cleared
+	s.refresh(t0.Add(161 * time.Minute))
+	assert.Equal(t, 0, len(s.activeAlarms()))
+	assert.Equal(t, 1, len(s.silenceHistory()))
+	assert.Equal(t, false, s.silenced(msg, t0.Add(162*time.Minute)))
+}
+
+func TestAlarmSilencerPersist(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "alarm_silence")
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "silence.json")
+	now := time.Now()
+
+	s := newAlarmSilencer(fn, time.Hour)
+	assert.Equal(t, nil, s.load())
+	s.silenced(alarmMailMessage{worker: "slow", key: "k1", msg: "x"}, now)
+	s.silence("", "^db", time.Hour, "", now)
+	s.ack("k1", "", now)
+
+	s = newAlarmSilencer(fn, time.Hour)
+	assert.Equal(t, nil, s.load())
+	assert.Equal(t, 2, len(s.activeSilences()))
+	assert.Equal(t, true,
+		s.silenced(alarmMailMessage{worker: "fatal", key: "k2", msg: "db down"}, now))
+	assert.Equal(t, true,
+		s.silenced(alarmMailMessage{worker: "slow", key: "k1", msg: "x"}, now))
+
+	next, _ := s.silence("fatal", "", time.Hour, "", now)
+	assert.Equal(t, int64(3), next.Id)
+
+	// callers get copies
+	for _, silence := range s.activeSilences() {
+		silence.Until = now.Add(-time.Hour)
+	}
+	assert.Equal(t, true,
+		s.silenced(alarmMailMessage{worker: "fatal", key: "k2", msg: "db down"}, now))
+}
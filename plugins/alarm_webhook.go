@@ -0,0 +1,226 @@
+package plugins
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/funkygao/dpipe/engine"
+	conf "github.com/funkygao/jsconf"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	WEBHOOK_GENERIC  = "generic"
+	WEBHOOK_SLACK    = "slack"
+	WEBHOOK_DINGTALK = "dingtalk"
+)
+
+// Push alarms to a chat robot or any http endpoint
+type alarmWebhook struct {
+	name              string
+	typ               string
+	url               string
+	severityThreshold int
+	workers           []string // worker titles, empty means all
+	interval          time.Duration
+	retries           int
+	retryBackoff      time.Duration
+	client            *http.Client
+
+	inChan   chan alarmMailMessage
+	droppedN int
+}
+
+func (this *alarmWebhook) load(section *conf.Conf) {
+	this.url = section.String("url", "")
+	if this.url == "" {
+		panic("webhook must have 'url'")
+	}
+	this.name = section.String("name", this.url)
+	this.typ = section.String("type", WEBHOOK_GENERIC)
+	switch this.typ {
+	case WEBHOOK_GENERIC, WEBHOOK_SLACK, WEBHOOK_DINGTALK:
+	default:
+		panic("invalid webhook type: " + this.typ)
+	}
+	this.severityThreshold = section.Int("severity_threshold", 1)
+	this.workers = section.StringList("workers", nil)
+	this.interval = time.Duration(section.Int("interval", 0)) * time.Second
+	this.retries = section.Int("retries", 3)
+	this.retryBackoff = time.Duration(section.Int("retry_backoff", 2)) * time.Second
+	this.client = &http.Client{
+		Timeout: time.Duration(section.Int("timeout", 10)) * time.Second}
+	this.inChan = make(chan alarmMailMessage, section.Int("queue_size", 1000))
+}
+
+func (this *alarmWebhook) accept(msg alarmMailMessage) bool {
+	if msg.severity < this.severityThreshold {
+		return false
+	}
+	if len(this.workers) == 0 {
+		return true
+	}
+
+	for _, worker := range this.workers {
+		if worker == msg.worker {
+			return true
+		}
+	}
+	return false
+}
+
+// Never blocks the alarm dispatching, drops if the endpoint can't keep up
+func (this *alarmWebhook) feed(msg alarmMailMessage) {
+	select {
+	case this.inChan <- msg:
+	default:
+		this.droppedN += 1
+	}
+}
+
+// Post each alarm immediately if no interval, else batch them
+func (this *alarmWebhook) run(project *engine.ConfProject, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	var (
+		batch  = make([]alarmMailMessage, 0)
+		ticker *time.Ticker
+		tick   <-chan time.Time
+	)
+	if this.interval > 0 {
+		ticker = time.NewTicker(this.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := this.push(project.Name, batch); err != nil {
+			project.Printf("webhook[%s] lost %d alarms: %v", this.name,
+				len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-tick:
+			flush()
+
+		case msg, ok := <-this.inChan:
+			if !ok {
+				flush()
+				if this.droppedN > 0 {
+					project.Printf("webhook[%s] dropped %d alarms", this.name,
+						this.droppedN)
+				}
+				return
+			}
+
+			batch = append(batch, msg)
+			if tick == nil {
+				flush()
+			}
+		}
+	}
+}
+
+func (this *alarmWebhook) push(projectName string, msgs []alarmMailMessage) (err error) {
+	body, err := this.payload(projectName, msgs)
+	if err != nil {
+		return
+	}
+
+	backoff := this.retryBackoff
+	for attempt := 0; ; attempt++ {
+		var retryable bool
+		if retryable, err = this.post(body); err == nil || !retryable ||
+			attempt >= this.retries {
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (this *alarmWebhook) post(body []byte) (retryable bool, err error) {
+	res, err := this.client.Post(this.url, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+
+	data, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return esRetryableStatus(res.StatusCode),
+			fmt.Errorf("%s %s", res.Status, data)
+	}
+
+	if this.typ == WEBHOOK_DINGTALK {
+		// dingtalk always replies 200, errcode tells the result
+		var result struct {
+			Errcode int    `json:"errcode"`
+			Errmsg  string `json:"errmsg"`
+		}
+		if err = json.Unmarshal(data, &result); err != nil {
+			return false, err
+		}
+		if result.Errcode != 0 {
+			return false, fmt.Errorf("dingtalk errcode %d: %s", result.Errcode,
+				result.Errmsg)
+		}
+	}
+
+	return false, nil
+}
+
+func (this *alarmWebhook) payload(projectName string,
+	msgs []alarmMailMessage) ([]byte, error) {
+	switch this.typ {
+	case WEBHOOK_SLACK:
+		return json.Marshal(map[string]string{
+			"text": fmt.Sprintf("*ALS[%s] alarms*\n```%s```", projectName,
+				webhookText(msgs))})
+
+	case WEBHOOK_DINGTALK:
+		return json.Marshal(map[string]interface{}{
+			"msgtype": "text",
+			"text": map[string]string{
+				"content": fmt.Sprintf("ALS[%s] alarms\n%s", projectName,
+					webhookText(msgs))},
+		})
+	}
+
+	alarms := make([]map[string]interface{}, 0, len(msgs))
+	for _, msg := range msgs {
+		alarms = append(alarms, map[string]interface{}{
+			"worker":   msg.worker,
+			"severity": msg.severity,
+			"abnormal": msg.abnormal,
+			"msg":      msg.msg,
+			"ts":       msg.receivedAt.Unix(),
+		})
+	}
+	return json.Marshal(map[string]interface{}{
+		"project": projectName,
+		"alarms":  alarms,
+	})
+}
+
+func webhookText(msgs []alarmMailMessage) string {
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		fmt.Fprintf(&buf, "%s[%d] %s %s\n", msg.receivedAt.Format(engine.TIME_FORMAT),
+			msg.severity, msg.worker, msg.msg)
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,135 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/funkygao/assert"
+	"github.com/funkygao/dpipe/engine"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAlarmWebhookAccept(t *testing.T) {
+	hook := &alarmWebhook{typ: WEBHOOK_GENERIC, severityThreshold: 5}
+	assert.Equal(t, false, hook.accept(alarmMailMessage{worker: "a", severity: 4}))
+	assert.Equal(t, true, hook.accept(alarmMailMessage{worker: "a", severity: 5}))
+
+	hook.workers = []string{"MongoError"}
+	assert.Equal(t, false, hook.accept(alarmMailMessage{worker: "a", severity: 5}))
+	assert.Equal(t, true, hook.accept(alarmMailMessage{worker: "MongoError", severity: 5}))
+}
+
+func TestAlarmWebhookPayload(t *testing.T) {
+	msgs := []alarmMailMessage{{worker: "MongoError", msg: "us refused",
+		severity: 9, receivedAt: time.Unix(1388600000, 0)}}
+
+	var slack map[string]string
+	body, _ := (&alarmWebhook{typ: WEBHOOK_SLACK}).payload("rs", msgs)
+	json.Unmarshal(body, &slack)
+	assert.Equal(t, true, strings.HasPrefix(slack["text"], "*ALS[rs] alarms*\n```"))
+	assert.Equal(t, true, strings.Contains(slack["text"], "[9] MongoError us refused"))
+
+	var ding struct {
+		Msgtype string
+		Text    map[string]string
+	}
+	body, _ = (&alarmWebhook{typ: WEBHOOK_DINGTALK}).payload("rs", msgs)
+	json.Unmarshal(body, &ding)
+	assert.Equal(t, "text", ding.Msgtype)
+	assert.Equal(t, true, strings.Contains(ding.Text["content"], "MongoError us refused"))
+
+	var generic struct {
+		Project string
+		Alarms  []map[string]interface{}
+	}
+	body, _ = (&alarmWebhook{typ: WEBHOOK_GENERIC}).payload("rs", msgs)
+	json.Unmarshal(body, &generic)
+	assert.Equal(t, "rs", generic.Project)
+	assert.Equal(t, "MongoError", generic.Alarms[0]["worker"])
+	assert.Equal(t, float64(1388600000), generic.Alarms[0]["ts"])
+}
+
+func TestAlarmWebhookRetry(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"errcode":0,"errmsg":"ok"}`)
+	}))
+	defer server.Close()
+
+	hook := &alarmWebhook{name: "ding", typ: WEBHOOK_DINGTALK, url: server.URL,
+		retries: 2, retryBackoff: time.Millisecond,
+		client: &http.Client{Timeout: time.Second}}
+	assert.Equal(t, nil, hook.push("rs", []alarmMailMessage{{msg: "x"}}))
+	assert.Equal(t, 2, attempts)
+}
+
+func TestAlarmWebhookDingtalkError(t *testing.T) {
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		attempts++
+		fmt.Fprint(w, `{"errcode":310000,"errmsg":"keywords not in content"}`)
+	}))
+	defer server.Close()
+
+	hook := &alarmWebhook{name: "ding", typ: WEBHOOK_DINGTALK, url: server.URL,
+		retries: 2, retryBackoff: time.Millisecond,
+		client: &http.Client{Timeout: time.Second}}
+	err := hook.push("rs", []alarmMailMessage{{msg: "x"}})
+	assert.Equal(t, true, strings.Contains(err.Error(), "310000"))
+	assert.Equal(t, 1, attempts) // not retryable
+}
+
+func TestAlarmWebhookBatch(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		posted []int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		var payload struct{ Alarms []interface{} }
+		json.Unmarshal(body, &payload)
+
+		mu.Lock()
+		posted = append(posted, len(payload.Alarms))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	hook := &alarmWebhook{name: "ops", typ: WEBHOOK_GENERIC, url: server.URL,
+		severityThreshold: 5, interval: time.Hour, retries: 2,
+		retryBackoff: time.Millisecond, client: &http.Client{Timeout: time.Second},
+		inChan: make(chan alarmMailMessage, 10)}
+	project := &engine.ConfProject{Name: "rs",
+		Logger: log.New(os.Stderr, "", 0)}
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go hook.run(project, wg)
+	for i := 0; i < 3; i++ {
+		hook.feed(alarmMailMessage{msg: "x", severity: 9})
+	}
+	close(hook.inChan)
+	wg.Wait()
+
+	// batched into one post at shutdown
+	assert.Equal(t, []int{3}, posted)
+}
@@ -0,0 +1,202 @@
+package plugins
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ALARM_BACKEND_MEMORY = "memory"
+	ALARM_BACKEND_SQL    = "sql" // custom stats_stmt over per worker sqlite
+)
+
+type alarmWindowAgg struct {
+	fn    string // sum | max
+	field int    // index of worker fields
+}
+
+type alarmWindowGroup struct {
+	key   string
+	row   []interface{} // count, area, group by values, aggregates
+	count int64
+	aggs  []float64
+	seen  []bool // max of a group starts from its first value
+}
+
+// In-memory windowed group by counter, same as the sql:
+// SELECT COUNT(*) AS c, area, <group_by>, <aggregates> FROM t
+// GROUP BY area, <group_by> HAVING c>=<min_count> ORDER BY c DESC LIMIT <top_n>
+type alarmWindow struct {
+	groupBy  []int // index of worker fields, area is always the 1st group column
+	aggs     []alarmWindowAgg
+	topN     int // 0 means all
+	minCount int64
+
+	groups     map[string]*alarmWindowGroup
+	head, tail int // ts border of the window
+}
+
+// groupBy defaults to all the fields, aggregates like "sum:ts", "max:ts"
+func newAlarmWindow(fields []alarmWorkerConfigField, groupBy, aggregates []string,
+	topN, minCount int) (*alarmWindow, error) {
+	this := &alarmWindow{topN: topN, minCount: int64(minCount),
+		groupBy: make([]int, 0), aggs: make([]alarmWindowAgg, 0),
+		groups: make(map[string]*alarmWindowGroup)}
+	if this.minCount < 1 {
+		this.minCount = 1
+	}
+
+	fieldIndex := func(name string) (int, error) {
+		for i, field := range fields {
+			if field.name == name {
+				return i, nil
+			}
+		}
+		return -1, fmt.Errorf("field %s not configured", name)
+	}
+
+	if len(groupBy) == 0 {
+		for i, _ := range fields {
+			this.groupBy = append(this.groupBy, i)
+		}
+	}
+	for _, name := range groupBy {
+		i, err := fieldIndex(name)
+		if err != nil {
+			return nil, err
+		}
+		this.groupBy = append(this.groupBy, i)
+	}
+
+	for _, agg := range aggregates {
+		parts := strings.SplitN(agg, ":", 2)
+		if len(parts) != 2 || (parts[0] != "sum" && parts[0] != "max") {
+			return nil, fmt.Errorf("invalid aggregate: %s", agg)
+		}
+		i, err := fieldIndex(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		this.aggs = append(this.aggs, alarmWindowAgg{fn: parts[0], field: i})
+	}
+
+	return this, nil
+}
+
+// values are of the worker fields, caller is responsible for locking
+func (this *alarmWindow) add(area string, ts int, values []interface{}) {
+	var key bytes.Buffer
+	key.WriteString(area)
+	for _, i := range this.groupBy {
+		key.WriteByte(0)
+		fmt.Fprint(&key, values[i])
+	}
+
+	group, present := this.groups[key.String()]
+	if !present {
+		group = &alarmWindowGroup{key: key.String(), row: make([]interface{}, 0,
+			2+len(this.groupBy)+len(this.aggs)),
+			aggs: make([]float64, len(this.aggs)),
+			seen: make([]bool, len(this.aggs))}
+		group.row = append(group.row, int64(0), area)
+		for _, i := range this.groupBy {
+			group.row = append(group.row, values[i])
+		}
+		this.groups[group.key] = group
+	}
+
+	group.count += 1
+	for j, agg := range this.aggs {
+		x, ok := windowFloat(values[agg.field])
+		if !ok {
+			continue
+		}
+
+		switch agg.fn {
+		case "sum":
+			group.aggs[j] += x
+		case "max":
+			if !group.seen[j] || x > group.aggs[j] {
+				group.aggs[j] = x
+			}
+		}
+		group.seen[j] = true
+	}
+
+	if this.head == 0 || ts < this.head {
+		this.head = ts
+	}
+	if ts > this.tail {
+		this.tail = ts
+	}
+}
+
+// Rows of the window ordered by count desc, then the window restarts
+func (this *alarmWindow) flush() (head, tail int, rows [][]interface{}, err error) {
+	if len(this.groups) == 0 {
+		err = errSlideWindowEmpty
+		return
+	}
+
+	head, tail = this.head, this.tail
+	groups := make([]*alarmWindowGroup, 0, len(this.groups))
+	for _, group := range this.groups {
+		if group.count >= this.minCount {
+			groups = append(groups, group)
+		}
+	}
+	sort.Sort(alarmWindowGroups(groups))
+	if this.topN > 0 && len(groups) > this.topN {
+		groups = groups[:this.topN]
+	}
+
+	rows = make([][]interface{}, 0, len(groups))
+	for _, group := range groups {
+		group.row[0] = group.count
+		for j, _ := range this.aggs {
+			group.row = append(group.row, group.aggs[j])
+		}
+		rows = append(rows, group.row)
+	}
+
+	this.groups = make(map[string]*alarmWindowGroup)
+	this.head, this.tail = 0, 0
+	return
+}
+
+func windowFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case string:
+		x, err := strconv.ParseFloat(v, 64)
+		return x, err == nil
+	}
+
+	return 0, false
+}
+
+type alarmWindowGroups []*alarmWindowGroup
+
+func (this alarmWindowGroups) Len() int {
+	return len(this)
+}
+
+// ties ordered by group values for stable output
+func (this alarmWindowGroups) Less(i, j int) bool {
+	if this[i].count == this[j].count {
+		return this[i].key < this[j].key
+	}
+	return this[i].count > this[j].count
+}
+
+func (this alarmWindowGroups) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+}
@@ -0,0 +1,54 @@
+package plugins
+
+import (
+	"github.com/funkygao/assert"
+	"testing"
+)
+
+func TestAlarmWindowGroupBy(t *testing.T) {
+	fields := []alarmWorkerConfigField{{name: "table"}, {name: "method"},
+		{name: "ts"}}
+	w, err := newAlarmWindow(fields, []string{"method", "table"},
+		[]string{"sum:ts", "max:ts"}, 0, 2)
+	assert.Equal(t, nil, err)
+
+	w.add("us", 1391857296, []interface{}{"user", "find", 0.5})
+	w.add("us", 1391857290, []interface{}{"user", "find", 1.5})
+	w.add("us", 1391857299, []interface{}{"user", "update", 2.0})
+	w.add("de", 1391857291, []interface{}{"user", "find", 0.25})
+	w.add("de", 1391857292, []interface{}{"user", "find", 0.125})
+	w.add("de", 1391857293, []interface{}{"user", "find", 0.5})
+
+	head, tail, rows, err := w.flush()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1391857290, head)
+	assert.Equal(t, 1391857299, tail)
+	// update is below min count
+	assert.Equal(t, [][]interface{}{
+		{int64(3), "de", "find", "user", 0.875, 0.5},
+		{int64(2), "us", "find", "user", 2.0, 1.5},
+	}, rows)
+
+	// window restarted
+	_, _, _, err = w.flush()
+	assert.Equal(t, errSlideWindowEmpty, err)
+}
+
+func TestAlarmWindowTopN(t *testing.T) {
+	fields := []alarmWorkerConfigField{{name: "message"}}
+	w, _ := newAlarmWindow(fields, nil, nil, 2, 0)
+	for i, msg := range []string{"a", "b", "b", "c", "c", "c"} {
+		w.add("us", 1391857290+i, []interface{}{msg})
+	}
+
+	_, _, rows, _ := w.flush()
+	assert.Equal(t, [][]interface{}{
+		{int64(3), "us", "c"},
+		{int64(2), "us", "b"},
+	}, rows)
+
+	_, err := newAlarmWindow(fields, []string{"host"}, nil, 0, 0)
+	assert.NotEqual(t, nil, err)
+	_, err = newAlarmWindow(fields, nil, []string{"avg:message"}, 0, 0)
+	assert.NotEqual(t, nil, err)
+}
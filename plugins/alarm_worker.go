@@ -9,12 +9,10 @@ import (
 	"github.com/funkygao/als"
 	"github.com/funkygao/dpipe/engine"
 	"github.com/funkygao/dpipe/plugins/parser"
-	"github.com/funkygao/golib/bjtime"
 	"github.com/funkygao/golib/color"
 	sqldb "github.com/funkygao/golib/db"
 	"github.com/funkygao/golib/stats"
 	conf "github.com/funkygao/jsconf"
-	"math"
 	"os"
 	"regexp"
 	"strings"
@@ -45,8 +43,16 @@ func (this *alarmWorkerConfigField) init(config *conf.Conf) {
 
 	this.typ = config.String("type", als.KEY_TYPE_STRING)
 	this.parser = config.String("parser", "")
+	if this.parser != "" && !parser.Registered(this.parser) {
+		panic("unknown parser: " + this.parser)
+	}
 	this.ignores = config.StringList("ignores", nil)
 	this.normalizers = config.StringList("normalizers", nil)
+	for _, norm := range this.normalizers {
+		if _, present := normalizers[norm]; !present {
+			panic("unknown normalizer: " + norm)
+		}
+	}
 	this._regexIgnores = make([]*regexp.Regexp, 0)
 	// build the precompiled regex matcher
 	for _, ignore := range this.ignores {
@@ -116,6 +122,12 @@ type alarmWorkerConfig struct {
 	abnormalSeverityFactor int
 	severity               int
 
+	backend    string
+	groupBy    []string // memory backend
+	aggregates []string
+	topN       int
+	minCount   int
+
 	dbName    string
 	tableName string
 
@@ -147,6 +159,16 @@ func (this *alarmWorkerConfig) init(config *conf.Conf) {
 	this.abnormalBase = config.Int("abnormal_base", 10)
 	this.abnormalSeverityFactor = config.Int("abnormal_severity_factor", 1)
 	this.abnormalPercent = config.Float("abnormal_percent", 1.5)
+	this.backend = config.String("backend", ALARM_BACKEND_MEMORY)
+	switch this.backend {
+	case ALARM_BACKEND_MEMORY, ALARM_BACKEND_SQL:
+	default:
+		panic(fmt.Sprintf("%s invalid backend: %s", this.title, this.backend))
+	}
+	this.groupBy = config.StringList("group_by", nil)
+	this.aggregates = config.StringList("aggregates", nil)
+	this.topN = config.Int("top_n", 0)
+	this.minCount = config.Int("min_count", 1)
 	this.dbName = config.String("dbname", "")
 	this.tableName = this.dbName // table name is db name
 	this.createTable = config.String("create_table", "")
@@ -179,16 +201,22 @@ type alarmWorker struct {
 	stopChan     chan interface{}
 	project      *engine.ConfProject
 	projName     string
-	emailChan    chan alarmMailMessage
+	alarmChan    chan alarmMailMessage
 	workersMutex *sync.Mutex // accross all alarm workers in a project
 
 	conf alarmWorkerConfig
 
+	window *alarmWindow // memory backend
+
 	db         *sqldb.SqlDb
+	dbFile     string
 	insertStmt *sql.Stmt
 	statsStmt  *sql.Stmt
 
-	history map[string]int64 // TODO LRU incase of OOM
+	detector           *anomalyDetector
+	detectorCheckpoint string // learned baselines survive restart
+	checkpointInterval time.Duration
+	lastCheckpoint     time.Time
 
 	_instantAlarmOnly bool
 }
@@ -196,10 +224,16 @@ type alarmWorker struct {
 func (this *alarmWorker) init(config *conf.Conf, stopChan chan interface{}) {
 	this.Mutex = new(sync.Mutex)
 	this.stopChan = stopChan
-	this.history = make(map[string]int64)
 
 	this.conf = alarmWorkerConfig{}
 	this.conf.init(config)
+	this.detector = newAnomalyDetector()
+	this.detector.load(config)
+	this.detectorCheckpoint = config.String("detector_checkpoint",
+		fmt.Sprintf("var/alarm_detector.%s.%s.gob", this.projName,
+			this.conf.camelName))
+	this.checkpointInterval = time.Duration(
+		config.Int("detector_checkpoint_interval", 300)) * time.Second
 	globals := engine.Globals()
 	if this.conf.windowSize.Seconds() < 1.0 {
 		this._instantAlarmOnly = true
@@ -240,10 +274,38 @@ func (this *alarmWorker) init(config *conf.Conf, stopChan chan interface{}) {
 			globals.Printf("[%s]instant only alarm needn't set 'dbname'",
 				this.conf.camelName)
 		}
+
+		return
+	}
+
+	if this.conf.printFormat == "" {
+		panic(fmt.Sprintf("%s empty 'printf'", this.conf.title))
+	}
+
+	if this.conf.backend == ALARM_BACKEND_SQL {
+		return
+	}
+
+	if this.conf.statsStmt != "" {
+		globals.Printf("[%s]memory backend ignores 'stats_stmt', set backend 'sql' to use it",
+			this.conf.camelName)
+	}
+	var err error
+	this.window, err = newAlarmWindow(this.conf.fields, this.conf.groupBy,
+		this.conf.aggregates, this.conf.topN, this.conf.minCount)
+	if err != nil {
+		panic(fmt.Sprintf("%s: %v", this.conf.title, err))
 	}
 }
 
 func (this *alarmWorker) cleanup() {
+	if this.project != nil && !this._instantAlarmOnly &&
+		!engine.Globals().DryRun {
+		this.Lock()
+		this.dumpDetector()
+		this.Unlock()
+	}
+
 	if this.insertStmt != nil {
 		this.insertStmt.Close()
 	}
@@ -252,6 +314,8 @@ func (this *alarmWorker) cleanup() {
 	}
 	if this.db != nil {
 		this.db.Close()
+		// the db file is per pid, never reused
+		os.Remove(this.dbFile)
 	}
 }
 
@@ -271,16 +335,22 @@ func (this *alarmWorker) run(h engine.PluginHelper, goAhead chan bool) {
 		return
 	}
 
-	this.createDB()
-	this.prepareInsertStmt()
-	this.prepareStatsStmt()
+	if this.conf.backend == ALARM_BACKEND_SQL {
+		this.createDB()
+		this.prepareInsertStmt()
+		this.prepareStatsStmt()
+	}
+	if err := this.detector.loadState(this.detectorCheckpoint); err != nil {
+		this.project.Printf("[%s] detector state: %v", this.conf.title, err)
+	}
+	this.lastCheckpoint = time.Now()
 	goAhead <- true
 
 	for ever {
 		select {
 		case <-time.After(this.conf.windowSize):
 			this.Lock()
-			windowHead, windowTail, err := this.getWindowBorder()
+			windowHead, windowTail, rows, err := this.windowRows()
 			if err != nil {
 				this.Unlock()
 				continue
@@ -290,22 +360,12 @@ func (this *alarmWorker) run(h engine.PluginHelper, goAhead chan bool) {
 				summary.Reset()
 			}
 
-			rows, _ := this.statsStmt.Query(windowTail)
-			cols, _ := rows.Columns()
-			colsN := len(cols)
-			values := make([]interface{}, colsN)
-			valuePtrs := make([]interface{}, colsN)
 			rowSeverity := 0
-			abnormal := false
 			this.workersMutex.Lock()
 			this.printWindowTitle(windowHead, windowTail, this.conf.title)
-			for rows.Next() {
+			for _, values := range rows {
 				beep = false
-				for i, _ := range cols {
-					valuePtrs[i] = &values[i]
-				}
-
-				rows.Scan(valuePtrs...)
+				colsN := len(values)
 
 				// 1st column always being aggregated quantile
 				var amount = values[0].(int64)
@@ -325,18 +385,25 @@ func (this *alarmWorker) run(h engine.PluginHelper, goAhead chan bool) {
 				rowSeverity = this.conf.severity * int(amount)
 
 				// abnormal change? blink
-				if this.isAbnormalChange(amount,
-					this.historyKey(this.conf.printFormat, values)) {
-					this.blinkColorPrintfLn(this.conf.printFormat, values...)
+				key := this.historyKey(this.conf.printFormat, values)
+				format, args := this.conf.printFormat, values
+				abnormal, expected := this.detector.observe(key,
+					float64(amount), this.project.Now())
+				if abnormal {
+					format += " (expected %.0f)"
+					args = append(values[:colsN:colsN], expected)
+					this.blinkColorPrintfLn(format, args...)
 
-					abnormal = true
 					// multiply factor
 					rowSeverity *= this.conf.abnormalSeverityFactor
 				}
 
-				this.colorPrintfLn(beep, this.conf.printFormat, values...)
+				this.colorPrintfLn(beep, format, args...)
 
-				this.feedAlarmMail(abnormal, rowSeverity, this.conf.printFormat, values...)
+				area, fields := this.rowGroup(values[:colsN])
+				this.feedAlarmMail(alarmMailMessage{abnormal: abnormal,
+					severity: rowSeverity, key: key, area: area, fields: fields},
+					format, args...)
 			}
 
 			// show summary
@@ -346,9 +413,10 @@ func (this *alarmWorker) run(h engine.PluginHelper, goAhead chan bool) {
 			}
 
 			this.workersMutex.Unlock()
-			rows.Close()
 
-			this.moveWindowForward(windowTail)
+			if time.Since(this.lastCheckpoint) >= this.checkpointInterval {
+				this.dumpDetector()
+			}
 			this.Unlock()
 
 		case <-this.stopChan:
@@ -359,7 +427,7 @@ func (this *alarmWorker) run(h engine.PluginHelper, goAhead chan bool) {
 }
 
 func (this *alarmWorker) inject(msg *als.AlsMessage, project *engine.ConfProject) {
-	args, severity, err := this.fieldValues(msg)
+	rows, err := this.fieldValues(msg)
 	if err != nil {
 		if err != errMessageIgnored && project.ShowError {
 			project.Println(err)
@@ -368,11 +436,13 @@ func (this *alarmWorker) inject(msg *als.AlsMessage, project *engine.ConfProject
 		return
 	}
 
-	if len(args) != len(this.conf.fields) {
-		// message ignored
-		return
+	for _, row := range rows {
+		this.injectRow(msg, row.values, row.severity)
 	}
+}
 
+func (this *alarmWorker) injectRow(msg *als.AlsMessage, args []interface{},
+	severity int) {
 	if this.conf.instantFormat != "" {
 		iargs := append([]interface{}{msg.Area}, args...) // 'area' is always 1st col
 		this.workersMutex.Lock()
@@ -380,7 +450,9 @@ func (this *alarmWorker) inject(msg *als.AlsMessage, project *engine.ConfProject
 		this.workersMutex.Unlock()
 
 		if this._instantAlarmOnly {
-			this.feedAlarmMail(false, severity, this.conf.instantFormat, iargs...)
+			this.feedAlarmMail(alarmMailMessage{severity: severity,
+				area: msg.Area, fields: alarmFieldStrings(args)},
+				this.conf.instantFormat, iargs...)
 			return
 		}
 	}
@@ -391,76 +463,126 @@ func (this *alarmWorker) inject(msg *als.AlsMessage, project *engine.ConfProject
 	this.insert(args...)
 }
 
-func (this *alarmWorker) fieldValues(msg *als.AlsMessage) (values []interface{},
-	severity int, err error) {
+// Field values of a message, one row per parsed alarm
+type alarmFieldRow struct {
+	values   []interface{}
+	severity int
+}
+
+// A parser field that matches yields a row for each of its alarms, and no
+// row at all if it has nothing to alarm
+func (this *alarmWorker) fieldValues(msg *als.AlsMessage) (rows []alarmFieldRow,
+	err error) {
 	var val interface{}
-	values = make([]interface{}, 0, 5)
+	rows = []alarmFieldRow{{values: make([]interface{}, 0, len(this.conf.fields)),
+		severity: this.conf.severity}}
 
-	severity = this.conf.severity
 	for _, field := range this.conf.fields {
 		val, err = field.value(msg)
 		if err != nil {
 			return
 		}
 
+		var (
+			match  bool
+			alarms []parser.Alarm
+		)
 		if field.parser != "" {
-			match, alarm, s, _ := parser.Parse(field.parser, val.(string))
-			if !match {
-				// this msg doesn't apply to this parser
-				values = append(values, val)
-			} else if alarm != "" {
-				// it's a parser processed alarm
-				severity = s
-				values = append(values, alarm)
+			match, alarms, _ = parser.Parse(field.parser, val.(string))
+		}
+		if !match {
+			// no parser or this msg doesn't apply to this parser
+			for i := range rows {
+				rows[i].values = append(rows[i].values, val)
+			}
+			continue
+		}
+
+		// it's a parser processed alarm
+		parsed := make([]alarmFieldRow, 0, len(rows)*len(alarms))
+		for _, row := range rows {
+			for _, alarm := range alarms {
+				values := append(append(make([]interface{}, 0,
+					len(this.conf.fields)), row.values...), alarm.Msg)
+				parsed = append(parsed, alarmFieldRow{values: values,
+					severity: alarm.Severity})
 			}
-		} else {
-			values = append(values, val)
 		}
+		rows = parsed
 	}
 
 	return
 }
 
-func (this *alarmWorker) isAbnormalChange(amount int64, key string) bool {
-	defer func() {
-		// reset when history size is large enough
-		if len(this.history) > (5<<20)/64 {
-			// each alarm worker consumes at most 5M history data
-			// remark: each history entry consumes 64bytes
-			this.history = make(map[string]int64)
-			this.project.Printf("[%s] history data restart", this.conf.title)
-		}
+// Persist the learned baselines, caller holds the lock
+func (this *alarmWorker) dumpDetector() {
+	this.lastCheckpoint = time.Now()
+	if pruned := this.detector.prune(this.project.Now()); pruned > 0 {
+		this.project.Printf("[%s] detector forgot %d keys", this.conf.title, pruned)
+	}
+	if !this.detector.dirty {
+		return
+	}
 
-		this.history[key] = amount
-	}()
+	if err := this.detector.dump(this.detectorCheckpoint); err != nil {
+		this.project.Printf("[%s] detector dump: %v", this.conf.title, err)
+	}
+}
 
-	if amount < int64(this.conf.abnormalBase) {
-		return false
+// alarm carries severity, area, fields and the key identifying it across
+// windows, empty key means the message itself
+func (this *alarmWorker) feedAlarmMail(alarm alarmMailMessage, format string,
+	args ...interface{}) {
+	if alarm.severity < 1 {
+		return
 	}
 
-	if lastAmount, present := this.history[key]; present {
-		delta := math.Abs(float64(amount - lastAmount))
-		if delta/float64(lastAmount) >= this.conf.abnormalPercent {
-			return true
-		}
+	// mail groups alarms by worker title
+	alarm.worker = this.conf.title
+	alarm.msg = strings.TrimSpace(strings.TrimPrefix(fmt.Sprintf(format, args...),
+		this.conf.title))
+	if alarm.key == "" {
+		alarm.key = alarm.msg
 	}
+	alarm.key = this.alarmKey(alarm.key)
+	alarm.receivedAt = time.Now()
 
-	return false
+	this.alarmChan <- alarm
 }
 
-func (this *alarmWorker) feedAlarmMail(abnormal bool, severity int,
-	format string, args ...interface{}) {
-	if severity < 1 {
-		return
+// Columns of a window row before the aggregates: count, area, group by
+func (this *alarmWorker) groupColumns(colsN int) int {
+	if this.window != nil {
+		return 2 + len(this.window.groupBy)
 	}
+	return colsN
+}
 
-	msg := fmt.Sprintf(format, args...)
-	if !strings.HasPrefix(msg, this.conf.title) {
-		msg = fmt.Sprintf("%15s %s", this.conf.title, msg)
+// Area and group by fields of a stats row: amount, area, fields...
+// A custom stats_stmt may return fewer columns.
+func (this *alarmWorker) rowGroup(values []interface{}) (area string,
+	fields []string) {
+	colsN := len(values)
+	if colsN > 1 {
+		area = alarmFieldString(values[1])
+	}
+	if groupN := this.groupColumns(colsN); groupN > 2 {
+		fields = alarmFieldStrings(values[2:groupN])
 	}
+	return
+}
+
+func (this *alarmWorker) alarmKey(key string) string {
+	return alarmKeyOf(this.conf.title, key)
+}
 
-	this.emailChan <- alarmMailMessage{msg: msg, severity: severity,
-		abnormal: abnormal, receivedAt: time.Now()}
+// Alarm key unique within the project, used for silencing and ack
+func alarmKeyOf(worker, key string) string {
+	h := md5.New()
+	h.Write([]byte(worker))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	return hex.EncodeToString(h.Sum(nil))
 }
 
 func (this *alarmWorker) historyKey(printf string, values []interface{}) string {
@@ -482,9 +604,9 @@ func (this *alarmWorker) createDB() {
 		SQLITE3_DBFILE_SUFFIX = "sqlite"
 	)
 
-	dsn := fmt.Sprintf("file:%s?cache=shared&mode=rwc",
-		fmt.Sprintf("%s/%s-%d.%s", DATA_BASEDIR, this.conf.dbName, os.Getpid(),
-			SQLITE3_DBFILE_SUFFIX))
+	this.dbFile = fmt.Sprintf("%s/%s-%d.%s", DATA_BASEDIR, this.conf.dbName,
+		os.Getpid(), SQLITE3_DBFILE_SUFFIX)
+	dsn := fmt.Sprintf("file:%s?cache=shared&mode=rwc", this.dbFile)
 	this.db = sqldb.NewSqlDb(sqldb.DRIVER_SQLITE3, dsn, this.project.Logger)
 	this.db.SetDebug(engine.Globals().Debug)
 	this.db.CreateDb(fmt.Sprintf(this.conf.createTable, this.conf.dbName))
@@ -513,10 +635,50 @@ func (this *alarmWorker) insert(args ...interface{}) {
 	}
 
 	this.Lock()
-	this.insertStmt.Exec(args...)
+	if this.window != nil {
+		// args is area, ts, fields...
+		this.window.add(args[0].(string), int(args[1].(uint64)), args[2:])
+	} else {
+		this.insertStmt.Exec(args...)
+	}
 	this.Unlock()
 }
 
+// Rows of the window and move the window forward, caller is responsible
+// for locking
+func (this *alarmWorker) windowRows() (head, tail int, rows [][]interface{},
+	err error) {
+	if this.window != nil {
+		return this.window.flush()
+	}
+
+	head, tail, err = this.getWindowBorder()
+	if err != nil {
+		return
+	}
+
+	r, err := this.statsStmt.Query(tail)
+	if err != nil {
+		return
+	}
+	cols, _ := r.Columns()
+	rows = make([][]interface{}, 0)
+	for r.Next() {
+		values := make([]interface{}, len(cols))
+		valuePtrs := make([]interface{}, len(cols))
+		for i, _ := range cols {
+			valuePtrs[i] = &values[i]
+		}
+
+		r.Scan(valuePtrs...)
+		rows = append(rows, values)
+	}
+	r.Close()
+
+	this.moveWindowForward(tail)
+	return
+}
+
 // caller is responsible for locking
 func (this *alarmWorker) moveWindowForward(tail int) (affectedRows int64) {
 	affectedRows = this.db.ExecSql("DELETE FROM "+this.conf.dbName+"  WHERE ts<=?", tail)
@@ -552,8 +714,9 @@ func (this *alarmWorker) getWindowBorder(wheres ...string) (head, tail int, err
 }
 
 func (this *alarmWorker) printWindowTitle(head, tail int, title string) {
-	this.colorPrintfLn(false, "(%s  ~  %s) %s", bjtime.TsToString(head),
-		bjtime.TsToString(tail), title)
+	this.colorPrintfLn(false, "(%s  ~  %s) %s",
+		this.project.TimeToString(time.Unix(int64(head), 0)),
+		this.project.TimeToString(time.Unix(int64(tail), 0)), title)
 }
 
 func (this *alarmWorker) blinkColorPrintfLn(format string, args ...interface{}) {
@@ -36,3 +36,15 @@ func TestAlarmFieldIgnore(t *testing.T) {
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "2014-02-08 06:01:35 [INFO] Update local version to e9818f0812b3933ac62d630b5b99aac5 for release royal.ae.php", value)
 }
+
+func TestAlarmWorkerRowGroup(t *testing.T) {
+	worker := &alarmWorker{} // sql backend
+	area, fields := worker.rowGroup([]interface{}{int64(5), "us", "db", "timeout"})
+	assert.Equal(t, "us", area)
+	assert.Equal(t, []string{"db", "timeout"}, fields)
+
+	// custom stats_stmt returns count only
+	area, fields = worker.rowGroup([]interface{}{int64(5)})
+	assert.Equal(t, "", area)
+	assert.Equal(t, 0, len(fields))
+}
@@ -1,6 +1,9 @@
 package plugins
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"github.com/funkygao/als"
 	"github.com/funkygao/dpipe/engine"
 	conf "github.com/funkygao/jsconf"
@@ -25,6 +28,48 @@ type ArchiveInput struct {
 	ident       string
 	project     string
 	leftN       int32
+	gzip        bool // also read the .gz files, e,g. rotated by FileOutput
+}
+
+type lineReader interface {
+	ReadLine() ([]byte, error)
+	Close()
+}
+
+type gzipLineReader struct {
+	f      *os.File
+	zr     *gzip.Reader
+	reader *bufio.Reader
+}
+
+func openGzipLineReader(path string) (this *gzipLineReader, err error) {
+	this = new(gzipLineReader)
+	if this.f, err = os.Open(path); err != nil {
+		return
+	}
+	if this.zr, err = gzip.NewReader(this.f); err != nil {
+		this.f.Close()
+		return
+	}
+
+	this.reader = bufio.NewReader(this.zr)
+	return
+}
+
+// Returns line without the trailing '\n'
+func (this *gzipLineReader) ReadLine() (line []byte, err error) {
+	line, err = this.reader.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		// last line without '\n'
+		err = nil
+	}
+
+	return bytes.TrimRight(line, "\n"), err
+}
+
+func (this *gzipLineReader) Close() {
+	this.zr.Close()
+	this.f.Close()
 }
 
 func (this *ArchiveInput) Init(config *conf.Conf) {
@@ -37,6 +82,7 @@ func (this *ArchiveInput) Init(config *conf.Conf) {
 	this.workerNChan = make(chan int, config.Int("concurrent_num", 20))
 	this.chkpnt = als.NewFileCheckpoint(config.String("chkpntfile", ""))
 	this.ignores = config.StringList("ignores", nil)
+	this.gzip = config.Bool("gzip", false)
 }
 
 func (this *ArchiveInput) CleanupForRestart() bool {
@@ -99,7 +145,12 @@ func (this *ArchiveInput) shouldRunSingleLogfile(path string) bool {
 		}
 	}
 
-	if strings.HasSuffix(filepath.Base(path), ".gz") {
+	if strings.HasSuffix(filepath.Base(path), ".gz") && !this.gzip {
+		return false
+	}
+
+	// being written
+	if strings.HasSuffix(filepath.Base(path), ".tmp") {
 		return false
 	}
 
@@ -137,9 +188,19 @@ func (this *ArchiveInput) runSingleLogfile(path string, f os.FileInfo,
 }
 
 func (this *ArchiveInput) doRunSingleLogfile(path string) {
-	reader := als.NewAlsReader(path)
-	if e := reader.Open(); e != nil {
-		panic(e)
+	var reader lineReader
+	if strings.HasSuffix(path, ".gz") {
+		gzReader, e := openGzipLineReader(path)
+		if e != nil {
+			panic(e)
+		}
+		reader = gzReader
+	} else {
+		alsReader := als.NewAlsReader(path)
+		if e := alsReader.Open(); e != nil {
+			panic(e)
+		}
+		reader = alsReader
 	}
 
 	defer func() {
@@ -3,21 +3,23 @@ package plugins
 import (
 	"fmt"
 	"github.com/funkygao/dpipe/engine"
-	"github.com/funkygao/golib/bjtime"
 	"github.com/funkygao/golib/stats"
 	conf "github.com/funkygao/jsconf"
 	"github.com/gorilla/mux"
 	"net/http"
+	"time"
 )
 
 type CardinalityOutput struct {
 	counters   *stats.CardinalityCounter
 	checkpoint string
+	buckets    map[string]string // key is counter key, value is current bucket
 }
 
 func (this *CardinalityOutput) Init(config *conf.Conf) {
 	this.checkpoint = config.String("checkpoint", "")
 	this.counters = stats.NewCardinalityCounter()
+	this.buckets = make(map[string]string)
 	if this.checkpoint != "" {
 		this.counters.Load(this.checkpoint)
 	}
@@ -44,6 +46,8 @@ LOOP:
 			}
 
 			if pack.CardinalityKey != "" && pack.CardinalityData != nil {
+				this.rollBucket(pack.CardinalityKey, pack.CardinalityInterval,
+					h.Project(pack.Project).Now())
 				this.counters.Add(pack.CardinalityKey, pack.CardinalityData)
 			}
 
@@ -59,6 +63,46 @@ LOOP:
 	return nil
 }
 
+// Reset the counter once its interval rolls over in the project timezone
+func (this *CardinalityOutput) rollBucket(key, interval string, now time.Time) {
+	bucket := cardinalityBucket(interval, now)
+	if bucket == "" {
+		// interval without period, reset through REST only
+		return
+	}
+
+	current, present := this.buckets[key]
+	if !present {
+		// counters loaded from checkpoint started in their own bucket
+		current = bucket
+		if startedAt := this.counters.StartedAt(key); !startedAt.IsZero() {
+			current = cardinalityBucket(interval, startedAt.In(now.Location()))
+		}
+	}
+	if current != bucket {
+		this.counters.Reset(key)
+	}
+	this.buckets[key] = bucket
+}
+
+func cardinalityBucket(interval string, t time.Time) string {
+	switch interval {
+	case "hour":
+		return t.Format("2006010215")
+	case "day":
+		return t.Format("20060102")
+	case "week":
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d_w%02d", year, week)
+	case "month":
+		return t.Format("200601")
+	case "year":
+		return t.Format("2006")
+	}
+
+	return ""
+}
+
 func (this *CardinalityOutput) handleHttpRequest(w http.ResponseWriter,
 	req *http.Request, params map[string]interface{}) (interface{}, error) {
 	vars := mux.Vars(req)
@@ -74,7 +118,7 @@ func (this *CardinalityOutput) handleHttpRequest(w http.ResponseWriter,
 		if key == "all" {
 			for _, c := range this.counters.Categories() {
 				output[c] = fmt.Sprintf("[%v] %d",
-					bjtime.TsToString(int(this.counters.StartedAt(c).Unix())),
+					globals.TimeToString(this.counters.StartedAt(c)),
 					this.counters.Count(c))
 			}
 		} else {
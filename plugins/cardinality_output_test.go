@@ -0,0 +1,19 @@
+package plugins
+
+import (
+	"github.com/funkygao/assert"
+	"testing"
+	"time"
+)
+
+func TestCardinalityBucket(t *testing.T) {
+	loc := time.FixedZone("PST", -8*3600)
+	// 2014-01-01 03:00 UTC is still 2013 in PST
+	now := time.Date(2014, 1, 1, 3, 0, 0, 0, time.UTC).In(loc)
+	assert.Equal(t, "2013123119", cardinalityBucket("hour", now))
+	assert.Equal(t, "20131231", cardinalityBucket("day", now))
+	assert.Equal(t, "2014_w01", cardinalityBucket("week", now))
+	assert.Equal(t, "201312", cardinalityBucket("month", now))
+	assert.Equal(t, "2013", cardinalityBucket("year", now))
+	assert.Equal(t, "", cardinalityBucket("forever", now))
+}
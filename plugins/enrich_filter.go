@@ -0,0 +1,428 @@
+package plugins
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/funkygao/als"
+	"github.com/funkygao/dpipe/engine"
+	sqldb "github.com/funkygao/golib/db"
+	conf "github.com/funkygao/jsconf"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// A local lookup table joined against message fields
+type enrichTable struct {
+	name      string
+	file      string
+	format    string // csv, json, sqlite
+	keyField  string // message field
+	keyType   string
+	keyColumn string // table column
+	columns   []string
+	prefix    string // prefix of the copied message field names
+	sqlTable  string // sqlite only
+	lruSize   int    // sqlite only, 0 means load the whole table in memory
+
+	rows    map[string]map[string]interface{} // key -> column -> value
+	cache   *lruCache
+	db      *sqldb.SqlDb
+	stmt    *sql.Stmt
+	modTime time.Time
+
+	hitN  int
+	missN int
+}
+
+func (this *enrichTable) load(section *conf.Conf) {
+	this.name = section.String("name", "")
+	this.file = section.String("file", "")
+	if this.file == "" {
+		panic("enrich table must have 'file'")
+	}
+	if this.name == "" {
+		this.name = this.file
+	}
+	this.format = section.String("format", "csv")
+	switch this.format {
+	case "csv", "json", "sqlite":
+	default:
+		panic("invalid enrich table format: " + this.format)
+	}
+	this.keyField = section.String("key_field", "")
+	if this.keyField == "" {
+		panic(fmt.Sprintf("[%s]empty 'key_field'", this.name))
+	}
+	this.keyType = section.String("key_type", als.KEY_TYPE_STRING)
+	this.keyColumn = section.String("key_column", this.keyField)
+	this.columns = section.StringList("columns", nil)
+	if len(this.columns) == 0 {
+		panic(fmt.Sprintf("[%s]empty 'columns'", this.name))
+	}
+	this.prefix = section.String("prefix", "")
+	this.sqlTable = section.String("sqlite_table", this.name)
+	this.lruSize = section.Int("lru_size", 0)
+	if this.lruSize > 0 && this.format != "sqlite" {
+		panic(fmt.Sprintf("[%s]'lru_size' only applies to sqlite table", this.name))
+	}
+}
+
+// Reload the table if underlying file changed since last load
+func (this *enrichTable) refresh() (reloaded bool, err error) {
+	fi, err := os.Stat(this.file)
+	if err != nil {
+		return
+	}
+
+	if !fi.ModTime().After(this.modTime) {
+		return
+	}
+
+	switch this.format {
+	case "csv":
+		err = this.loadCsv()
+	case "json":
+		err = this.loadJson()
+	case "sqlite":
+		err = this.loadSqlite()
+	}
+	if err != nil {
+		return
+	}
+
+	this.modTime = fi.ModTime()
+	reloaded = true
+	return
+}
+
+func (this *enrichTable) loadCsv() error {
+	f, err := os.Open(this.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+
+	keyIdx := -1
+	colIdx := make(map[string]int)
+	for i, col := range header {
+		col = strings.TrimSpace(col)
+		colIdx[col] = i
+		if col == this.keyColumn {
+			keyIdx = i
+		}
+	}
+	if keyIdx == -1 {
+		return fmt.Errorf("%s: no key column '%s'", this.file, this.keyColumn)
+	}
+
+	rows := make(map[string]map[string]interface{})
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		row := make(map[string]interface{}, len(this.columns))
+		for _, col := range this.columns {
+			if idx, present := colIdx[col]; present && idx < len(record) {
+				row[col] = record[idx]
+			}
+		}
+		rows[record[keyIdx]] = row
+	}
+
+	// swap in the new table as a whole
+	this.rows = rows
+	return nil
+}
+
+// json table file is an array of objects, each of which has the key column
+func (this *enrichTable) loadJson() error {
+	data, err := ioutil.ReadFile(this.file)
+	if err != nil {
+		return err
+	}
+
+	var records []map[string]interface{}
+	if err = json.Unmarshal(data, &records); err != nil {
+		return err
+	}
+
+	rows := make(map[string]map[string]interface{}, len(records))
+	for _, record := range records {
+		key, present := record[this.keyColumn]
+		if !present {
+			continue
+		}
+
+		row := make(map[string]interface{}, len(this.columns))
+		for _, col := range this.columns {
+			if val, present := record[col]; present {
+				row[col] = val
+			}
+		}
+		rows[this.keyString(key)] = row
+	}
+
+	this.rows = rows
+	return nil
+}
+
+func (this *enrichTable) loadSqlite() error {
+	dsn := fmt.Sprintf("file:%s?mode=ro", this.file)
+	db := sqldb.NewSqlDb(sqldb.DRIVER_SQLITE3, dsn, engine.Globals().Logger)
+	db.SetDebug(engine.Globals().Debug)
+
+	columns := strings.Join(this.columns, ",")
+	if this.lruSize > 0 {
+		// lookup on demand, the hot keys are cached
+		stmt := db.Prepare(fmt.Sprintf("SELECT %s FROM %s WHERE %s=?",
+			columns, this.sqlTable, this.keyColumn))
+		this.close()
+		this.db, this.stmt = db, stmt
+		this.cache = newLruCache(this.lruSize)
+		return nil
+	}
+
+	defer db.Close()
+	stmt := db.Prepare(fmt.Sprintf("SELECT %s,%s FROM %s",
+		this.keyColumn, columns, this.sqlTable))
+	defer stmt.Close()
+	sqlRows, err := stmt.Query()
+	if err != nil {
+		return err
+	}
+	defer sqlRows.Close()
+
+	rows := make(map[string]map[string]interface{})
+	values := make([]interface{}, len(this.columns)+1)
+	valuePtrs := make([]interface{}, len(values))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+	for sqlRows.Next() {
+		if err = sqlRows.Scan(valuePtrs...); err != nil {
+			return err
+		}
+
+		row := make(map[string]interface{}, len(this.columns))
+		for i, col := range this.columns {
+			row[col] = sqlValue(values[i+1])
+		}
+		rows[this.keyString(sqlValue(values[0]))] = row
+	}
+	if err = sqlRows.Err(); err != nil {
+		return err
+	}
+
+	this.rows = rows
+	return nil
+}
+
+func (this *enrichTable) lookup(key string) (row map[string]interface{}, present bool) {
+	if this.cache == nil {
+		row, present = this.rows[key]
+		return
+	}
+
+	if cached, ok := this.cache.get(key); ok {
+		// negative result is also cached as nil row
+		row = cached.(map[string]interface{})
+		return row, row != nil
+	}
+
+	values := make([]interface{}, len(this.columns))
+	valuePtrs := make([]interface{}, len(values))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+	if err := this.stmt.QueryRow(key).Scan(valuePtrs...); err == nil {
+		row = make(map[string]interface{}, len(this.columns))
+		for i, col := range this.columns {
+			row[col] = sqlValue(values[i])
+		}
+		present = true
+	}
+
+	this.cache.set(key, row)
+	return
+}
+
+func (this *enrichTable) enrich(msg *als.AlsMessage) {
+	val, err := msg.FieldValue(this.keyField, this.keyType)
+	if err != nil {
+		// no such field
+		return
+	}
+
+	row, present := this.lookup(this.keyString(val))
+	if !present {
+		this.missN += 1
+		return
+	}
+
+	this.hitN += 1
+	for col, val := range row {
+		msg.SetField(this.prefix+col, val)
+	}
+}
+
+func (this *enrichTable) keyString(key interface{}) string {
+	switch k := key.(type) {
+	case string:
+		return k
+	case float64:
+		// json numbers
+		return fmt.Sprintf("%.0f", k)
+	default:
+		return fmt.Sprintf("%v", k)
+	}
+}
+
+func (this *enrichTable) close() {
+	if this.stmt != nil {
+		this.stmt.Close()
+		this.stmt = nil
+	}
+	if this.db != nil {
+		this.db.Close()
+		this.db = nil
+	}
+}
+
+// sqlite3 driver returns TEXT columns as []byte
+func sqlValue(val interface{}) interface{} {
+	if b, ok := val.([]byte); ok {
+		return string(b)
+	}
+
+	return val
+}
+
+// Join message fields against local lookup tables
+type EnrichFilter struct {
+	ident          string
+	reloadInterval time.Duration
+	tables         []*enrichTable
+}
+
+func (this *EnrichFilter) Init(config *conf.Conf) {
+	this.ident = config.String("ident", "")
+	if this.ident == "" {
+		panic("empty ident")
+	}
+	this.reloadInterval = time.Duration(config.Int("reload_interval", 60)) * time.Second
+	this.tables = make([]*enrichTable, 0, 5)
+	for i := 0; i < len(config.List("tables", nil)); i++ {
+		section, err := config.Section(fmt.Sprintf("tables[%d]", i))
+		if err != nil {
+			panic(err)
+		}
+
+		table := new(enrichTable)
+		table.load(section)
+		if _, err = table.refresh(); err != nil {
+			panic(err)
+		}
+		this.tables = append(this.tables, table)
+	}
+	if len(this.tables) == 0 {
+		panic("empty 'tables'")
+	}
+}
+
+func (this *EnrichFilter) Run(r engine.FilterRunner, h engine.PluginHelper) error {
+	var (
+		globals      = engine.Globals()
+		pack         *engine.PipelinePack
+		ok           = true
+		count        = 0
+		inChan       = r.InChan()
+		reloadTicker = time.NewTicker(this.reloadInterval)
+	)
+
+	defer reloadTicker.Stop()
+
+LOOP:
+	for ok {
+		select {
+		case <-reloadTicker.C:
+			this.refreshTables()
+
+		case pack, ok = <-inChan:
+			if !ok {
+				break LOOP
+			}
+
+			if globals.Debug {
+				globals.Println(*pack)
+			}
+
+			count += 1
+			this.handlePack(pack, r, h)
+			pack.Recycle()
+		}
+	}
+
+	for _, table := range this.tables {
+		globals.Printf("[%s]table %s hit: %d, miss: %d", r.Name(), table.name,
+			table.hitN, table.missN)
+		table.close()
+	}
+	globals.Printf("[%s]Total filtered: %d", r.Name(), count)
+
+	return nil
+}
+
+func (this *EnrichFilter) refreshTables() {
+	globals := engine.Globals()
+	for _, table := range this.tables {
+		reloaded, err := table.refresh()
+		if err != nil {
+			// keep on using the old table
+			globals.Printf("enrich table[%s] %v", table.name, err)
+			continue
+		}
+
+		if reloaded && globals.Verbose {
+			globals.Printf("enrich table[%s] reloaded from %s", table.name, table.file)
+		}
+	}
+}
+
+func (this *EnrichFilter) handlePack(p *engine.PipelinePack,
+	r engine.FilterRunner, h engine.PluginHelper) {
+	// generate new pack
+	pack := h.PipelinePack(p.MsgLoopCount)
+	if pack == nil {
+		h.Project(p.Project).Println("can't get pack in filter")
+		return
+	}
+
+	p.CopyTo(pack)
+	pack.Ident = this.ident
+	for _, table := range this.tables {
+		table.enrich(pack.Message)
+	}
+
+	r.Inject(pack)
+}
+
+func init() {
+	engine.RegisterPlugin("EnrichFilter", func() engine.Plugin {
+		return new(EnrichFilter)
+	})
+}
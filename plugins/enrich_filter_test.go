@@ -0,0 +1,50 @@
+package plugins
+
+import (
+	"github.com/funkygao/assert"
+	"testing"
+)
+
+func TestLruCache(t *testing.T) {
+	c := newLruCache(2)
+	c.set("a", 1)
+	c.set("b", 2)
+	c.get("a")
+	c.set("c", 3) // b evicted
+	_, ok := c.get("b")
+	assert.Equal(t, false, ok)
+	v, ok := c.get("a")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 1, v)
+	assert.Equal(t, 2, c.len())
+}
+
+func TestEnrichTableCsv(t *testing.T) {
+	table := &enrichTable{file: "fixture/payer.csv", format: "csv",
+		keyColumn: "uid", columns: []string{"tier", "channel"}}
+	reloaded, err := table.refresh()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, reloaded)
+	row, present := table.lookup("1001")
+	assert.Equal(t, true, present)
+	assert.Equal(t, "whale", row["tier"])
+	assert.Equal(t, "facebook", row["channel"])
+	_, present = table.lookup("1003")
+	assert.Equal(t, false, present)
+
+	// file not changed, no reload
+	reloaded, _ = table.refresh()
+	assert.Equal(t, false, reloaded)
+}
+
+func TestEnrichTableJson(t *testing.T) {
+	table := &enrichTable{file: "fixture/payer.json", format: "json",
+		keyColumn: "uid", columns: []string{"tier", "channel"}}
+	_, err := table.refresh()
+	assert.Equal(t, nil, err)
+	row, present := table.lookup("1002")
+	assert.Equal(t, true, present)
+	assert.Equal(t, "dolphin", row["tier"])
+	_, present = row["channel"]
+	assert.Equal(t, false, present)
+}
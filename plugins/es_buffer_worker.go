@@ -9,18 +9,18 @@ import (
 )
 
 type esBufferWorker struct {
-	ident        string
-	projectName  string
-	camelName    string
-	indexPattern string
-	fieldName    string
-	fieldType    string
-	expression   string // count, mean, max, min, sum, sd
-	interval     time.Duration
+	ident       string
+	projectName string
+	camelName   string
+	index       *esName
+	typ         *esName
+	fieldName   string
+	fieldType   string
+	expression  string // count, mean, max, min, sum, sd
+	interval    time.Duration
 
 	summary   stats.Summary
 	esField   string
-	esType    string
 	timestamp uint64
 
 	stopChan chan interface{}
@@ -37,7 +37,8 @@ func (this *esBufferWorker) init(config *conf.Conf, ident string,
 	this.stopChan = stopChan
 	this.interval = time.Duration(config.Int("interval", 10)) * time.Second
 	this.projectName = config.String("project", "")
-	this.indexPattern = config.String("index_pattern", "@ym")
+	this.index = newEsIndexName(config.String("index_prefix", INDEX_PREFIX),
+		config.String("index_pattern", YM))
 	this.expression = config.String("expression", "count")
 	if this.expression != "count" {
 		this.fieldName = config.String("field_name", "")
@@ -56,7 +57,8 @@ func (this *esBufferWorker) init(config *conf.Conf, ident string,
 	default:
 		this.esField = this.expression + "_" + this.fieldName
 	}
-	this.esType = this.camelName + "_" + this.expression
+	this.typ = newEsTypeName(config.String("type_pattern",
+		"{camelName}_"+this.expression))
 }
 
 func (this *esBufferWorker) inject(pack *engine.PipelinePack) {
@@ -114,11 +116,22 @@ func (this *esBufferWorker) flush(r engine.FilterRunner, h engine.PluginHelper)
 
 	pack.Message.Timestamp = this.timestamp
 	pack.Ident = this.ident
-	pack.EsIndex = indexName(h.Project(this.projectName),
-		this.indexPattern, time.Unix(int64(this.timestamp), 0))
-	pack.EsType = this.esType
+	var (
+		project = h.Project(this.projectName)
+		date    = time.Unix(int64(this.timestamp), 0).In(project.Location())
+		globals = engine.Globals()
+		err     error
+	)
+	pack.EsIndex, err = this.index.render(project, this.ident, this.camelName,
+		date, pack.Message)
+	if err == nil {
+		pack.EsType, err = this.typ.render(project, this.ident, this.camelName,
+			date, pack.Message)
+	}
+	if err != nil {
+		globals.Printf("[%s]%v", this.camelName, err)
+	}
 	pack.Project = this.projectName
-	globals := engine.Globals()
 	if globals.Debug {
 		globals.Println(*pack)
 	}
@@ -127,11 +140,15 @@ func (this *esBufferWorker) flush(r engine.FilterRunner, h engine.PluginHelper)
 	this.summary.Reset()
 }
 
+// Windows are aligned to the interval in the project timezone, so a daily
+// window rolls at the project's midnight
 func (this *esBufferWorker) run(r engine.FilterRunner, h engine.PluginHelper) {
+	project := h.Project(this.projectName)
 	ever := true
 	for ever {
+		now := project.Now()
 		select {
-		case <-time.After(this.interval):
+		case <-time.After(windowStart(now, this.interval).Add(this.interval).Sub(now)):
 			this.flush(r, h)
 
 		case <-this.stopChan:
@@ -0,0 +1,477 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/funkygao/dpipe/engine"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ES_SPOOL_SUFFIX     = ".bulk"
+	SPOOL_BAD_SUFFIX    = ".bad"
+	SPOOL_REPLAY_SUFFIX = ".replay" // in flight
+)
+
+var (
+	errEsUnavailable  = errors.New("ES unavailable")
+	errSpoolTruncated = errors.New("truncated spool file")
+	errNoSpoolDir     = errors.New("no spool_dir")
+)
+
+// A batch of docs, each doc is the action line followed by source line
+type esBulk struct {
+	docs      [][]byte
+	size      int
+	spoolFile string // replayed from, removed once done
+}
+
+func (this *esBulk) add(doc []byte) {
+	this.docs = append(this.docs, doc)
+	this.size += len(doc)
+}
+
+func (this *esBulk) body() *bytes.Buffer {
+	buf := bytes.NewBuffer(make([]byte, 0, this.size))
+	for _, doc := range this.docs {
+		buf.Write(doc)
+	}
+	return buf
+}
+
+type esBulkItem struct {
+	Status int         `json:"status"`
+	Error  interface{} `json:"error"` // string or object, depends on ES version
+}
+
+type esBulkResponse struct {
+	Errors bool                    `json:"errors"`
+	Items  []map[string]esBulkItem `json:"items"` // op type -> result
+}
+
+// Bulk indexer that inspects each item of the bulk response.
+// Retryable failures are retried with exponential backoff, and what
+// still can't be delivered goes to the on-disk spool for later replay.
+type esBulkIndexer struct {
+	baseUrl      string // e,g. http://localhost:9200
+	maxConn      int
+	maxDocs      int
+	maxBuffer    int
+	maxRetries   int
+	retryBackoff time.Duration
+	maxBackoff   time.Duration
+	spoolDir     string
+	client       *http.Client
+
+	replayInterval time.Duration // zero means never
+	replayMax      int           // max spool files each replay
+
+	mu         sync.Mutex
+	pending    *esBulk
+	sendChan   chan *esBulk
+	wg         *sync.WaitGroup
+	quit       chan bool
+	replayDone chan bool
+
+	indexedN  int64
+	retriedN  int64
+	rejectedN int64
+	spooledN  int64
+	replayedN int64
+}
+
+func (this *esBulkIndexer) start() {
+	if this.spoolDir != "" {
+		if err := os.MkdirAll(this.spoolDir, 0755); err != nil {
+			panic(err)
+		}
+		recoverSpool(this.spoolDir, ES_SPOOL_SUFFIX)
+	}
+
+	this.pending = new(esBulk)
+	this.sendChan = make(chan *esBulk, this.maxConn)
+	this.wg = new(sync.WaitGroup)
+	for i := 0; i < this.maxConn; i++ {
+		this.wg.Add(1)
+		go func() {
+			defer this.wg.Done()
+
+			for bulk := range this.sendChan {
+				this.send(bulk)
+			}
+		}()
+	}
+
+	this.quit = make(chan bool)
+	this.replayDone = make(chan bool)
+	go this.replayLoop()
+}
+
+// Flush pending docs and wait for all the inflight bulks done
+func (this *esBulkIndexer) stop() {
+	close(this.quit)
+	<-this.replayDone
+
+	this.flush()
+	close(this.sendChan)
+	this.wg.Wait()
+}
+
+func (this *esBulkIndexer) index(index, typ, id string, date time.Time,
+	data []byte) error {
+	meta := map[string]interface{}{
+		"_index":     index,
+		"_type":      typ,
+		"_timestamp": date.Format(time.RFC3339),
+	}
+	if id != "" {
+		meta["_id"] = id
+	}
+	action, err := json.Marshal(map[string]interface{}{"index": meta})
+	if err != nil {
+		return err
+	}
+
+	doc := make([]byte, 0, len(action)+len(data)+2)
+	doc = append(doc, action...)
+	doc = append(doc, '\n')
+	doc = append(doc, data...)
+	doc = append(doc, '\n')
+
+	this.mu.Lock()
+	this.pending.add(doc)
+	full := len(this.pending.docs) >= this.maxDocs || this.pending.size >= this.maxBuffer
+	this.mu.Unlock()
+
+	if full {
+		this.flush()
+	}
+
+	return nil
+}
+
+func (this *esBulkIndexer) flush() {
+	this.mu.Lock()
+	bulk := this.pending
+	this.pending = new(esBulk)
+	this.mu.Unlock()
+
+	if len(bulk.docs) > 0 {
+		this.sendChan <- bulk
+	}
+}
+
+func (this *esBulkIndexer) send(bulk *esBulk) {
+	var (
+		backoff   = this.retryBackoff
+		globals   = engine.Globals()
+		spoolFile = bulk.spoolFile
+	)
+
+	for attempt := 0; ; attempt++ {
+		retry, err := this.post(bulk)
+		if err == nil && retry == nil {
+			releaseSpool(spoolFile, true)
+			return
+		}
+
+		if err == nil {
+			// partially failed
+			bulk = retry
+		}
+
+		if attempt >= this.maxRetries {
+			if err != nil {
+				globals.Printf("ES bulk of %d docs: %v", len(bulk.docs), err)
+			}
+
+			releaseSpool(spoolFile, this.spool(bulk) == nil)
+			return
+		}
+
+		atomic.AddInt64(&this.retriedN, int64(len(bulk.docs)))
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > this.maxBackoff {
+			backoff = this.maxBackoff
+		}
+	}
+}
+
+// Returns the docs that can be retried, or error if the whole bulk failed
+func (this *esBulkIndexer) post(bulk *esBulk) (retry *esBulk, err error) {
+	res, err := this.client.Post(this.baseUrl+"/_bulk", "application/json",
+		bulk.body())
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+
+	if res.StatusCode != http.StatusOK {
+		if esRetryableStatus(res.StatusCode) {
+			return nil, fmt.Errorf("%s: %s", res.Status, body)
+		}
+
+		// the whole bulk is rejected, e,g. malformed request
+		atomic.AddInt64(&this.rejectedN, int64(len(bulk.docs)))
+		engine.Globals().Printf("ES rejected bulk of %d docs: %s %s",
+			len(bulk.docs), res.Status, body)
+		return
+	}
+
+	var response esBulkResponse
+	if err = json.Unmarshal(body, &response); err != nil {
+		return
+	}
+
+	if !response.Errors {
+		atomic.AddInt64(&this.indexedN, int64(len(bulk.docs)))
+		return
+	}
+
+	if len(response.Items) != len(bulk.docs) {
+		// can't tell which doc failed, retry them all
+		engine.Globals().Printf("ES bulk items mismatch: %d/%d",
+			len(response.Items), len(bulk.docs))
+		return bulk, nil
+	}
+
+	for i, result := range response.Items {
+		for _, item := range result {
+			switch {
+			case item.Status >= 200 && item.Status < 300:
+				atomic.AddInt64(&this.indexedN, 1)
+
+			case esRetryableStatus(item.Status):
+				if retry == nil {
+					retry = new(esBulk)
+				}
+				retry.add(bulk.docs[i])
+
+			default:
+				atomic.AddInt64(&this.rejectedN, 1)
+				engine.Globals().Printf("ES rejected[%d] %v: %s", item.Status,
+					item.Error, bytes.TrimSpace(bulk.docs[i]))
+			}
+		}
+	}
+
+	return
+}
+
+func esRetryableStatus(status int) bool {
+	return status == 429 || status >= 500
+}
+
+func (this *esBulkIndexer) spool(bulk *esBulk) error {
+	globals := engine.Globals()
+	if this.spoolDir == "" {
+		globals.Printf("ES lost %d docs: no spool_dir", len(bulk.docs))
+		return errNoSpoolDir
+	}
+
+	fn := filepath.Join(this.spoolDir,
+		fmt.Sprintf("%d%s", time.Now().UnixNano(), ES_SPOOL_SUFFIX))
+	// write then rename, so that replay never sees a half written file
+	tmp := fn + ".tmp"
+	err := ioutil.WriteFile(tmp, bulk.body().Bytes(), 0644)
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		globals.Printf("ES lost %d docs: %v", len(bulk.docs), err)
+		return err
+	}
+
+	atomic.AddInt64(&this.spooledN, int64(len(bulk.docs)))
+	return nil
+}
+
+// Replay runs aside the output loop, so that a slow ES never stalls intake
+func (this *esBulkIndexer) replayLoop() {
+	defer close(this.replayDone)
+
+	if this.spoolDir == "" || this.replayInterval <= 0 {
+		return
+	}
+
+	var (
+		globals = engine.Globals()
+		ticker  = time.NewTicker(this.replayInterval)
+	)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.quit:
+			return
+
+		case <-ticker.C:
+			replayed, err := this.replaySpool(this.replayMax)
+			if err != nil {
+				if globals.Verbose {
+					globals.Printf("ES spool replay: %v", err)
+				}
+			} else if replayed > 0 {
+				globals.Printf("ES replayed %d spooled bulks", replayed)
+			}
+		}
+	}
+}
+
+// Replay the spooled bulks oldest first if ES is back, at most maxFiles
+// each time to avoid flooding a just recovered ES.
+// Unreadable files are moved aside so that they never block the rest.
+func (this *esBulkIndexer) replaySpool(maxFiles int) (replayed int, err error) {
+	if this.spoolDir == "" {
+		return
+	}
+
+	files, err := filepath.Glob(filepath.Join(this.spoolDir, "*"+ES_SPOOL_SUFFIX))
+	if err != nil || len(files) == 0 {
+		return
+	}
+
+	if !this.alive() {
+		return 0, errEsUnavailable
+	}
+
+	sort.Strings(files)
+	for _, fn := range files {
+		if replayed >= maxFiles {
+			break
+		}
+
+		bulk, e := loadSpooledBulk(fn)
+		if e != nil {
+			moveBadSpool(fn, e)
+			continue
+		}
+
+		// removed only after its docs are delivered or spooled again
+		if bulk.spoolFile, err = claimSpool(fn); err != nil {
+			return
+		}
+
+		atomic.AddInt64(&this.replayedN, int64(len(bulk.docs)))
+		this.sendChan <- bulk
+		replayed += 1
+	}
+
+	return
+}
+
+func loadSpooledBulk(fn string) (bulk *esBulk, err error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var (
+		reader = bufio.NewReader(f)
+		action []byte
+		line   []byte
+	)
+	bulk = new(esBulk)
+	for {
+		line, err = reader.ReadBytes('\n')
+		if err == io.EOF {
+			if action != nil || len(line) > 0 {
+				return nil, errSpoolTruncated
+			}
+			return bulk, nil
+		} else if err != nil {
+			return
+		}
+
+		if action == nil {
+			action = line
+			continue
+		}
+
+		// action line and source line are both '\n' terminated
+		bulk.add(append(action, line...))
+		action = nil
+	}
+}
+
+func moveBadSpool(fn string, err error) {
+	globals := engine.Globals()
+	if e := os.Rename(fn, fn+SPOOL_BAD_SUFFIX); e != nil {
+		globals.Printf("spool %s: %v, can't move aside: %v", fn, err, e)
+		return
+	}
+
+	globals.Printf("spool %s: %v, moved aside", fn, err)
+}
+
+// A replayed spool file is renamed while in flight, so that the next replay
+// skips it and a crash leaves it for recoverSpool
+func claimSpool(fn string) (string, error) {
+	inflight := fn + SPOOL_REPLAY_SUFFIX
+	return inflight, os.Rename(fn, inflight)
+}
+
+// Remove the replayed file when done, otherwise put it back for next replay
+func releaseSpool(inflight string, done bool) {
+	if inflight == "" {
+		return
+	}
+
+	var err error
+	if done {
+		err = os.Remove(inflight)
+	} else {
+		err = os.Rename(inflight, strings.TrimSuffix(inflight, SPOOL_REPLAY_SUFFIX))
+	}
+	if err != nil {
+		engine.Globals().Printf("spool %s: %v", inflight, err)
+	}
+}
+
+// Put back the files that were in flight when the process died
+func recoverSpool(dir, suffix string) {
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+suffix+SPOOL_REPLAY_SUFFIX))
+	for _, fn := range files {
+		if err := os.Rename(fn, strings.TrimSuffix(fn,
+			SPOOL_REPLAY_SUFFIX)); err != nil {
+			engine.Globals().Printf("spool %s: %v", fn, err)
+		}
+	}
+}
+
+func (this *esBulkIndexer) alive() bool {
+	res, err := this.client.Get(this.baseUrl + "/")
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+
+	return res.StatusCode == http.StatusOK
+}
+
+func (this *esBulkIndexer) spooledFiles() int {
+	if this.spoolDir == "" {
+		return 0
+	}
+
+	files, _ := filepath.Glob(filepath.Join(this.spoolDir, "*"+ES_SPOOL_SUFFIX))
+	return len(files)
+}
@@ -0,0 +1,229 @@
+package plugins
+
+import (
+	"fmt"
+	"github.com/funkygao/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEsBulkIndexerItemErrors(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts int
+	)
+	// 1st doc ok, 2nd doc rejected, 3rd doc retried once and then ok
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+
+		body, _ := ioutil.ReadAll(req.Body)
+		docN := strings.Count(string(body), "\n") / 2
+		if attempts == 1 {
+			assert.Equal(t, 3, docN)
+			fmt.Fprint(w, `{"errors":true,"items":[{"index":{"status":201}},{"index":{"status":400,"error":"MapperParsingException"}},{"index":{"status":429,"error":"EsRejectedExecutionException"}}]}`)
+			return
+		}
+
+		assert.Equal(t, 1, docN)
+		fmt.Fprint(w, `{"errors":false,"items":[{"index":{"status":201}}]}`)
+	}))
+	defer es.Close()
+
+	indexer := &esBulkIndexer{baseUrl: es.URL, maxConn: 1, maxDocs: 100,
+		maxBuffer: 1 << 20, maxRetries: 2, retryBackoff: time.Millisecond,
+		maxBackoff: time.Millisecond, client: &http.Client{Timeout: time.Second}}
+	indexer.start()
+	for i := 0; i < 3; i++ {
+		indexer.index("fun_rs", "pv", fmt.Sprintf("%d", i), time.Now(),
+			[]byte(`{"uid":1}`))
+	}
+	indexer.stop()
+
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, int64(2), indexer.indexedN)
+	assert.Equal(t, int64(1), indexer.rejectedN)
+	assert.Equal(t, int64(1), indexer.retriedN)
+	assert.Equal(t, int64(0), indexer.spooledN)
+}
+
+func TestEsBulkIndexerItemsMismatch(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts int
+	)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+
+		if attempts == 1 {
+			fmt.Fprint(w, `{"errors":true,"items":[{"index":{"status":201}}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"errors":false,"items":[{"index":{"status":201}},{"index":{"status":201}}]}`)
+	}))
+	defer es.Close()
+
+	indexer := &esBulkIndexer{baseUrl: es.URL, maxConn: 1, maxDocs: 100,
+		maxBuffer: 1 << 20, maxRetries: 2, retryBackoff: time.Millisecond,
+		maxBackoff: time.Millisecond, client: &http.Client{Timeout: time.Second}}
+	indexer.start()
+	indexer.index("fun_rs", "pv", "1", time.Now(), []byte(`{"uid":1}`))
+	indexer.index("fun_rs", "pv", "2", time.Now(), []byte(`{"uid":2}`))
+	indexer.stop()
+
+	// the whole bulk is retried
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, int64(2), indexer.retriedN)
+	assert.Equal(t, int64(2), indexer.indexedN)
+}
+
+func TestEsBulkIndexerSpoolAndReplay(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		down = true
+	)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if req.URL.Path == "/_bulk" {
+			fmt.Fprint(w, `{"errors":false,"items":[]}`)
+		}
+	}))
+	defer es.Close()
+
+	spoolDir, _ := ioutil.TempDir("", "es_spool")
+	defer os.RemoveAll(spoolDir)
+	indexer := &esBulkIndexer{baseUrl: es.URL, maxConn: 1, maxDocs: 100,
+		maxBuffer: 1 << 20, maxRetries: 2, retryBackoff: time.Millisecond,
+		maxBackoff: time.Millisecond, spoolDir: spoolDir,
+		client: &http.Client{Timeout: time.Second}}
+	indexer.start()
+	indexer.index("fun_rs", "pv", "1", time.Now(), []byte(`{"uid":1}`))
+	indexer.index("fun_rs", "pv", "2", time.Now(), []byte(`{"uid":2}`))
+	indexer.flush()
+
+	// wait for retries exhausted
+	for i := 0; i < 100 && indexer.spooledFiles() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, indexer.spooledFiles())
+	assert.Equal(t, int64(2), atomic.LoadInt64(&indexer.spooledN))
+
+	_, err := indexer.replaySpool(10)
+	assert.Equal(t, errEsUnavailable, err)
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	replayed, err := indexer.replaySpool(10)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, replayed)
+	indexer.stop()
+
+	assert.Equal(t, 0, indexer.spooledFiles())
+	assert.Equal(t, int64(2), atomic.LoadInt64(&indexer.indexedN))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&indexer.replayedN))
+}
+
+func TestEsBulkIndexerReplayBadSpool(t *testing.T) {
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		if req.URL.Path == "/_bulk" {
+			fmt.Fprint(w, `{"errors":false,"items":[]}`)
+		}
+	}))
+	defer es.Close()
+
+	spoolDir, _ := ioutil.TempDir("", "es_spool")
+	defer os.RemoveAll(spoolDir)
+	indexer := &esBulkIndexer{baseUrl: es.URL, maxConn: 1, maxDocs: 100,
+		maxBuffer: 1 << 20, maxRetries: 2, retryBackoff: time.Millisecond,
+		maxBackoff: time.Millisecond, spoolDir: spoolDir,
+		client: &http.Client{Timeout: time.Second}}
+	indexer.start()
+
+	// the truncated oldest file must not block the good one
+	bad := filepath.Join(spoolDir, "1"+ES_SPOOL_SUFFIX)
+	ioutil.WriteFile(bad, []byte(`{"index":{"_index":"fun_rs"}}`+"\n"), 0644)
+	indexer.spool(&esBulk{docs: [][]byte{
+		[]byte(`{"index":{"_index":"fun_rs"}}` + "\n" + `{"uid":1}` + "\n")}})
+
+	replayed, err := indexer.replaySpool(10)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, replayed)
+	indexer.stop()
+
+	assert.Equal(t, 0, indexer.spooledFiles())
+	_, err = os.Stat(bad + SPOOL_BAD_SUFFIX)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(1), indexer.indexedN)
+}
+
+func TestEsBulkIndexerReplayLoop(t *testing.T) {
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		if req.URL.Path == "/_bulk" {
+			fmt.Fprint(w, `{"errors":false,"items":[]}`)
+		}
+	}))
+	defer es.Close()
+
+	spoolDir, _ := ioutil.TempDir("", "es_spool")
+	defer os.RemoveAll(spoolDir)
+	indexer := &esBulkIndexer{baseUrl: es.URL, maxConn: 1, maxDocs: 100,
+		maxBuffer: 1 << 20, maxRetries: 2, retryBackoff: time.Millisecond,
+		maxBackoff: time.Millisecond, spoolDir: spoolDir,
+		client: &http.Client{Timeout: time.Second}}
+	indexer.replayInterval = time.Millisecond
+	indexer.replayMax = 10
+	indexer.start()
+	indexer.spool(&esBulk{docs: [][]byte{
+		[]byte(`{"index":{"_index":"fun_rs"}}` + "\n" + `{"uid":1}` + "\n")}})
+
+	for i := 0; i < 100 && atomic.LoadInt64(&indexer.indexedN) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	indexer.stop()
+	assert.Equal(t, 0, indexer.spooledFiles())
+	assert.Equal(t, int64(1), indexer.indexedN)
+}
+
+func TestEsBulkIndexerRecoverSpool(t *testing.T) {
+	spoolDir, _ := ioutil.TempDir("", "es_spool")
+	defer os.RemoveAll(spoolDir)
+	indexer := &esBulkIndexer{maxConn: 1, spoolDir: spoolDir}
+	indexer.spool(&esBulk{docs: [][]byte{
+		[]byte(`{"index":{"_index":"fun_rs"}}` + "\n" + `{"uid":1}` + "\n")}})
+
+	// killed while the replayed file is in flight
+	files, _ := filepath.Glob(filepath.Join(spoolDir, "*"+ES_SPOOL_SUFFIX))
+	_, err := claimSpool(files[0])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, indexer.spooledFiles())
+
+	indexer.start()
+	indexer.stop()
+	assert.Equal(t, 1, indexer.spooledFiles())
+	bulk, err := loadSpooledBulk(files[0])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(bulk.docs))
+}
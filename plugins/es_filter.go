@@ -1,11 +1,17 @@
 package plugins
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"github.com/abh/geoip"
 	"github.com/funkygao/als"
 	"github.com/funkygao/dpipe/engine"
 	conf "github.com/funkygao/jsconf"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type esConverter struct {
@@ -14,6 +20,18 @@ type esConverter struct {
 	currency    string   // currency field name
 	rang        []int    // range
 	normalizers []string
+
+	keyType   string      // value type of the keys
+	to        string      // target field name, defaults to the key itself
+	separator string      // split
+	salt      string      // hash
+	length    int         // truncate, in bytes
+	layout    string      // parse_time
+	castType  string      // cast
+	dflt      interface{} // default
+
+	geoFields map[string]string // ip: country|region|city|location|asn -> field name
+	uaFields  map[string]string // useragent: browser|browser_version|os|os_version|device -> field name
 }
 
 func (this *esConverter) load(section *conf.Conf) {
@@ -22,12 +40,94 @@ func (this *esConverter) load(section *conf.Conf) {
 	this.currency = section.String("currency", "")
 	this.rang = section.IntList("range", nil)
 	this.normalizers = section.StringList("normalizers", nil)
+
+	this.keyType = section.String("key_type", als.KEY_TYPE_STRING)
+	this.to = section.String("to", "")
+	this.separator = section.String("separator", ",")
+	this.salt = section.String("salt", "")
+	this.length = section.Int("length", 0)
+	this.layout = section.String("layout", "2006-01-02 15:04:05")
+	this.castType = section.String("cast_type", "")
+	this.dflt = section.Interface("default", nil)
+
+	switch this.typ {
+	case "ip":
+		this.geoFields = make(map[string]string)
+		for _, kind := range []string{"country", "region", "city", "location", "asn"} {
+			dflt := ""
+			if kind == "country" {
+				dflt = "_cntry"
+			}
+			if name := section.String("geo_fields."+kind, dflt); name != "" {
+				this.geoFields[kind] = name
+			}
+		}
+
+	case "useragent":
+		this.uaFields = make(map[string]string)
+		for kind, dflt := range map[string]string{
+			"browser":         "_browser",
+			"browser_version": "_browser_ver",
+			"os":              "_os",
+			"os_version":      "_os_ver",
+			"device":          "_device",
+		} {
+			if name := section.String("ua_fields."+kind, dflt); name != "" {
+				this.uaFields[kind] = name
+			}
+		}
+
+	case "rename", "copy":
+		if this.to == "" {
+			panic(this.typ + " converter must have 'to'")
+		}
+
+	case "truncate":
+		if this.length <= 0 {
+			panic("truncate converter must have positive 'length'")
+		}
+
+	case "cast":
+		switch this.castType {
+		case als.KEY_TYPE_INT, als.KEY_TYPE_FLOAT, als.KEY_TYPE_STRING:
+		default:
+			panic("invalid cast_type: " + this.castType)
+		}
+
+	case "default":
+		if this.dflt == nil {
+			panic("default converter must have 'default'")
+		}
+
+		if section.String("key_type", "") == "" {
+			// check key existence with the same type as default value
+			if _, ok := this.dflt.(string); !ok {
+				this.keyType = als.KEY_TYPE_FLOAT
+			}
+		}
+	}
+}
+
+// the field name where converted value goes
+func (this *esConverter) target(key string) string {
+	if this.to != "" {
+		return this.to
+	}
+
+	return key
 }
 
 type EsFilter struct {
-	ident        string
-	indexPattern string
-	converters   []esConverter
+	ident      string
+	index      *esName
+	typ        *esName
+	converters []esConverter
+
+	reloadInterval time.Duration
+	countryDb      *geoDb
+	cityDb         *geoDb
+	asnDb          *geoDb
+	uaParser       *uaParser
 }
 
 func (this *EsFilter) Init(config *conf.Conf) {
@@ -36,7 +136,9 @@ func (this *EsFilter) Init(config *conf.Conf) {
 		panic("empty ident")
 	}
 	this.converters = make([]esConverter, 0, 10)
-	this.indexPattern = config.String("index_pattern", "")
+	this.index = newEsIndexName(config.String("index_prefix", INDEX_PREFIX),
+		config.String("index_pattern", ""))
+	this.typ = newEsTypeName(config.String("type_pattern", "{camelName}"))
 	for i := 0; i < len(config.List("converts", nil)); i++ {
 		section, err := config.Section(fmt.Sprintf("%s[%d]", "converts", i))
 		if err != nil {
@@ -48,28 +150,104 @@ func (this *EsFilter) Init(config *conf.Conf) {
 		this.converters = append(this.converters, c)
 	}
 
-	geodbFile := config.String("geodbfile", "")
-	if err := als.LoadGeoDb(geodbFile); err != nil {
+	var (
+		err       error
+		needCity  bool
+		needAsn   bool
+		geodbFile = config.String("geodbfile", "")
+		globals   = engine.Globals()
+	)
+	for _, c := range this.converters {
+		for kind, _ := range c.geoFields {
+			switch kind {
+			case "region", "city", "location":
+				needCity = true
+			case "asn":
+				needAsn = true
+			}
+		}
+	}
+
+	// ua rules are checked for change along with geodb
+	this.reloadInterval = time.Duration(config.Int("geodb_check_interval", 600)) * time.Second
+	if this.countryDb, err = newGeoDb(geodbFile); err != nil {
 		panic(err)
 	}
-	globals := engine.Globals()
+	if needCity {
+		if this.cityDb, err = newGeoDb(config.String("geocitydbfile", "")); err != nil {
+			panic(err)
+		}
+	}
+	if needAsn {
+		if this.asnDb, err = newGeoDb(config.String("geoasndbfile", "")); err != nil {
+			panic(err)
+		}
+	}
 	if globals.Verbose {
 		globals.Printf("Loaded geodb %s\n", geodbFile)
 	}
+
+	for _, c := range this.converters {
+		if c.typ == "useragent" {
+			cacheSize := config.Int("ua_cache_size", 10000)
+			if cacheSize <= 0 {
+				panic("ua_cache_size must be positive")
+			}
+			this.uaParser, err = newUaParser(config.String("ua_rules", ""),
+				cacheSize)
+			if err != nil {
+				panic(err)
+			}
+
+			break
+		}
+	}
+}
+
+// Pick up the GeoIP db files updated by cron.upgeodb and the ua rules file
+func (this *EsFilter) refreshDbs() {
+	globals := engine.Globals()
+	for _, db := range []*geoDb{this.countryDb, this.cityDb, this.asnDb} {
+		if db == nil {
+			continue
+		}
+
+		reloaded, err := db.refresh()
+		if err != nil {
+			globals.Printf("geodb %s: %v", db.file, err)
+		} else if reloaded {
+			globals.Printf("Reloaded geodb %s", db.file)
+		}
+	}
+
+	if this.uaParser != nil {
+		reloaded, err := this.uaParser.refresh()
+		if err != nil {
+			globals.Printf("ua rules %s: %v", this.uaParser.file, err)
+		} else if reloaded {
+			globals.Printf("Reloaded ua rules %s", this.uaParser.file)
+		}
+	}
 }
 
 func (this *EsFilter) Run(r engine.FilterRunner, h engine.PluginHelper) error {
 	var (
-		globals = engine.Globals()
-		pack    *engine.PipelinePack
-		ok      = true
-		count   = 0
-		inChan  = r.InChan()
+		globals      = engine.Globals()
+		pack         *engine.PipelinePack
+		ok           = true
+		count        = 0
+		inChan       = r.InChan()
+		reloadTicker = time.NewTicker(this.reloadInterval)
 	)
 
+	defer reloadTicker.Stop()
+
 LOOP:
 	for ok {
 		select {
+		case <-reloadTicker.C:
+			this.refreshDbs()
+
 		case pack, ok = <-inChan:
 			if !ok {
 				break LOOP
@@ -103,12 +281,24 @@ func (this *EsFilter) handlePack(p *engine.PipelinePack,
 
 	p.CopyTo(pack)
 
+	var (
+		camelName = pack.Logfile.CamelCaseName()
+		date      = time.Unix(int64(pack.Message.Timestamp), 0).In(project.Location())
+		err       error
+	)
 	if pack.EsType == "" {
-		pack.EsType = pack.Logfile.CamelCaseName()
+		pack.EsType, err = this.typ.render(project, this.ident, camelName,
+			date, pack.Message)
+		if err != nil && project.ShowError {
+			project.Printf("type %s: %v", this.typ.pattern, err)
+		}
 	}
 	if pack.EsIndex == "" {
-		pack.EsIndex = indexName(project, this.indexPattern,
-			time.Unix(int64(pack.Message.Timestamp), 0))
+		pack.EsIndex, err = this.index.render(project, this.ident, camelName,
+			date, pack.Message)
+		if err != nil && project.ShowError {
+			project.Printf("index %s: %v", this.index.pattern, err)
+		}
 	}
 
 	// each ES item has area and ts fields
@@ -158,7 +348,33 @@ func (this *EsFilter) handlePack(p *engine.PipelinePack,
 					continue
 				}
 
-				pack.Message.SetField("_cntry", als.IpToCountry(ip.(string)))
+				this.setGeoFields(pack.Message, conv, ip.(string))
+
+			case "useragent":
+				ua, err := pack.Message.FieldValue(key, als.KEY_TYPE_STRING)
+				if err != nil || ua.(string) == "" {
+					continue
+				}
+
+				info := this.uaParser.parse(ua.(string))
+				for kind, name := range conv.uaFields {
+					var val string
+					switch kind {
+					case "browser":
+						val = info.browser
+					case "browser_version":
+						val = info.browserVersion
+					case "os":
+						val = info.os
+					case "os_version":
+						val = info.osVersion
+					case "device":
+						val = info.device
+					}
+					if val != "" {
+						pack.Message.SetField(name, val)
+					}
+				}
 
 			case "range":
 				if len(conv.rang) < 2 {
@@ -174,6 +390,100 @@ func (this *EsFilter) handlePack(p *engine.PipelinePack,
 
 			case "del":
 				pack.Message.DelField(key)
+
+			case "rename", "copy":
+				val, err := pack.Message.FieldValue(key, conv.keyType)
+				if err != nil {
+					continue
+				}
+
+				pack.Message.SetField(conv.to, val)
+				if conv.typ == "rename" {
+					pack.Message.DelField(key)
+				}
+
+			case "lowercase", "uppercase":
+				val, err := pack.Message.FieldValue(key, als.KEY_TYPE_STRING)
+				if err != nil {
+					continue
+				}
+
+				if conv.typ == "lowercase" {
+					val = strings.ToLower(val.(string))
+				} else {
+					val = strings.ToUpper(val.(string))
+				}
+				pack.Message.SetField(conv.target(key), val)
+
+			case "split":
+				val, err := pack.Message.FieldValue(key, als.KEY_TYPE_STRING)
+				if err != nil {
+					continue
+				}
+
+				parts := make([]string, 0, 5)
+				for _, part := range strings.Split(val.(string), conv.separator) {
+					if part = strings.TrimSpace(part); part != "" {
+						parts = append(parts, part)
+					}
+				}
+				pack.Message.SetField(conv.target(key), parts)
+
+			case "hash":
+				val, err := pack.Message.FieldValue(key, conv.keyType)
+				if err != nil {
+					continue
+				}
+
+				sum := sha256.Sum256([]byte(conv.salt + fmt.Sprintf("%v", val)))
+				pack.Message.SetField(conv.target(key), hex.EncodeToString(sum[:]))
+
+			case "truncate":
+				val, err := pack.Message.FieldValue(key, als.KEY_TYPE_STRING)
+				if err != nil {
+					continue
+				}
+
+				if len(val.(string)) > conv.length {
+					pack.Message.SetField(conv.target(key),
+						truncateBytes(val.(string), conv.length))
+				}
+
+			case "parse_time":
+				val, err := pack.Message.FieldValue(key, als.KEY_TYPE_STRING)
+				if err != nil {
+					continue
+				}
+
+				t, err := time.ParseInLocation(conv.layout, val.(string),
+					project.Location())
+				if err != nil {
+					continue
+				}
+
+				pack.Message.SetField("_t", uint64(t.Unix()))
+
+			case "cast":
+				val, err := pack.Message.FieldValue(key, conv.keyType)
+				if err != nil {
+					continue
+				}
+
+				val, err = castValue(val, conv.castType)
+				if err != nil {
+					if project.ShowError {
+						project.Printf("cast %s: %v", key, err)
+					}
+
+					continue
+				}
+
+				pack.Message.SetField(conv.target(key), val)
+
+			case "default":
+				if _, err := pack.Message.FieldValue(key, conv.keyType); err != nil {
+					pack.Message.SetField(key, conv.dflt)
+				}
 			}
 		}
 	}
@@ -181,6 +491,92 @@ func (this *EsFilter) handlePack(p *engine.PipelinePack,
 	r.Inject(pack)
 }
 
+func (this *EsFilter) setGeoFields(msg *als.AlsMessage, conv esConverter,
+	ip string) {
+	if name, present := conv.geoFields["country"]; present {
+		msg.SetField(name, this.countryDb.country(ip))
+	}
+
+	if this.cityDb != nil {
+		if rec := this.cityDb.record(ip); rec != nil {
+			if name, present := conv.geoFields["region"]; present && rec.Region != "" {
+				region := geoip.GetRegionName(rec.CountryCode, rec.Region)
+				if region == "" {
+					region = rec.Region
+				}
+				msg.SetField(name, region)
+			}
+			if name, present := conv.geoFields["city"]; present && rec.City != "" {
+				msg.SetField(name, rec.City)
+			}
+			if name, present := conv.geoFields["location"]; present {
+				// ES geo_point
+				msg.SetField(name, map[string]float32{"lat": rec.Latitude,
+					"lon": rec.Longitude})
+			}
+		}
+	}
+
+	if name, present := conv.geoFields["asn"]; present && this.asnDb != nil {
+		if asn := this.asnDb.asn(ip); asn != "" {
+			msg.SetField(name, asn)
+		}
+	}
+}
+
+// Cast a field value to int, float or string
+func castValue(val interface{}, typ string) (interface{}, error) {
+	switch typ {
+	case als.KEY_TYPE_STRING:
+		switch v := val.(type) {
+		case string:
+			return v, nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		default:
+			return fmt.Sprintf("%v", v), nil
+		}
+
+	case als.KEY_TYPE_INT:
+		switch v := val.(type) {
+		case int:
+			return v, nil
+		case float64:
+			return int(v), nil
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, err
+			}
+			return int(f), nil
+		}
+
+	case als.KEY_TYPE_FLOAT:
+		switch v := val.(type) {
+		case float64:
+			return v, nil
+		case int:
+			return float64(v), nil
+		case string:
+			return strconv.ParseFloat(strings.TrimSpace(v), 64)
+		}
+	}
+
+	return nil, fmt.Errorf("can't cast %T to %s", val, typ)
+}
+
+// Truncate s to at most n bytes without breaking a multi-byte char
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
 func init() {
 	engine.RegisterPlugin("EsFilter", func() engine.Plugin {
 		return new(EsFilter)
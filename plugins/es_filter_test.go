@@ -0,0 +1,25 @@
+package plugins
+
+import (
+	"github.com/funkygao/als"
+	"github.com/funkygao/assert"
+	"testing"
+)
+
+func TestCastValue(t *testing.T) {
+	v, err := castValue("12.7", als.KEY_TYPE_INT)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 12, v)
+	v, _ = castValue(12, als.KEY_TYPE_FLOAT)
+	assert.Equal(t, 12.0, v)
+	v, _ = castValue(3.50, als.KEY_TYPE_STRING)
+	assert.Equal(t, "3.5", v)
+	_, err = castValue("abc", als.KEY_TYPE_FLOAT)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestTruncateBytes(t *testing.T) {
+	assert.Equal(t, "hello", truncateBytes("hello", 10))
+	assert.Equal(t, "hel", truncateBytes("hello", 3))
+	assert.Equal(t, "中", truncateBytes("中文", 4)) // never split a rune
+}
@@ -0,0 +1,307 @@
+package plugins
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/funkygao/dpipe/engine"
+	conf "github.com/funkygao/jsconf"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	ES_RETENTION_DELETE = "delete"
+	ES_RETENTION_CLOSE  = "close"
+)
+
+// An index template whose body is a json file, e,g. the one in thirdParty/es/template.sh
+type esIndexTemplate struct {
+	name      string
+	file      string
+	overwrite bool // PUT even if ES already has it
+}
+
+func (this *esIndexTemplate) load(section *conf.Conf) {
+	this.name = section.String("name", "")
+	this.file = section.String("file", "")
+	if this.name == "" || this.file == "" {
+		panic("index template must have 'name' and 'file'")
+	}
+	this.overwrite = section.Bool("overwrite", false)
+}
+
+// Dated indices of a project produced by indexName
+type esManagedIndex struct {
+	projectName  string
+	indexPrefix  string
+	indexPattern string // @ym, @ymw, @ymd
+	alias        string // points to the current index, empty means no alias
+	keep         time.Duration
+	action       string // delete or close indices older than keep
+
+	project *engine.ConfProject
+}
+
+func (this *esManagedIndex) load(section *conf.Conf) {
+	this.projectName = section.String("project", "")
+	if this.projectName == "" {
+		panic("managed index must have 'project'")
+	}
+	this.indexPrefix = section.String("index_prefix", INDEX_PREFIX)
+	this.indexPattern = section.String("index_pattern", YM)
+	this.alias = section.String("alias", "")
+	this.keep = time.Duration(section.Int("retention_days", 0)) * time.Hour * 24
+	this.action = section.String("retention_action", ES_RETENTION_DELETE)
+	switch this.action {
+	case ES_RETENTION_DELETE, ES_RETENTION_CLOSE:
+	default:
+		panic("invalid retention_action: " + this.action)
+	}
+}
+
+// Installs index templates and maintains aliases and retention of the
+// dated indices through ES REST api
+type esIndexManager struct {
+	baseUrl   string
+	client    *http.Client
+	templates []*esIndexTemplate
+	indices   []*esManagedIndex
+}
+
+func (this *esIndexManager) load(config *conf.Conf) {
+	this.templates = make([]*esIndexTemplate, 0)
+	for i := 0; i < len(config.List("index_templates", nil)); i++ {
+		section, err := config.Section(fmt.Sprintf("index_templates[%d]", i))
+		if err != nil {
+			panic(err)
+		}
+
+		tpl := new(esIndexTemplate)
+		tpl.load(section)
+		this.templates = append(this.templates, tpl)
+	}
+
+	this.indices = make([]*esManagedIndex, 0)
+	for i := 0; i < len(config.List("managed_indices", nil)); i++ {
+		section, err := config.Section(fmt.Sprintf("managed_indices[%d]", i))
+		if err != nil {
+			panic(err)
+		}
+
+		idx := new(esManagedIndex)
+		idx.load(section)
+		this.indices = append(this.indices, idx)
+	}
+}
+
+func (this *esIndexManager) bindProjects(h engine.PluginHelper) {
+	for _, idx := range this.indices {
+		if !h.EngineConfig().HasProject(idx.projectName) {
+			panic("EsOutput indices: unknown project " + idx.projectName)
+		}
+		idx.project = h.Project(idx.projectName)
+	}
+}
+
+func (this *esIndexManager) enabled() bool {
+	return len(this.templates) > 0 || len(this.indices) > 0
+}
+
+// Install the missing templates, and warn if ES has a different one
+func (this *esIndexManager) installTemplates() error {
+	globals := engine.Globals()
+	for _, tpl := range this.templates {
+		body, err := ioutil.ReadFile(tpl.file)
+		if err != nil {
+			return err
+		}
+
+		var local map[string]interface{}
+		if err = json.Unmarshal(body, &local); err != nil {
+			return fmt.Errorf("%s: %v", tpl.file, err)
+		}
+
+		status, data, err := this.do("GET", "/_template/"+tpl.name, nil)
+		if err != nil {
+			return err
+		}
+
+		// old ES returns 200 with empty object for missing template
+		var remote map[string]map[string]interface{}
+		if status == http.StatusOK {
+			if err = json.Unmarshal(data, &remote); err != nil {
+				return err
+			}
+		}
+
+		installed, present := remote[tpl.name]
+		if present && !tpl.overwrite {
+			if installed["template"] != local["template"] {
+				globals.Printf("ES template[%s] pattern %v differs from %s: %v",
+					tpl.name, installed["template"], tpl.file, local["template"])
+			}
+			continue
+		}
+
+		if status, data, err = this.do("PUT", "/_template/"+tpl.name,
+			bytes.NewReader(body)); err != nil {
+			return err
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("put template[%s]: %d %s", tpl.name, status, data)
+		}
+
+		globals.Printf("ES template[%s] installed from %s", tpl.name, tpl.file)
+	}
+
+	return nil
+}
+
+// Move each alias onto the index of current period once that index exists
+func (this *esIndexManager) updateAliases(now time.Time) error {
+	var (
+		globals = engine.Globals()
+		indices map[string]map[string]map[string]interface{}
+	)
+	if err := this.getJson("/_aliases", &indices); err != nil {
+		return err
+	}
+
+	for _, idx := range this.indices {
+		if idx.alias == "" {
+			continue
+		}
+
+		current := indexName(idx.indexPrefix, idx.project, idx.indexPattern,
+			now.In(idx.project.Location()))
+		if _, present := indices[current]; !present {
+			// no doc of current period yet
+			continue
+		}
+
+		actions := make([]map[string]interface{}, 0)
+		for name, meta := range indices {
+			if _, present := meta["aliases"][idx.alias]; present && name != current {
+				actions = append(actions, map[string]interface{}{
+					"remove": map[string]string{"index": name, "alias": idx.alias}})
+			}
+		}
+		if _, present := indices[current]["aliases"][idx.alias]; !present {
+			actions = append(actions, map[string]interface{}{
+				"add": map[string]string{"index": current, "alias": idx.alias}})
+		}
+		if len(actions) == 0 {
+			continue
+		}
+
+		// remove and add in one request, so the alias is never dangling
+		body, _ := json.Marshal(map[string]interface{}{"actions": actions})
+		status, data, err := this.do("POST", "/_aliases", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("alias[%s]: %d %s", idx.alias, status, data)
+		}
+
+		globals.Printf("ES alias[%s] -> %s", idx.alias, current)
+	}
+
+	return nil
+}
+
+// Delete or close the indices whose whole period is older than retention.
+// Returns the affected index names.
+func (this *esIndexManager) applyRetention(now time.Time) (affected []string,
+	err error) {
+	var indices map[string]interface{}
+	if err = this.getJson("/_aliases", &indices); err != nil {
+		return
+	}
+
+	names := make([]string, 0, len(indices))
+	for name, _ := range indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, idx := range this.indices {
+		if idx.keep <= 0 {
+			continue
+		}
+
+		for _, name := range names {
+			_, end, ok := indexPeriod(idx.indexPrefix, idx.project,
+				idx.indexPattern, name)
+			if !ok || now.Sub(end) < idx.keep {
+				continue
+			}
+
+			var status int
+			var data []byte
+			switch idx.action {
+			case ES_RETENTION_DELETE:
+				status, data, err = this.do("DELETE", "/"+name, nil)
+			case ES_RETENTION_CLOSE:
+				status, data, err = this.do("POST", "/"+name+"/_close", nil)
+			}
+			if err != nil {
+				return
+			}
+			if status != http.StatusOK {
+				err = fmt.Errorf("%s %s: %d %s", idx.action, name, status, data)
+				return
+			}
+
+			engine.Globals().Printf("ES index %s %sd by retention of %s",
+				name, idx.action, idx.keep)
+			affected = append(affected, name)
+		}
+	}
+
+	return
+}
+
+// Run all the maintenance tasks, the failure of one doesn't stop others
+func (this *esIndexManager) maintain(now time.Time) {
+	globals := engine.Globals()
+	if err := this.updateAliases(now); err != nil {
+		globals.Printf("ES alias: %v", err)
+	}
+	if _, err := this.applyRetention(now); err != nil {
+		globals.Printf("ES retention: %v", err)
+	}
+}
+
+func (this *esIndexManager) getJson(path string, v interface{}) error {
+	status, data, err := this.do("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("GET %s: %d %s", path, status, data)
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func (this *esIndexManager) do(method, path string,
+	body io.Reader) (status int, data []byte, err error) {
+	req, err := http.NewRequest(method, this.baseUrl+path, body)
+	if err != nil {
+		return
+	}
+
+	res, err := this.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	data, err = ioutil.ReadAll(res.Body)
+	return res.StatusCode, data, err
+}
@@ -0,0 +1,191 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/funkygao/assert"
+	"github.com/funkygao/dpipe/engine"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In memory ES that knows templates, indices and aliases
+type fakeEs struct {
+	sync.Mutex
+	templates map[string]string
+	indices   map[string]map[string]bool // index -> aliases
+	closed    map[string]bool
+}
+
+func newFakeEs(indices ...string) *fakeEs {
+	this := &fakeEs{templates: make(map[string]string),
+		indices: make(map[string]map[string]bool),
+		closed:  make(map[string]bool)}
+	for _, idx := range indices {
+		this.indices[idx] = make(map[string]bool)
+	}
+	return this
+}
+
+func (this *fakeEs) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	this.Lock()
+	defer this.Unlock()
+
+	body, _ := ioutil.ReadAll(req.Body)
+	path := req.URL.Path
+	var name string
+	switch {
+	case req.Method == "GET" && path == "/_aliases":
+		out := make(map[string]interface{})
+		for idx, aliases := range this.indices {
+			out[idx] = map[string]interface{}{"aliases": aliases}
+		}
+		json.NewEncoder(w).Encode(out)
+
+	case req.Method == "POST" && path == "/_aliases":
+		var actions struct {
+			Actions []map[string]map[string]string `json:"actions"`
+		}
+		json.Unmarshal(body, &actions)
+		for _, action := range actions.Actions {
+			for op, arg := range action {
+				if op == "add" {
+					this.indices[arg["index"]][arg["alias"]] = true
+				} else {
+					delete(this.indices[arg["index"]], arg["alias"])
+				}
+			}
+		}
+		fmt.Fprint(w, `{"acknowledged":true}`)
+
+	case scan(path, "/_template/%s", &name):
+		if req.Method == "PUT" {
+			this.templates[name] = string(body)
+			fmt.Fprint(w, `{"acknowledged":true}`)
+			return
+		}
+
+		tpl, present := this.templates[name]
+		if !present {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{}`)
+			return
+		}
+		fmt.Fprintf(w, `{"%s":%s}`, name, tpl)
+
+	case req.Method == "POST" && scan(path, "/%s", &name):
+		// /{index}/_close
+		name = name[:len(name)-len("/_close")]
+		this.closed[name] = true
+		fmt.Fprint(w, `{"acknowledged":true}`)
+
+	case req.Method == "DELETE" && scan(path, "/%s", &name):
+		delete(this.indices, name)
+		fmt.Fprint(w, `{"acknowledged":true}`)
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func scan(path, format string, name *string) bool {
+	n, _ := fmt.Sscanf(path, format, name)
+	return n == 1
+}
+
+func TestEsIndexManagerTemplates(t *testing.T) {
+	es := newFakeEs()
+	server := httptest.NewServer(es)
+	defer server.Close()
+
+	f, _ := ioutil.TempFile("", "template")
+	defer os.Remove(f.Name())
+	f.WriteString(`{"template": "fun*", "settings": {}}`)
+	f.Close()
+
+	manager := &esIndexManager{baseUrl: server.URL,
+		client:    &http.Client{Timeout: time.Second},
+		templates: []*esIndexTemplate{&esIndexTemplate{name: "fun", file: f.Name()}}}
+	assert.Equal(t, nil, manager.installTemplates())
+	assert.Equal(t, `{"template": "fun*", "settings": {}}`, es.templates["fun"])
+
+	// existing template is kept
+	es.templates["fun"] = `{"template": "fun*"}`
+	assert.Equal(t, nil, manager.installTemplates())
+	assert.Equal(t, `{"template": "fun*"}`, es.templates["fun"])
+
+	manager.templates[0].overwrite = true
+	assert.Equal(t, nil, manager.installTemplates())
+	assert.Equal(t, `{"template": "fun*", "settings": {}}`, es.templates["fun"])
+}
+
+func TestEsIndexManagerAliases(t *testing.T) {
+	es := newFakeEs("fun_rs_2013_11", "fun_rs_2013_12", "fun_ffs_2013_12")
+	es.indices["fun_rs_2013_11"]["rs_latest"] = true
+	server := httptest.NewServer(es)
+	defer server.Close()
+
+	manager := &esIndexManager{baseUrl: server.URL,
+		client: &http.Client{Timeout: time.Second},
+		indices: []*esManagedIndex{&esManagedIndex{projectName: "rs",
+			indexPrefix: INDEX_PREFIX, indexPattern: "@ym", alias: "rs_latest",
+			keep: 60 * 24 * time.Hour, action: ES_RETENTION_DELETE,
+			project: &engine.ConfProject{Name: "rs", IndexPrefix: "rs"}}}}
+	now := time.Date(2013, time.December, 10, 0, 0, 0, 0, time.Local)
+	assert.Equal(t, nil, manager.updateAliases(now))
+	assert.Equal(t, map[string]bool{}, es.indices["fun_rs_2013_11"])
+	assert.Equal(t, map[string]bool{"rs_latest": true}, es.indices["fun_rs_2013_12"])
+
+	// current index not created yet, alias stays
+	now = now.AddDate(0, 1, 0)
+	assert.Equal(t, nil, manager.updateAliases(now))
+	assert.Equal(t, map[string]bool{"rs_latest": true}, es.indices["fun_rs_2013_12"])
+}
+
+func TestEsIndexManagerRetention(t *testing.T) {
+	es := newFakeEs("fun_rs_2013_10", "fun_rs_2013_11", "fun_rs_2013_12",
+		"fun_ffs_2013_10", "fun_rs_foo")
+	server := httptest.NewServer(es)
+	defer server.Close()
+
+	manager := &esIndexManager{baseUrl: server.URL,
+		client: &http.Client{Timeout: time.Second},
+		indices: []*esManagedIndex{&esManagedIndex{projectName: "rs",
+			indexPrefix: INDEX_PREFIX, indexPattern: "@ym", alias: "rs_latest",
+			keep: 60 * 24 * time.Hour, action: ES_RETENTION_DELETE,
+			project: &engine.ConfProject{Name: "rs", IndexPrefix: "rs"}}}}
+	now := time.Date(2014, time.January, 20, 0, 0, 0, 0, time.Local)
+	affected, err := manager.applyRetention(now)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"fun_rs_2013_10"}, affected)
+
+	indices := make([]string, 0)
+	for idx, _ := range es.indices {
+		indices = append(indices, idx)
+	}
+	sort.Strings(indices)
+	assert.Equal(t, []string{"fun_ffs_2013_10", "fun_rs_2013_11", "fun_rs_2013_12",
+		"fun_rs_foo"}, indices)
+
+	manager.indices[0].action = ES_RETENTION_CLOSE
+	now = now.AddDate(0, 1, 0)
+	affected, err = manager.applyRetention(now)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"fun_rs_2013_11"}, affected)
+	assert.Equal(t, true, es.closed["fun_rs_2013_11"])
+}
+
+func TestEsIndexManagerUnknownProject(t *testing.T) {
+	manager := &esIndexManager{indices: []*esManagedIndex{
+		&esManagedIndex{projectName: "rs"}}}
+	defer func() {
+		assert.Equal(t, "EsOutput indices: unknown project rs", recover())
+	}()
+	manager.bindProjects(engine.NewEngineConfig(nil))
+}
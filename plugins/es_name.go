@@ -0,0 +1,118 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"github.com/funkygao/als"
+	"github.com/funkygao/dpipe/engine"
+	"strings"
+	"time"
+)
+
+// Chars ES rejects in index and type names
+var esNameReplacer = strings.NewReplacer(" ", "_", "/", "_", "\\", "_",
+	"*", "_", "?", "_", `"`, "_", "<", "_", ">", "_", "|", "_", ",", "_",
+	"#", "_")
+
+// ES index or type name.
+// A pattern with '{' is a template, e,g. {project}_{area}_{yyyy}_{MM},
+// otherwise it's the legacy @ym/@ymw/@ymd pattern handled by indexName.
+//
+// Placeholders:
+// {project}   index_prefix of the project
+// {ident}     ident of the pack
+// {camelName} camel case name of the log file
+// {yyyy} {MM} {ww} {dd} {HH}  event time, {yyyy} is ISO year if {ww} used
+// others      message field, e,g. {area} {_log_info.uid}
+// Chars ES rejects in message field values are replaced with '_'.
+type esName struct {
+	prefix  string
+	pattern string
+	tpl     *fieldTemplate // nil for legacy pattern
+	isIndex bool           // ES index names must be lower case
+	isoYear bool
+}
+
+func newEsIndexName(prefix, pattern string) *esName {
+	this := &esName{prefix: prefix, pattern: pattern, isIndex: true}
+	if strings.Contains(pattern, "{") {
+		this.tpl = newFieldTemplate(pattern)
+		for _, field := range this.tpl.fields() {
+			if field == "ww" {
+				this.isoYear = true
+			}
+		}
+	}
+
+	return this
+}
+
+// Event time placeholders of a template
+func timeField(field string, date time.Time, isoYear bool) (string, bool) {
+	switch field {
+	case "yyyy":
+		if isoYear {
+			year, _ := date.ISOWeek()
+			return fmt.Sprintf("%d", year), true
+		}
+		return fmt.Sprintf("%d", date.Year()), true
+	case "MM":
+		return fmt.Sprintf("%02d", int(date.Month())), true
+	case "ww":
+		_, week := date.ISOWeek()
+		return fmt.Sprintf("%02d", week), true
+	case "dd":
+		return fmt.Sprintf("%02d", date.Day()), true
+	case "HH":
+		return fmt.Sprintf("%02d", date.Hour()), true
+	}
+
+	return "", false
+}
+
+func newEsTypeName(pattern string) *esName {
+	return &esName{pattern: pattern, tpl: newFieldTemplate(pattern)}
+}
+
+func (this *esName) render(project *engine.ConfProject, ident, camelName string,
+	date time.Time, msg *als.AlsMessage) (name string, err error) {
+	if this.tpl == nil {
+		return indexName(this.prefix, project, this.pattern, date), nil
+	}
+
+	name, err = this.tpl.render(func(field string) (string, error) {
+		switch field {
+		case "project":
+			return project.IndexPrefix, nil
+		case "ident":
+			return ident, nil
+		case "camelName":
+			return camelName, nil
+		}
+		if val, ok := timeField(field, date, this.isoYear); ok {
+			return val, nil
+		}
+
+		if msg == nil {
+			return "", errors.New("no message for field: " + field)
+		}
+		if field == "area" {
+			return esNameReplacer.Replace(msg.Area), nil
+		}
+		val, err := messageFieldString(msg, field)
+		return esNameReplacer.Replace(val), err
+	})
+	if err != nil {
+		return
+	}
+
+	if this.isIndex {
+		name = strings.ToLower(this.prefix + name)
+	}
+	// names must not start with _ - +
+	if name = strings.TrimLeft(name, "_-+"); name == "" || name == "." ||
+		name == ".." {
+		return "", errors.New("invalid name rendered from " + this.pattern)
+	}
+	return
+}
@@ -2,37 +2,62 @@
 package plugins
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
 	"github.com/funkygao/dpipe/engine"
 	"github.com/funkygao/golib/gofmt"
 	"github.com/funkygao/golib/observer"
 	"github.com/funkygao/golib/sortedmap"
 	"github.com/funkygao/golib/uuid"
 	conf "github.com/funkygao/jsconf"
-	"github.com/mattbaird/elastigo/api"
-	"github.com/mattbaird/elastigo/core"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	ES_ID_RANDOM   = "random"
+	ES_ID_HASH     = "hash"
+	ES_ID_TEMPLATE = "template"
+)
+
 type EsOutput struct {
 	flushInterval  time.Duration
 	reportInterval time.Duration
+	replayInterval time.Duration
 	dryRun         bool
 	showProgress   bool
 
 	counters      *sortedmap.SortedMap
+	domain        string
+	port          string
 	bulkMaxConn   int `json:"bulk_max_conn"`
 	bulkMaxDocs   int `json:"bulk_max_docs"`
 	bulkMaxBuffer int `json:"bulk_max_buffer"` // in Byte
-	indexer       *core.BulkIndexer
-	stopChan      chan bool
+	maxRetries    int
+	retryBackoff  time.Duration
+	maxBackoff    time.Duration
+	spoolDir      string
+	replayMax     int
+	timeout       time.Duration
+	indexer       *esBulkIndexer
 	totalN        int
+
+	idStrategy string // random, hash, template
+	idTemplate *fieldTemplate
+
+	indexManager      *esIndexManager
+	lifecycleInterval time.Duration
+	templatesReady    bool
 }
 
 func (this *EsOutput) Init(config *conf.Conf) {
-	this.stopChan = make(chan bool)
-	api.Domain = config.String("domain", "localhost")
+	this.domain = config.String("domain", "localhost")
 	this.counters = sortedmap.NewSortedMap()
-	api.Port = config.String("port", "9200")
+	this.port = config.String("port", "9200")
 	this.reportInterval = time.Duration(config.Int("report_interval", 30)) * time.Second
 	this.showProgress = config.Bool("show_progress", true)
 	this.flushInterval = time.Duration(config.Int("flush_interval", 30)) * time.Second
@@ -40,43 +65,92 @@ func (this *EsOutput) Init(config *conf.Conf) {
 	this.bulkMaxDocs = config.Int("bulk_max_docs", 100)
 	this.bulkMaxBuffer = config.Int("bulk_max_buffer", 10<<20) // 10 MB
 	this.dryRun = config.Bool("dryrun", false)
+	this.timeout = time.Duration(config.Int("http_timeout", 30)) * time.Second
+	this.maxRetries = config.Int("max_retries", 5)
+	this.retryBackoff = time.Duration(config.Int("retry_backoff_ms", 500)) * time.Millisecond
+	this.maxBackoff = time.Duration(config.Int("max_backoff", 60)) * time.Second
+	this.spoolDir = config.String("spool_dir", "var/es_spool")
+	this.replayInterval = time.Duration(config.Int("spool_replay_interval", 60)) * time.Second
+	this.replayMax = config.Int("spool_replay_max", 50)
+	this.idStrategy = config.String("id_strategy", ES_ID_RANDOM)
+	switch this.idStrategy {
+	case ES_ID_RANDOM, ES_ID_HASH:
+	case ES_ID_TEMPLATE:
+		tpl := config.String("id_template", "")
+		if tpl == "" {
+			panic("empty 'id_template'")
+		}
+		this.idTemplate = newFieldTemplate(tpl)
+	default:
+		panic("invalid id_strategy: " + this.idStrategy)
+	}
+	this.indexManager = new(esIndexManager)
+	this.indexManager.load(config)
+	this.lifecycleInterval = time.Duration(config.Int("lifecycle_interval", 3600)) * time.Second
 }
 
 func (this *EsOutput) Run(r engine.OutputRunner, h engine.PluginHelper) error {
 	var (
-		pack         *engine.PipelinePack
-		reloadChan   = make(chan interface{})
-		ok           = true
-		globals      = engine.Globals()
-		inChan       = r.InChan()
-		reportTicker = time.NewTicker(this.reportInterval)
+		pack            *engine.PipelinePack
+		reloadChan      = make(chan interface{})
+		ok              = true
+		globals         = engine.Globals()
+		inChan          = r.InChan()
+		reportTicker    = time.NewTicker(this.reportInterval)
+		flushTicker     = time.NewTicker(this.flushInterval)
+		lifecycleTicker = time.NewTicker(this.lifecycleInterval)
 	)
 
-	this.indexer = core.NewBulkIndexer(this.bulkMaxConn)
-	this.indexer.BulkMaxDocs = this.bulkMaxDocs
-	this.indexer.BulkMaxBuffer = this.bulkMaxBuffer
+	this.indexer = &esBulkIndexer{
+		baseUrl:      fmt.Sprintf("http://%s:%s", this.domain, this.port),
+		maxConn:      this.bulkMaxConn,
+		maxDocs:      this.bulkMaxDocs,
+		maxBuffer:    this.bulkMaxBuffer,
+		maxRetries:   this.maxRetries,
+		retryBackoff: this.retryBackoff,
+		maxBackoff:   this.maxBackoff,
+		spoolDir:     this.spoolDir,
+		client:       &http.Client{Timeout: this.timeout},
+
+		replayInterval: this.replayInterval,
+		replayMax:      this.replayMax,
+	}
 
 	// start the bulk indexer
-	this.indexer.Run(this.stopChan)
+	this.indexer.start()
+
+	this.indexManager.baseUrl = this.indexer.baseUrl
+	this.indexManager.client = this.indexer.client
+	this.indexManager.bindProjects(h)
+	if !this.dryRun {
+		this.manageIndices()
+	}
 
-	defer reportTicker.Stop()
+	defer func() {
+		reportTicker.Stop()
+		flushTicker.Stop()
+		lifecycleTicker.Stop()
+	}()
 
 	observer.Subscribe(engine.RELOAD, reloadChan)
 
 LOOP:
 	for ok {
 		select {
-		case <-this.stopChan:
-			ok = false
-
 		case <-reportTicker.C:
 			this.showPeriodicalStats()
+			this.showIndexerStats()
 
 		case <-reloadChan:
 			// TODO
 
-		case <-time.After(this.flushInterval):
-			this.indexer.Flush()
+		case <-flushTicker.C:
+			this.indexer.flush()
+
+		case <-lifecycleTicker.C:
+			if !this.dryRun {
+				this.manageIndices()
+			}
 
 		case pack, ok = <-inChan:
 			if !ok {
@@ -94,21 +168,36 @@ LOOP:
 
 	engine.Globals().Printf("[%s]Total output to ES: %d", r.Name(), this.totalN)
 
-	// before shutdown, flush again
+	// before shutdown, wait for all the inflight bulks done or spooled
 	if globals.Verbose {
 		engine.Globals().Println("Waiting for ES flush...")
 	}
-	this.indexer.Flush()
+	this.indexer.stop()
 	if globals.Verbose {
 		engine.Globals().Println("ES flushed")
 	}
-
-	// let indexer stop
-	this.stopChan <- true
+	this.showIndexerStats()
 
 	return nil
 }
 
+// Templates are retried on next tick if ES is not ready at startup
+func (this *EsOutput) manageIndices() {
+	if !this.indexManager.enabled() {
+		return
+	}
+
+	if !this.templatesReady {
+		if err := this.indexManager.installTemplates(); err != nil {
+			engine.Globals().Printf("ES template: %v", err)
+		} else {
+			this.templatesReady = true
+		}
+	}
+
+	this.indexManager.maintain(time.Now())
+}
+
 func (this *EsOutput) showPeriodicalStats() {
 	if !this.showProgress {
 		return
@@ -133,6 +222,16 @@ func (this *EsOutput) showPeriodicalStats() {
 	globals.Printf("%50s %12s", "Sum", gofmt.Comma(int64(total)))
 }
 
+func (this *EsOutput) showIndexerStats() {
+	engine.Globals().Printf("ES indexed: %s, retried: %s, rejected: %s, spooled: %s, replayed: %s, spool files: %d",
+		gofmt.Comma(atomic.LoadInt64(&this.indexer.indexedN)),
+		gofmt.Comma(atomic.LoadInt64(&this.indexer.retriedN)),
+		gofmt.Comma(atomic.LoadInt64(&this.indexer.rejectedN)),
+		gofmt.Comma(atomic.LoadInt64(&this.indexer.spooledN)),
+		gofmt.Comma(atomic.LoadInt64(&this.indexer.replayedN)),
+		this.indexer.spooledFiles())
+}
+
 func (this *EsOutput) feedEs(project *engine.ConfProject, pack *engine.PipelinePack) {
 	if pack.EsType == "" || pack.EsIndex == "" {
 		if project.ShowError {
@@ -151,14 +250,66 @@ func (this *EsOutput) feedEs(project *engine.ConfProject, pack *engine.PipelineP
 		return
 	}
 
-	date := time.Unix(int64(pack.Message.Timestamp), 0)
+	date := time.Unix(int64(pack.Message.Timestamp), 0).In(project.Location())
 	data, err := pack.Message.MarshalPayload()
 	if err != nil {
 		project.Println(err, *pack)
 		return
 	}
-	id, _ := uuid.UUID()
-	this.indexer.Index(pack.EsIndex, pack.EsType, id, "", &date, data) // ttl empty
+	id := this.docId(project, pack)
+	if err = this.indexer.index(pack.EsIndex, pack.EsType, id, date,
+		[]byte(data)); err != nil {
+		project.Println(err, *pack)
+	}
+}
+
+// Deterministic doc id makes replays overwrite instead of duplicating
+func (this *EsOutput) docId(project *engine.ConfProject,
+	pack *engine.PipelinePack) (id string) {
+	switch this.idStrategy {
+	case ES_ID_TEMPLATE:
+		var err error
+		id, err = this.idTemplate.render(func(field string) (string, error) {
+			switch field {
+			case "project":
+				return pack.Project, nil
+			case "ident":
+				return pack.Ident, nil
+			case "area":
+				return pack.Message.Area, nil
+			case "ts":
+				return strconv.FormatUint(pack.Message.Timestamp, 10), nil
+			case "camelName":
+				return pack.Logfile.CamelCaseName(), nil
+			}
+
+			return messageFieldString(pack.Message, field)
+		})
+		if err == nil {
+			return
+		}
+
+		// never render an incomplete id that would overwrite other docs
+		if project.ShowError {
+			project.Printf("id template %s: %v", this.idTemplate.raw, err)
+		}
+		fallthrough
+
+	case ES_ID_HASH:
+		h := sha1.New()
+		io.WriteString(h, pack.Logfile.Path())
+		io.WriteString(h, "\x00")
+		io.WriteString(h, strconv.FormatUint(pack.Message.Timestamp, 10))
+		io.WriteString(h, "\x00")
+		io.WriteString(h, pack.Message.Area)
+		io.WriteString(h, ",")
+		io.WriteString(h, pack.Message.Payload)
+		return hex.EncodeToString(h.Sum(nil))
+
+	default:
+		id, _ = uuid.UUID()
+		return
+	}
 }
 
 func init() {
@@ -0,0 +1,376 @@
+package plugins
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/funkygao/dpipe/engine"
+	conf "github.com/funkygao/jsconf"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FILE_FORMAT_RAW     = "raw"     // area,ts,payload: readable by ArchiveInput
+	FILE_FORMAT_JSONL   = "jsonl"   // pack meta with payload, one per line
+	FILE_FORMAT_PAYLOAD = "payload" // MarshalPayload only
+
+	FILE_FSYNC_NEVER    = "never"
+	FILE_FSYNC_INTERVAL = "interval"
+	FILE_FSYNC_ALWAYS   = "always"
+)
+
+var pathPartReplacer = strings.NewReplacer("/", "_", "\\", "_", "..", "__")
+
+// A file being written, once rotated it's renamed with timestamp suffix
+type outputFile struct {
+	path    string
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	opened  time.Time
+	written time.Time
+}
+
+func openOutputFile(path string, now time.Time) (this *outputFile, err error) {
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+
+	// append to the file left by last run
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	this = &outputFile{path: path, f: f, w: bufio.NewWriter(f),
+		size: fi.Size(), opened: now, written: now}
+	return
+}
+
+func (this *outputFile) write(line []byte, now time.Time) (err error) {
+	if _, err = this.w.Write(line); err != nil {
+		return
+	}
+	if err = this.w.WriteByte('\n'); err != nil {
+		return
+	}
+
+	this.size += int64(len(line) + 1)
+	this.written = now
+	return
+}
+
+func (this *outputFile) sync(fsync bool) error {
+	if err := this.w.Flush(); err != nil {
+		return err
+	}
+
+	if fsync {
+		return this.f.Sync()
+	}
+	return nil
+}
+
+func (this *outputFile) close(fsync bool) error {
+	err := this.sync(fsync)
+	if e := this.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Persist packs to local files with rotation
+type FileOutput struct {
+	path           *fieldTemplate
+	format         string
+	maxSize        int64
+	rotateInterval time.Duration
+	idleTimeout    time.Duration
+	gzip           bool
+	fsync          string
+	fsyncInterval  time.Duration
+
+	files    map[string]*outputFile // key is path
+	gzipWg   *sync.WaitGroup
+	writtenN int64
+	rotatedN int
+}
+
+func (this *FileOutput) Init(config *conf.Conf) {
+	this.path = newFieldTemplate(config.String("path",
+		"var/file_output/{project}/{yyyy}{MM}{dd}/{base}"))
+	this.format = config.String("format", FILE_FORMAT_RAW)
+	switch this.format {
+	case FILE_FORMAT_RAW, FILE_FORMAT_JSONL, FILE_FORMAT_PAYLOAD:
+	default:
+		panic("invalid format: " + this.format)
+	}
+	this.maxSize = int64(config.Int("max_size", 100<<20))
+	this.rotateInterval = time.Duration(config.Int("rotate_interval", 3600)) * time.Second
+	this.idleTimeout = time.Duration(config.Int("idle_timeout", 600)) * time.Second
+	this.gzip = config.Bool("gzip", false)
+	this.fsync = config.String("fsync", FILE_FSYNC_INTERVAL)
+	switch this.fsync {
+	case FILE_FSYNC_NEVER, FILE_FSYNC_INTERVAL, FILE_FSYNC_ALWAYS:
+	default:
+		panic("invalid fsync: " + this.fsync)
+	}
+	this.fsyncInterval = time.Duration(config.Int("fsync_interval", 5)) * time.Second
+
+	this.files = make(map[string]*outputFile)
+	this.gzipWg = new(sync.WaitGroup)
+}
+
+func (this *FileOutput) Run(r engine.OutputRunner, h engine.PluginHelper) error {
+	var (
+		globals    = engine.Globals()
+		pack       *engine.PipelinePack
+		ok         = true
+		inChan     = r.InChan()
+		syncTicker = time.NewTicker(this.fsyncInterval)
+	)
+
+	defer syncTicker.Stop()
+
+LOOP:
+	for ok {
+		select {
+		case <-syncTicker.C:
+			this.syncFiles(time.Now())
+
+		case pack, ok = <-inChan:
+			if !ok {
+				break LOOP
+			}
+
+			if globals.Debug {
+				globals.Println(*pack)
+			}
+
+			this.handlePack(h.Project(pack.Project), pack)
+			pack.Recycle()
+		}
+	}
+
+	// not rotated, next run will append to them
+	for path, file := range this.files {
+		if err := file.close(this.fsync != FILE_FSYNC_NEVER); err != nil {
+			globals.Printf("[%s]%s: %v", r.Name(), path, err)
+		}
+	}
+	this.gzipWg.Wait()
+
+	globals.Printf("[%s]Total written: %d, rotated: %d", r.Name(),
+		this.writtenN, this.rotatedN)
+
+	return nil
+}
+
+func filePathField(pack *engine.PipelinePack, date time.Time,
+	field string) (string, error) {
+	switch field {
+	case "project":
+		return pack.Project, nil
+	case "ident":
+		return pack.Ident, nil
+	case "camelName":
+		return pack.Logfile.CamelCaseName(), nil
+	case "base":
+		return pack.Logfile.Base(), nil
+	case "area":
+		return pack.Message.Area, nil
+	}
+	if val, ok := timeField(field, date, false); ok {
+		return val, nil
+	}
+
+	return messageFieldString(pack.Message, field)
+}
+
+// Rendered values never escape the output dir, e,g. ../../etc/x
+func safePathPart(val string) string {
+	return pathPartReplacer.Replace(val)
+}
+
+func (this *FileOutput) handlePack(project *engine.ConfProject,
+	pack *engine.PipelinePack) {
+	date := time.Unix(int64(pack.Message.Timestamp), 0).In(project.Location())
+	path, err := this.path.render(func(field string) (string, error) {
+		val, err := filePathField(pack, date, field)
+		return safePathPart(val), err
+	})
+	if err != nil {
+		if project.ShowError {
+			project.Printf("path %s: %v", this.path.raw, err)
+		}
+		return
+	}
+
+	line, err := this.formatPack(pack)
+	if err != nil {
+		if project.ShowError {
+			project.Println(err, *pack)
+		}
+		return
+	}
+
+	if err = this.write(path, line, time.Now()); err != nil {
+		project.Printf("%s: %v", path, err)
+	}
+}
+
+func (this *FileOutput) formatPack(pack *engine.PipelinePack) ([]byte, error) {
+	payload, err := pack.Message.MarshalPayload()
+	if err != nil {
+		return nil, err
+	}
+
+	switch this.format {
+	case FILE_FORMAT_RAW:
+		return []byte(fmt.Sprintf("%s,%d,%s", pack.Message.Area,
+			pack.Message.Timestamp, payload)), nil
+
+	case FILE_FORMAT_JSONL:
+		return json.Marshal(map[string]interface{}{
+			"project": pack.Project,
+			"ident":   pack.Ident,
+			"logfile": pack.Logfile.Path(),
+			"area":    pack.Message.Area,
+			"ts":      pack.Message.Timestamp,
+			"payload": json.RawMessage(payload),
+		})
+	}
+
+	return payload, nil
+}
+
+func (this *FileOutput) write(path string, line []byte, now time.Time) (err error) {
+	file, present := this.files[path]
+	if !present {
+		if file, err = openOutputFile(path, now); err != nil {
+			return
+		}
+		this.files[path] = file
+	}
+
+	if err = file.write(line, now); err != nil {
+		return
+	}
+	this.writtenN += 1
+
+	if this.fsync == FILE_FSYNC_ALWAYS {
+		if err = file.sync(true); err != nil {
+			return
+		}
+	}
+
+	if this.maxSize > 0 && file.size >= this.maxSize {
+		return this.rotate(file, now)
+	}
+
+	return
+}
+
+// Flush the buffered lines, rotate the aged and idle files
+func (this *FileOutput) syncFiles(now time.Time) {
+	globals := engine.Globals()
+	for path, file := range this.files {
+		var err error
+		switch {
+		case this.rotateInterval > 0 && now.Sub(file.opened) >= this.rotateInterval,
+			this.idleTimeout > 0 && now.Sub(file.written) >= this.idleTimeout:
+			// a file path with date in it becomes idle when the date changes
+			err = this.rotate(file, now)
+
+		default:
+			err = file.sync(this.fsync != FILE_FSYNC_NEVER)
+		}
+
+		if err != nil {
+			globals.Printf("%s: %v", path, err)
+		}
+	}
+}
+
+func (this *FileOutput) rotate(file *outputFile, now time.Time) error {
+	delete(this.files, file.path)
+	if err := file.close(this.fsync != FILE_FSYNC_NEVER); err != nil {
+		return err
+	}
+
+	rotated := file.path + "." + now.Format("20060102150405")
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s.%s.%d", file.path, now.Format("20060102150405"), i)
+	}
+	if err := os.Rename(file.path, rotated); err != nil {
+		return err
+	}
+
+	this.rotatedN += 1
+	if this.gzip {
+		this.gzipWg.Add(1)
+		go func() {
+			defer this.gzipWg.Done()
+
+			if err := gzipFile(rotated); err != nil {
+				engine.Globals().Printf("gzip %s: %v", rotated, err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Compress to fn.gz and remove fn
+func gzipFile(fn string) error {
+	src, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// write then rename, so that ArchiveInput never sees a half written file
+	tmp := fn + ".gz.tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if e := zw.Close(); err == nil {
+		err = e
+	}
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Remove(fn)
+}
+
+func init() {
+	engine.RegisterPlugin("FileOutput", func() engine.Plugin {
+		return new(FileOutput)
+	})
+}
@@ -0,0 +1,79 @@
+package plugins
+
+import (
+	"github.com/funkygao/assert"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileOutputRotateBySize(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "file_output")
+	defer os.RemoveAll(dir)
+
+	output := &FileOutput{format: FILE_FORMAT_RAW, maxSize: 30,
+		rotateInterval: time.Hour, idleTimeout: time.Minute, gzip: true,
+		fsync: FILE_FSYNC_NEVER, files: make(map[string]*outputFile),
+		gzipWg: new(sync.WaitGroup)}
+	path := filepath.Join(dir, "rs", "pay.log")
+	now := time.Date(2014, time.January, 2, 3, 4, 5, 0, time.Local)
+	lines := []string{`us,1388600000,{"uid":1}`, `us,1388600001,{"uid":2}`}
+	for _, line := range lines {
+		assert.Equal(t, nil, output.write(path, []byte(line), now))
+	}
+	output.gzipWg.Wait()
+	assert.Equal(t, 1, output.rotatedN)
+	assert.Equal(t, 0, len(output.files))
+
+	// round trip through ArchiveInput's reader
+	reader, err := openGzipLineReader(path + ".20140102030405.gz")
+	assert.Equal(t, nil, err)
+	defer reader.Close()
+	for _, line := range lines {
+		l, err := reader.ReadLine()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, line, string(l))
+	}
+	_, err = reader.ReadLine()
+	assert.Equal(t, io.EOF, err)
+
+	_, err = os.Stat(path + ".20140102030405")
+	assert.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestFileOutputRotateIdle(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "file_output")
+	defer os.RemoveAll(dir)
+
+	output := &FileOutput{format: FILE_FORMAT_RAW, maxSize: 30,
+		rotateInterval: time.Hour, idleTimeout: time.Minute,
+		fsync: FILE_FSYNC_NEVER, files: make(map[string]*outputFile),
+		gzipWg: new(sync.WaitGroup)}
+	path := filepath.Join(dir, "a.log")
+	now := time.Date(2014, time.January, 2, 3, 4, 5, 0, time.Local)
+	assert.Equal(t, nil, output.write(path, []byte("x"), now))
+
+	// flushed but kept open
+	output.syncFiles(now.Add(time.Second))
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "x\n", string(data))
+	assert.Equal(t, 1, len(output.files))
+
+	// a rotated file never gets overwritten
+	ioutil.WriteFile(path+".20140102030605", nil, 0644)
+	output.syncFiles(now.Add(2 * time.Minute))
+	assert.Equal(t, 0, len(output.files))
+	data, _ = ioutil.ReadFile(path + ".20140102030605.1")
+	assert.Equal(t, "x\n", string(data))
+}
+
+func TestSafePathPart(t *testing.T) {
+	assert.Equal(t, "us", safePathPart("us"))
+	assert.Equal(t, "______etc_x", safePathPart("../../etc/x"))
+	assert.Equal(t, "a_b", safePathPart(`a\b`))
+	assert.Equal(t, "v1.2", safePathPart("v1.2"))
+}
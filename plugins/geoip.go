@@ -0,0 +1,72 @@
+package plugins
+
+import (
+	"github.com/abh/geoip"
+	"os"
+	"sync"
+	"time"
+)
+
+// A GeoIP database file that is reopened when cron.upgeodb replaces it.
+// Each db has its own handle, lookups never race with the swap.
+type geoDb struct {
+	sync.RWMutex
+
+	file    string
+	db      *geoip.GeoIP
+	modTime time.Time
+}
+
+func newGeoDb(file string) (this *geoDb, err error) {
+	this = &geoDb{file: file}
+	_, err = this.refresh()
+	return
+}
+
+// Reopen the db file if its mtime changed, the old db keeps serving on error
+func (this *geoDb) refresh() (reloaded bool, err error) {
+	fi, err := os.Stat(this.file)
+	if err != nil {
+		return
+	}
+
+	if !fi.ModTime().After(this.modTime) {
+		return
+	}
+
+	// open the new db before swapping so that lookups never see a half db
+	db, err := geoip.Open(this.file)
+	if err != nil {
+		return
+	}
+
+	this.Lock()
+	this.db = db
+	this.Unlock()
+
+	this.modTime = fi.ModTime()
+	reloaded = true
+	return
+}
+
+// Country code, e,g. US
+func (this *geoDb) country(ip string) string {
+	this.RLock()
+	defer this.RUnlock()
+	cc, _ := this.db.GetCountry(ip)
+	return cc
+}
+
+func (this *geoDb) record(ip string) *geoip.GeoIPRecord {
+	this.RLock()
+	defer this.RUnlock()
+	return this.db.GetRecord(ip)
+}
+
+// e,g. AS15169 Google Inc.
+func (this *geoDb) asn(ip string) string {
+	this.RLock()
+	defer this.RUnlock()
+	name, _ := this.db.GetName(ip)
+	return name
+}
@@ -0,0 +1,59 @@
+package plugins
+
+import (
+	"container/list"
+)
+
+// A fixed size LRU cache, not goroutine safe
+type lruCache struct {
+	maxEntries int
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLruCache(maxEntries int) *lruCache {
+	return &lruCache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (this *lruCache) get(key string) (value interface{}, ok bool) {
+	if elem, present := this.items[key]; present {
+		this.ll.MoveToFront(elem)
+		return elem.Value.(*lruEntry).value, true
+	}
+
+	return
+}
+
+func (this *lruCache) set(key string, value interface{}) {
+	if elem, present := this.items[key]; present {
+		this.ll.MoveToFront(elem)
+		elem.Value.(*lruEntry).value = value
+		return
+	}
+
+	this.items[key] = this.ll.PushFront(&lruEntry{key: key, value: value})
+	if this.maxEntries > 0 && this.ll.Len() > this.maxEntries {
+		// evict the oldest
+		oldest := this.ll.Back()
+		this.ll.Remove(oldest)
+		delete(this.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (this *lruCache) len() int {
+	return this.ll.Len()
+}
+
+func (this *lruCache) purge() {
+	this.ll.Init()
+	this.items = make(map[string]*list.Element)
+}
@@ -0,0 +1,267 @@
+package plugins
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/funkygao/dpipe/engine"
+	conf "github.com/funkygao/jsconf"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	MAIL_TRANSPORT_SMTP     = "smtp"
+	MAIL_TRANSPORT_SENDMAIL = "sendmail"
+
+	MAIL_DEFAULT_FROM = "dpipe <noreply@funplusgame.com>"
+)
+
+// Mail delivery through SMTP server or local sendmail command
+type mailer struct {
+	transport     string
+	host          string
+	port          int
+	user          string
+	password      string
+	startTls      bool
+	tlsSkipVerify bool
+	from          string
+	replyTo       string
+	retries       int
+	retryBackoff  time.Duration
+	timeout       time.Duration
+}
+
+func newMailer() *mailer {
+	return &mailer{
+		transport:    MAIL_TRANSPORT_SENDMAIL,
+		from:         MAIL_DEFAULT_FROM,
+		retries:      3,
+		retryBackoff: 5 * time.Second,
+		timeout:      30 * time.Second,
+	}
+}
+
+func (this *mailer) load(section *conf.Conf) {
+	this.transport = section.String("transport", MAIL_TRANSPORT_SMTP)
+	switch this.transport {
+	case MAIL_TRANSPORT_SMTP:
+		this.host = section.String("host", "")
+		if this.host == "" {
+			panic("smtp must have 'host'")
+		}
+	case MAIL_TRANSPORT_SENDMAIL:
+	default:
+		panic("invalid mail transport: " + this.transport)
+	}
+	this.port = section.Int("port", 25)
+	this.user = section.String("user", "")
+	this.password = section.String("password", "")
+	this.startTls = section.Bool("starttls", false)
+	this.tlsSkipVerify = section.Bool("tls_skip_verify", false)
+	this.from = section.String("from", MAIL_DEFAULT_FROM)
+	if _, err := mail.ParseAddress(this.from); err != nil {
+		panic(fmt.Sprintf("invalid from %s: %v", this.from, err))
+	}
+	this.replyTo = section.String("reply_to", "")
+	this.retries = section.Int("retries", 3)
+	this.retryBackoff = time.Duration(section.Int("retry_backoff", 5)) * time.Second
+	this.timeout = time.Duration(section.Int("timeout", 30)) * time.Second
+}
+
+// Send mail with text and optional html body, retry on temporary failures
+func (this *mailer) send(to []string, subject, text, html string) (err error) {
+	if len(to) == 0 || subject == "" || (text == "" && html == "") {
+		return errors.New("empty mail params")
+	}
+
+	msg, err := this.compose(to, subject, text, html)
+	if err != nil {
+		return
+	}
+
+	globals := engine.Globals()
+	backoff := this.retryBackoff
+	for attempt := 0; ; attempt++ {
+		switch this.transport {
+		case MAIL_TRANSPORT_SMTP:
+			err = this.sendSmtp(to, msg)
+		default:
+			err = this.sendmail(msg)
+		}
+		if err == nil {
+			globals.Printf("mail[%s] sent to %v", subject, to)
+			return
+		}
+
+		if tpErr, ok := err.(*textproto.Error); ok && tpErr.Code >= 500 {
+			// permanent failure, e,g. bad recipient
+			break
+		}
+		if attempt >= this.retries {
+			break
+		}
+
+		globals.Printf("mail[%s] attempt %d: %v", subject, attempt+1, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	globals.Printf("mail[%s] to %v failed: %v", subject, to, err)
+	return
+}
+
+func (this *mailer) compose(to []string, subject, text,
+	html string) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(k, v string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+	}
+
+	header("From", this.from)
+	header("To", strings.Join(to, ", "))
+	if this.replyTo != "" {
+		header("Reply-To", this.replyTo)
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Importance", "High")
+	header("X-Priority", "1 (Highest)")
+
+	if html == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	buf.WriteString("\r\n")
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		if part.body == "" {
+			continue
+		}
+
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = writeQuotedPrintable(w, part.body); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qw := quotedprintable.NewWriter(w)
+	if _, err := qw.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+func (this *mailer) sendSmtp(to []string, msg []byte) error {
+	addr := net.JoinHostPort(this.host, fmt.Sprintf("%d", this.port))
+	conn, err := net.DialTimeout("tcp", addr, this.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(this.timeout))
+
+	c, err := smtp.NewClient(conn, this.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if this.startTls {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New(addr + " doesn't support STARTTLS")
+		}
+
+		if err = c.StartTLS(&tls.Config{ServerName: this.host,
+			InsecureSkipVerify: this.tlsSkipVerify}); err != nil {
+			return err
+		}
+	}
+
+	if this.user != "" {
+		// PlainAuth refuses to send password without TLS except to localhost
+		if err = c.Auth(smtp.PlainAuth("", this.user, this.password,
+			this.host)); err != nil {
+			return err
+		}
+	}
+
+	from, _ := mail.ParseAddress(this.from)
+	if err = c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err = c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+func (this *mailer) sendmail(msg []byte) error {
+	cmd := exec.Command("sendmail", "-t")
+	cmd.Stdin = bytes.NewReader(msg)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sendmail: %v %s", err, output)
+	}
+
+	return nil
+}
+
+func splitRecipients(recipients string) []string {
+	to := make([]string, 0)
+	for _, rcpt := range strings.Split(recipients, ",") {
+		if rcpt = strings.TrimSpace(rcpt); rcpt != "" {
+			to = append(to, rcpt)
+		}
+	}
+
+	return to
+}
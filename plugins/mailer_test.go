@@ -0,0 +1,179 @@
+package plugins
+
+import (
+	"bufio"
+	"github.com/funkygao/assert"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Minimal SMTP server, MAIL fails with 451 for the first failN sessions
+type fakeSmtpServer struct {
+	sync.Mutex
+	ln       net.Listener
+	failN    int
+	sessions int
+	auth     string
+	rcpts    []string
+	data     string
+}
+
+func newFakeSmtpServer(t *testing.T, failN int) *fakeSmtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+
+	this := &fakeSmtpServer{ln: ln, failN: failN}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			this.serve(conn)
+		}
+	}()
+
+	return this
+}
+
+func (this *fakeSmtpServer) port() int {
+	return this.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (this *fakeSmtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	this.Lock()
+	defer this.Unlock()
+	this.sessions++
+
+	reader := bufio.NewReader(conn)
+	reply := func(s string) {
+		conn.Write([]byte(s + "\r\n"))
+	}
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(strings.SplitN(strings.TrimSpace(line), " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			this.auth = strings.TrimSpace(line)
+			reply("235 ok")
+		case "MAIL":
+			if this.sessions <= this.failN {
+				reply("451 try again later")
+				continue
+			}
+			reply("250 ok")
+		case "RCPT":
+			this.rcpts = append(this.rcpts, strings.TrimSpace(line))
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data []string
+			for {
+				l, err := reader.ReadString('\n')
+				if err != nil || l == ".\r\n" {
+					break
+				}
+				data = append(data, l)
+			}
+			this.data = strings.Join(data, "")
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestMailerSmtpRetry(t *testing.T) {
+	server := newFakeSmtpServer(t, 1)
+	defer server.ln.Close()
+
+	m := newMailer()
+	m.transport, m.host, m.port = MAIL_TRANSPORT_SMTP, "localhost", server.port()
+	m.from, m.replyTo = "alarm <alarm@example.com>", "ops@example.com"
+	m.user, m.password = "user", "secret"
+	m.retryBackoff, m.timeout = time.Millisecond, time.Second
+	err := m.send([]string{"a@example.com", "b@example.com"}, "ALS[rs] alarms",
+		"text body", "<b>html body</b>")
+	assert.Equal(t, nil, err)
+
+	server.Lock()
+	defer server.Unlock()
+	assert.Equal(t, 2, server.sessions)
+	assert.Equal(t, true, strings.HasPrefix(server.auth, "AUTH PLAIN"))
+	assert.Equal(t, []string{"RCPT TO:<a@example.com>", "RCPT TO:<b@example.com>"},
+		server.rcpts)
+	assert.Equal(t, true, strings.Contains(server.data, "From: alarm <alarm@example.com>\r\n"))
+	assert.Equal(t, true, strings.Contains(server.data, "Reply-To: ops@example.com\r\n"))
+	assert.Equal(t, true, strings.Contains(server.data, "multipart/alternative"))
+	assert.Equal(t, true, strings.Contains(server.data, "text body"))
+	assert.Equal(t, true, strings.Contains(server.data, "<b>html body</b>"))
+}
+
+func TestMailerSmtpTextOnly(t *testing.T) {
+	server := newFakeSmtpServer(t, 0)
+	defer server.ln.Close()
+
+	m := newMailer()
+	m.transport, m.host, m.port = MAIL_TRANSPORT_SMTP, "localhost", server.port()
+	m.retryBackoff, m.timeout = time.Millisecond, time.Second
+	err := m.send([]string{"a@example.com"}, "subject", "text only body", "")
+	assert.Equal(t, nil, err)
+
+	server.Lock()
+	defer server.Unlock()
+	assert.Equal(t, true, strings.Contains(server.data, "text/plain"))
+	assert.Equal(t, true, strings.Contains(server.data, "text only body"))
+}
+
+func TestMailerSmtpGiveUp(t *testing.T) {
+	server := newFakeSmtpServer(t, 10)
+	defer server.ln.Close()
+
+	m := newMailer()
+	m.transport, m.host, m.port = MAIL_TRANSPORT_SMTP, "localhost", server.port()
+	m.retryBackoff, m.timeout = time.Millisecond, time.Second
+	m.retries = 2
+	err := m.send([]string{"a@example.com"}, "subject", "body", "")
+	assert.NotEqual(t, nil, err)
+
+	server.Lock()
+	defer server.Unlock()
+	assert.Equal(t, 3, server.sessions)
+}
+
+func TestMailerStartTlsRequired(t *testing.T) {
+	server := newFakeSmtpServer(t, 0)
+	defer server.ln.Close()
+
+	m := newMailer()
+	m.transport, m.host, m.port = MAIL_TRANSPORT_SMTP, "localhost", server.port()
+	m.retryBackoff, m.timeout = time.Millisecond, time.Second
+	m.startTls = true
+	m.retries = 0
+	err := m.send([]string{"a@example.com"}, "subject", "body", "")
+	assert.Equal(t, true, strings.Contains(err.Error(), "STARTTLS"))
+}
+
+func TestSplitRecipients(t *testing.T) {
+	assert.Equal(t, []string{"a@x.com", "b@x.com"},
+		splitRecipients(" a@x.com,, b@x.com "))
+	assert.Equal(t, 0, len(splitRecipients("")))
+}
@@ -0,0 +1,13 @@
+package plugins
+
+import (
+	"github.com/funkygao/dpipe/engine"
+	"os"
+	"testing"
+)
+
+// Plugins log through engine.Globals()
+func TestMain(m *testing.M) {
+	engine.NewEngineConfig(nil)
+	os.Exit(m.Run())
+}
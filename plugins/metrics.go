@@ -0,0 +1,343 @@
+package plugins
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/funkygao/als"
+	"github.com/funkygao/dpipe/engine"
+	conf "github.com/funkygao/jsconf"
+	"math"
+	"math/rand"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	METRICS_GRAPHITE = "graphite"
+	METRICS_STATSD   = "statsd"
+
+	METRIC_COUNTER = "counter"
+	METRIC_GAUGE   = "gauge"
+	METRIC_TIMER   = "timer"
+
+	metricsMaxPacket = 1432 // fits in an ethernet frame
+)
+
+var metricNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9_\-]`)
+
+// A metric fed by the matched packs, named by a template of project,
+// ident, camelName, area and message fields
+type metricConf struct {
+	typ       string // counter, gauge or timer
+	ident     string // empty matches all
+	camelName string
+	field     string // numeric field of gauge and timer
+	name      *fieldTemplate
+}
+
+func (this *metricConf) load(section *conf.Conf) {
+	this.typ = section.String("type", METRIC_COUNTER)
+	this.ident = section.String("ident", "")
+	this.camelName = section.String("camel_name", "")
+	this.field = section.String("field", "")
+	defaultName := "{project}.{ident}.{camelName}.{area}.count"
+	switch this.typ {
+	case METRIC_COUNTER:
+	case METRIC_GAUGE, METRIC_TIMER:
+		if this.field == "" {
+			panic(this.typ + " metric must have 'field'")
+		}
+		defaultName = "{project}.{camelName}.{area}." + this.field
+	default:
+		panic("invalid metric type: " + this.typ)
+	}
+	this.name = newFieldTemplate(section.String("name", defaultName))
+}
+
+func (this *metricConf) match(pack *engine.PipelinePack) bool {
+	return (this.ident == "" || this.ident == pack.Ident) &&
+		(this.camelName == "" || this.camelName == pack.Logfile.CamelCaseName())
+}
+
+// Template values are sanitized, dots in the template make the hierarchy
+func (this *metricConf) render(project *engine.ConfProject,
+	pack *engine.PipelinePack) (string, error) {
+	return this.name.render(func(field string) (val string, err error) {
+		switch field {
+		case "project":
+			val = project.Name
+		case "ident":
+			val = pack.Ident
+		case "camelName":
+			val = pack.Logfile.CamelCaseName()
+		case "area":
+			val = pack.Message.Area
+		default:
+			val, err = messageFieldString(pack.Message, field)
+		}
+		return metricNameUnsafe.ReplaceAllString(val, "_"), err
+	})
+}
+
+// Value of a metric within the flush interval
+type metricValue struct {
+	typ    string
+	n      int64
+	sum    float64
+	min    float64
+	max    float64
+	last   float64
+	values []float64 // reservoir of timer
+}
+
+func (this *metricValue) add(x float64, samples int) {
+	this.n += 1
+	this.sum += x
+	this.last = x
+	if this.n == 1 || x < this.min {
+		this.min = x
+	}
+	if this.n == 1 || x > this.max {
+		this.max = x
+	}
+
+	if this.typ != METRIC_TIMER {
+		return
+	}
+	// reservoir sampling keeps memory bounded
+	if len(this.values) < samples {
+		this.values = append(this.values, x)
+	} else if j := rand.Int63n(this.n); j < int64(samples) {
+		this.values[j] = x
+	}
+}
+
+// Percentile of the reservoir, q in (0, 100]
+func (this *metricValue) percentile(q float64) float64 {
+	if len(this.values) == 0 {
+		return 0
+	}
+
+	sort.Float64s(this.values)
+	i := int(math.Ceil(q/100*float64(len(this.values)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return this.values[i]
+}
+
+// Aggregates the metrics of packs between flushes
+type metricsAggregator struct {
+	metrics     []*metricConf
+	samples     int // cap of each timer reservoir
+	maxNames    int // more names within an interval are dropped
+	percentiles []float64
+
+	values   map[string]*metricValue // key is metric name
+	droppedN int64
+}
+
+func (this *metricsAggregator) observe(project *engine.ConfProject,
+	pack *engine.PipelinePack) {
+	for _, m := range this.metrics {
+		if !m.match(pack) {
+			continue
+		}
+
+		x := 1.
+		if m.typ != METRIC_COUNTER {
+			val, err := pack.Message.FieldValue(m.field, als.KEY_TYPE_FLOAT)
+			if err != nil {
+				continue
+			}
+			var ok bool
+			if x, ok = windowFloat(val); !ok {
+				continue
+			}
+		}
+
+		name, err := m.render(project, pack)
+		if err != nil {
+			if project.ShowError {
+				project.Printf("metric %s: %v", m.name.raw, err)
+			}
+			continue
+		}
+
+		this.add(name, m.typ, x)
+	}
+}
+
+func (this *metricsAggregator) add(name, typ string, x float64) {
+	v, present := this.values[name]
+	if !present {
+		if len(this.values) >= this.maxNames {
+			this.droppedN += 1
+			return
+		}
+
+		v = &metricValue{typ: typ}
+		this.values[name] = v
+	}
+	v.add(x, this.samples)
+}
+
+// Take the values of the interval
+func (this *metricsAggregator) drain() map[string]*metricValue {
+	values := this.values
+	this.values = make(map[string]*metricValue)
+	return values
+}
+
+func sortedMetricNames(values map[string]*metricValue) []string {
+	names := make([]string, 0, len(values))
+	for name, _ := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func formatMetric(x float64) string {
+	return strconv.FormatFloat(x, 'f', -1, 64)
+}
+
+// Graphite plaintext: counter is the count of the interval, gauge the last
+// value, timer is expanded to count, sum, mean, min, max and percentiles
+func encodeGraphite(prefix string, values map[string]*metricValue,
+	percentiles []float64, ts time.Time) []string {
+	lines := make([]string, 0, len(values))
+	line := func(name string, x float64) {
+		lines = append(lines, fmt.Sprintf("%s%s %s %d", prefix, name,
+			formatMetric(x), ts.Unix()))
+	}
+
+	for _, name := range sortedMetricNames(values) {
+		v := values[name]
+		switch v.typ {
+		case METRIC_COUNTER:
+			line(name, float64(v.n))
+
+		case METRIC_GAUGE:
+			line(name, v.last)
+
+		case METRIC_TIMER:
+			line(name+".count", float64(v.n))
+			line(name+".sum", v.sum)
+			line(name+".mean", v.sum/float64(v.n))
+			line(name+".min", v.min)
+			line(name+".max", v.max)
+			for _, q := range percentiles {
+				line(name+".p"+formatMetric(q), v.percentile(q))
+			}
+		}
+	}
+
+	return lines
+}
+
+// StatsD line protocol: timer samples are sent for statsd to aggregate,
+// with the sample rate if the reservoir is saturated
+func encodeStatsd(prefix string, values map[string]*metricValue) []string {
+	lines := make([]string, 0, len(values))
+	for _, name := range sortedMetricNames(values) {
+		v := values[name]
+		switch v.typ {
+		case METRIC_COUNTER:
+			lines = append(lines, fmt.Sprintf("%s%s:%d|c", prefix, name, v.n))
+
+		case METRIC_GAUGE:
+			lines = append(lines, fmt.Sprintf("%s%s:%s|g", prefix, name,
+				formatMetric(v.last)))
+
+		case METRIC_TIMER:
+			rate := ""
+			if int64(len(v.values)) < v.n {
+				rate = "|@" + strconv.FormatFloat(
+					float64(len(v.values))/float64(v.n), 'f', 4, 64)
+			}
+			for _, x := range v.values {
+				lines = append(lines, fmt.Sprintf("%s%s:%s|ms%s", prefix, name,
+					formatMetric(x), rate))
+			}
+		}
+	}
+
+	return lines
+}
+
+// Sends metric lines over tcp or udp, dialing lazily and redialing once
+// on write failure
+type metricsSender struct {
+	network string
+	addr    string
+	timeout time.Duration
+
+	conn net.Conn
+}
+
+func (this *metricsSender) send(lines []string) (err error) {
+	if len(lines) == 0 {
+		return
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = this.write(lines); err == nil {
+			return
+		}
+		this.close()
+	}
+
+	return
+}
+
+func (this *metricsSender) write(lines []string) error {
+	if this.conn == nil {
+		conn, err := net.DialTimeout(this.network, this.addr, this.timeout)
+		if err != nil {
+			return err
+		}
+		this.conn = conn
+	}
+
+	var buf bytes.Buffer
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+
+		this.conn.SetWriteDeadline(time.Now().Add(this.timeout))
+		_, err := this.conn.Write(buf.Bytes())
+		buf.Reset()
+		return err
+	}
+
+	for _, line := range lines {
+		// udp datagram carries whole lines
+		if strings.HasPrefix(this.network, "udp") && buf.Len() > 0 &&
+			buf.Len()+len(line)+1 > metricsMaxPacket {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+
+	return flush()
+}
+
+func (this *metricsSender) close() {
+	if this.conn != nil {
+		this.conn.Close()
+		this.conn = nil
+	}
+}
+
+func validMetricsNetwork(network string) bool {
+	return strings.HasPrefix(network, "tcp") || strings.HasPrefix(network, "udp")
+}
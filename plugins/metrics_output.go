@@ -0,0 +1,135 @@
+package plugins
+
+import (
+	"fmt"
+	"github.com/funkygao/dpipe/engine"
+	conf "github.com/funkygao/jsconf"
+	"time"
+)
+
+// Aggregates packs into counters, gauges and timers and flushes them to
+// graphite or statsd each interval
+type MetricsOutput struct {
+	protocol      string
+	prefix        string
+	flushInterval time.Duration
+	aggregator    *metricsAggregator
+	sender        *metricsSender
+}
+
+func (this *MetricsOutput) Init(config *conf.Conf) {
+	this.protocol = config.String("protocol", METRICS_GRAPHITE)
+	if this.protocol != METRICS_GRAPHITE && this.protocol != METRICS_STATSD {
+		panic("invalid metrics protocol: " + this.protocol)
+	}
+	this.prefix = config.String("prefix", "dpipe.")
+	this.flushInterval = time.Duration(config.Int("flush_interval", 60)) * time.Second
+
+	defaultNetwork, defaultAddr := "tcp", "localhost:2003"
+	if this.protocol == METRICS_STATSD {
+		defaultNetwork, defaultAddr = "udp", "localhost:8125"
+	}
+	this.sender = &metricsSender{
+		network: config.String("network", defaultNetwork),
+		addr:    config.String("addr", defaultAddr),
+		timeout: time.Duration(config.Int("timeout", 5)) * time.Second,
+	}
+	if !validMetricsNetwork(this.sender.network) {
+		panic("invalid metrics network: " + this.sender.network)
+	}
+
+	this.aggregator = &metricsAggregator{
+		samples:  config.Int("samples", 1000),
+		maxNames: config.Int("max_names", 10000),
+		metrics:  make([]*metricConf, 0, 10),
+		values:   make(map[string]*metricValue),
+	}
+	for _, q := range config.List("percentiles", []interface{}{90, 99}) {
+		x, ok := windowFloat(q)
+		if !ok || x <= 0 || x > 100 {
+			panic(fmt.Sprintf("invalid percentile: %v", q))
+		}
+		this.aggregator.percentiles = append(this.aggregator.percentiles, x)
+	}
+	for i := 0; i < len(config.List("metrics", nil)); i++ {
+		section, err := config.Section(fmt.Sprintf("metrics[%d]", i))
+		if err != nil {
+			panic(err)
+		}
+
+		metric := new(metricConf)
+		metric.load(section)
+		this.aggregator.metrics = append(this.aggregator.metrics, metric)
+	}
+	if len(this.aggregator.metrics) == 0 {
+		panic("empty metrics")
+	}
+}
+
+func (this *MetricsOutput) Run(r engine.OutputRunner, h engine.PluginHelper) error {
+	var (
+		ok          = true
+		pack        *engine.PipelinePack
+		inChan      = r.InChan()
+		globals     = engine.Globals()
+		flushTicker = time.NewTicker(this.flushInterval)
+		sentN       int
+	)
+
+	defer func() {
+		flushTicker.Stop()
+		this.sender.close()
+	}()
+
+	flush := func() {
+		lines := this.encode(time.Now())
+		if err := this.sender.send(lines); err != nil {
+			// metrics of the interval are lost, next flush will redial
+			globals.Printf("[%s]%d metric lines lost: %v", r.Name(), len(lines), err)
+			return
+		}
+		sentN += len(lines)
+	}
+
+LOOP:
+	for ok {
+		select {
+		case <-flushTicker.C:
+			flush()
+
+		case pack, ok = <-inChan:
+			if !ok {
+				break LOOP
+			}
+
+			if globals.Debug {
+				globals.Println(*pack)
+			}
+
+			this.aggregator.observe(h.Project(pack.Project), pack)
+			pack.Recycle()
+		}
+	}
+
+	// flush the last partial interval
+	flush()
+	globals.Printf("[%s]sent: %d, dropped names: %d", r.Name(), sentN,
+		this.aggregator.droppedN)
+
+	return nil
+}
+
+func (this *MetricsOutput) encode(now time.Time) []string {
+	values := this.aggregator.drain()
+	if this.protocol == METRICS_STATSD {
+		return encodeStatsd(this.prefix, values)
+	}
+
+	return encodeGraphite(this.prefix, values, this.aggregator.percentiles, now)
+}
+
+func init() {
+	engine.RegisterPlugin("MetricsOutput", func() engine.Plugin {
+		return new(MetricsOutput)
+	})
+}
@@ -0,0 +1,155 @@
+package plugins
+
+import (
+	"bufio"
+	"github.com/funkygao/assert"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMetricsAggregator() *metricsAggregator {
+	return &metricsAggregator{samples: 100, maxNames: 3,
+		percentiles: []float64{50, 90},
+		values:      make(map[string]*metricValue)}
+}
+
+func TestMetricsAggregator(t *testing.T) {
+	agg := newTestMetricsAggregator()
+	agg.add("rs.login.count", METRIC_COUNTER, 1)
+	agg.add("rs.login.count", METRIC_COUNTER, 1)
+	agg.add("rs.payment.elapsed", METRIC_TIMER, 5)
+	for i := 1; i <= 10; i++ {
+		agg.add("rs.payment.elapsed", METRIC_TIMER, float64(i))
+	}
+	agg.add("rs.online", METRIC_GAUGE, 300)
+	agg.add("rs.online", METRIC_GAUGE, 280)
+	agg.add("rs.overflow", METRIC_COUNTER, 1) // over max names
+	assert.Equal(t, int64(1), agg.droppedN)
+
+	values := agg.drain()
+	assert.Equal(t, 0, len(agg.values))
+	assert.Equal(t, int64(2), values["rs.login.count"].n)
+	assert.Equal(t, float64(280), values["rs.online"].last)
+	timer := values["rs.payment.elapsed"]
+	assert.Equal(t, int64(11), timer.n)
+	assert.Equal(t, float64(60), timer.sum)
+	assert.Equal(t, float64(1), timer.min)
+	assert.Equal(t, float64(10), timer.max)
+	assert.Equal(t, float64(5), timer.percentile(50))
+	assert.Equal(t, float64(9), timer.percentile(90))
+}
+
+func TestMetricValueReservoir(t *testing.T) {
+	v := &metricValue{typ: METRIC_TIMER}
+	for i := 0; i < 1000; i++ {
+		v.add(float64(i), 10)
+	}
+	assert.Equal(t, 10, len(v.values))
+	assert.Equal(t, int64(1000), v.n)
+	assert.Equal(t, float64(999), v.max)
+}
+
+func TestEncodeGraphite(t *testing.T) {
+	agg := newTestMetricsAggregator()
+	agg.add("rs.login.count", METRIC_COUNTER, 1)
+	agg.add("rs.online", METRIC_GAUGE, 1.5)
+	agg.add("rs.elapsed", METRIC_TIMER, 2)
+	agg.add("rs.elapsed", METRIC_TIMER, 4)
+
+	lines := encodeGraphite("dpipe.", agg.drain(), agg.percentiles,
+		time.Unix(1391857296, 0))
+	assert.Equal(t, []string{
+		"dpipe.rs.elapsed.count 2 1391857296",
+		"dpipe.rs.elapsed.sum 6 1391857296",
+		"dpipe.rs.elapsed.mean 3 1391857296",
+		"dpipe.rs.elapsed.min 2 1391857296",
+		"dpipe.rs.elapsed.max 4 1391857296",
+		"dpipe.rs.elapsed.p50 2 1391857296",
+		"dpipe.rs.elapsed.p90 4 1391857296",
+		"dpipe.rs.login.count 1 1391857296",
+		"dpipe.rs.online 1.5 1391857296",
+	}, lines)
+}
+
+func TestEncodeStatsd(t *testing.T) {
+	agg := newTestMetricsAggregator()
+	agg.samples = 2
+	agg.add("rs.login.count", METRIC_COUNTER, 1)
+	agg.add("rs.online", METRIC_GAUGE, 280)
+	agg.add("rs.elapsed", METRIC_TIMER, 3)
+	agg.add("rs.elapsed", METRIC_TIMER, 3)
+	agg.add("rs.elapsed", METRIC_TIMER, 3)
+	agg.add("rs.elapsed", METRIC_TIMER, 3)
+
+	lines := encodeStatsd("", agg.drain())
+	assert.Equal(t, []string{
+		"rs.elapsed:3|ms|@0.5000",
+		"rs.elapsed:3|ms|@0.5000",
+		"rs.login.count:1|c",
+		"rs.online:280|g",
+	}, lines)
+}
+
+func TestMetricNameUnsafe(t *testing.T) {
+	assert.Equal(t, "us_west_1_a", metricNameUnsafe.ReplaceAllString("us.west 1/a", "_"))
+	assert.Equal(t, "payment-v2", metricNameUnsafe.ReplaceAllString("payment-v2", "_"))
+}
+
+func TestMetricsSenderUdp(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+
+	sender := &metricsSender{network: "udp", addr: conn.LocalAddr().String(),
+		timeout: time.Second}
+	defer sender.close()
+	lines := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		lines = append(lines, "dpipe.rs.login.count:1|c")
+	}
+	assert.Equal(t, nil, sender.send(lines))
+
+	// split into datagrams of whole lines
+	received := 0
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for received < len(lines) {
+		n, _, err := conn.ReadFrom(buf)
+		assert.Equal(t, nil, err)
+		if err != nil {
+			return
+		}
+		if n > metricsMaxPacket {
+			t.Fatalf("datagram of %d bytes", n)
+		}
+		received += strings.Count(string(buf[:n]), "|c\n")
+	}
+	assert.Equal(t, len(lines), received)
+}
+
+func TestMetricsSenderTcp(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+
+	received := make(chan string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			received <- scanner.Text()
+		}
+	}()
+
+	sender := &metricsSender{network: "tcp", addr: ln.Addr().String(),
+		timeout: time.Second}
+	defer sender.close()
+	assert.Equal(t, nil, sender.send([]string{"dpipe.rs.online 280 1391857296"}))
+	assert.Equal(t, "dpipe.rs.online 280 1391857296", <-received)
+}
@@ -0,0 +1,46 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	mongoSlowOp      = regexp.MustCompile(`\[conn\d+\] (query|getmore|update|insert|remove|command) (\S+) .*?(\d+)ms\s*$`)
+	mongoScanned     = regexp.MustCompile(`\bnscanned:(\d+)`)
+	mongoReturned    = regexp.MustCompile(`\bnreturned:(\d+)`)
+	mongoPlanSummary = regexp.MustCompile(`\bplanSummary: (\w+)`)
+)
+
+func init() {
+	RegisterAlarms("mongoSlowOp", parseMongoSlowOp)
+}
+
+// mongod slow op whose severity is its seconds, query shape is dropped
+//
+//	Sat Feb  8 06:01:35.123 [conn12345] query royal.users query: { uid: 123 } ntoreturn:1 nscanned:50000 nreturned:1 reslen:200 305ms
+func parseMongoSlowOp(msg string) (match bool, alarms []Alarm) {
+	op := mongoSlowOp.FindStringSubmatch(msg)
+	if op == nil {
+		return
+	}
+
+	match = true
+	ms, _ := strconv.Atoi(op[3])
+	alarm := fmt.Sprintf("%s %s %dms", op[1], op[2], ms)
+	if scanned := mongoScanned.FindStringSubmatch(msg); scanned != nil {
+		alarm += " nscanned:" + scanned[1]
+	}
+	if returned := mongoReturned.FindStringSubmatch(msg); returned != nil {
+		alarm += " nreturned:" + returned[1]
+	}
+	if plan := mongoPlanSummary.FindStringSubmatch(msg); plan != nil {
+		alarm += " plan:" + plan[1]
+	}
+
+	alarms = []Alarm{{Msg: alarm,
+		Severity: durationSeverity(time.Duration(ms) * time.Millisecond)}}
+	return
+}
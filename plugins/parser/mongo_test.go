@@ -0,0 +1,27 @@
+package parser
+
+import (
+	"github.com/funkygao/assert"
+	"testing"
+)
+
+func TestMongoSlowOpParser(t *testing.T) {
+	match, alarms := parseMongoSlowOp("Sat Feb  8 06:01:35.123 [initandlisten] connection accepted from 10.0.0.1:50432 #12345")
+	assert.Equal(t, false, match)
+	assert.Equal(t, 0, len(alarms))
+
+	match, alarms = parseMongoSlowOp("Sat Feb  8 06:01:35.123 [conn12345] query royal.users query: { uid: 123 } ntoreturn:1 ntoskip:0 nscanned:50000 keyUpdates:0 numYields: 2 locks(micros) r:120345 nreturned:1 reslen:200 305ms")
+	assert.Equal(t, true, match)
+	assert.Equal(t, []Alarm{{Msg: "query royal.users 305ms nscanned:50000 nreturned:1",
+		Severity: 1}}, alarms)
+
+	match, alarms = parseMongoSlowOp("2014-02-08T06:01:35.123+0000 [conn12345] update royal.users query: { uid: 123 } update: { $set: { level: 2 } } nscanned:1 nMatched:1 nModified:1 keyUpdates:0 numYields:0 locks(micros) w:120 2510ms")
+	assert.Equal(t, true, match)
+	assert.Equal(t, []Alarm{{Msg: "update royal.users 2510ms nscanned:1",
+		Severity: 3}}, alarms)
+
+	match, alarms = parseMongoSlowOp("2014-02-08T06:01:35.123+0000 [conn12345] command royal.$cmd command: count { count: \"users\", query: {} } planSummary: COLLSCAN keyUpdates:0 numYields:0 reslen:48 12000ms")
+	assert.Equal(t, true, match)
+	assert.Equal(t, []Alarm{{Msg: "command royal.$cmd 12000ms plan:COLLSCAN",
+		Severity: 13}}, alarms)
+}
@@ -0,0 +1,56 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	mysqlSlowHeader = regexp.MustCompile(`^Count: (\d+)\s+Time=([\d.]+)s \(([\d.]+)s\)\s+Lock=([\d.]+)s \(([\d.]+)s\)\s+Rows=([\d.]+) \((\d+)\),\s*(\S+)`)
+	whitespaces     = regexp.MustCompile(`\s+`)
+)
+
+const mysqlSlowMaxQueryLen = 200
+
+func init() {
+	RegisterAlarms("mysqlSlowSummary", parseMysqlSlowSummary)
+}
+
+// mysqldumpslow output, each statement is an alarm whose severity is its
+// total seconds
+//
+//	Count: 12  Time=3.21s (38s)  Lock=0.00s (0s)  Rows=1.0 (12), root[root]@localhost
+//	  SELECT * FROM users WHERE uid = N
+func parseMysqlSlowSummary(msg string) (match bool, alarms []Alarm) {
+	for _, entry := range strings.Split(msg, "\nCount: ") {
+		if !strings.HasPrefix(entry, "Count: ") {
+			entry = "Count: " + entry
+		}
+
+		lines := strings.SplitN(entry, "\n", 2)
+		header := mysqlSlowHeader.FindStringSubmatch(lines[0])
+		if header == nil {
+			continue
+		}
+
+		match = true
+		query := ""
+		if len(lines) == 2 {
+			query = whitespaces.ReplaceAllString(strings.TrimSpace(lines[1]), " ")
+		}
+		if len(query) > mysqlSlowMaxQueryLen {
+			query = query[:mysqlSlowMaxQueryLen] + "..."
+		}
+
+		total, _ := strconv.ParseFloat(header[3], 64)
+		alarms = append(alarms, Alarm{
+			Severity: durationSeverity(time.Duration(total * float64(time.Second))),
+			Msg: fmt.Sprintf("count:%s avg:%ss total:%ss rows:%s %s %s",
+				header[1], header[2], header[3], header[6], header[8], query)})
+	}
+
+	return
+}
@@ -0,0 +1,27 @@
+package parser
+
+import (
+	"github.com/funkygao/assert"
+	"testing"
+)
+
+func TestMysqlSlowSummaryParser(t *testing.T) {
+	match, alarms := parseMysqlSlowSummary("Reading mysql slow query log from /var/log/mysql/slow.log")
+	assert.Equal(t, false, match)
+	assert.Equal(t, 0, len(alarms))
+
+	msg := `Reading mysql slow query log from /var/log/mysql/slow.log
+Count: 12  Time=3.21s (38s)  Lock=0.00s (0s)  Rows=1.0 (12), root[root]@localhost
+  SELECT * FROM users
+  WHERE uid = N
+
+Count: 1  Time=0.50s (0s)  Lock=0.10s (0s)  Rows=0.0 (0), royal[royal]@10.0.0.1
+  UPDATE users SET level = N WHERE uid = N
+`
+	match, alarms = parseMysqlSlowSummary(msg)
+	assert.Equal(t, true, match)
+	assert.Equal(t, []Alarm{
+		{Msg: "count:12 avg:3.21s total:38s rows:1.0 root[root]@localhost SELECT * FROM users WHERE uid = N", Severity: 39},
+		{Msg: "count:1 avg:0.50s total:0s rows:0.0 royal[royal]@10.0.0.1 UPDATE users SET level = N WHERE uid = N", Severity: 1},
+	}, alarms)
+}
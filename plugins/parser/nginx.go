@@ -0,0 +1,53 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	nginxError    = regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d \[(\w+)\] \d+#\d+: (?:\*\d+ )?(.+)$`)
+	nginxUpstream = regexp.MustCompile(`, upstream: "(?:\w+://)?([^/"]+)`)
+
+	// notice, info and debug match but don't alarm
+	nginxErrorSeverity = map[string]int{
+		"emerg": 1000,
+		"alert": 500,
+		"crit":  200,
+		"error": 20,
+		"warn":  2,
+	}
+)
+
+func init() {
+	RegisterAlarms("nginxError", parseNginxError)
+}
+
+// Client and request of the error are dropped, upstream is kept
+//
+//	2014/02/08 06:01:35 [error] 1234#0: *5678 connect() failed (111: Connection refused) while connecting to upstream, client: 1.2.3.4, server: royal, request: "GET /api HTTP/1.1", upstream: "http://127.0.0.1:9000/api", host: "royal"
+func parseNginxError(msg string) (match bool, alarms []Alarm) {
+	parts := nginxError.FindStringSubmatch(strings.TrimSpace(msg))
+	if parts == nil {
+		return
+	}
+
+	match = true
+	severity, present := nginxErrorSeverity[parts[1]]
+	if !present {
+		return
+	}
+
+	text := parts[2]
+	if i := strings.Index(text, ", client: "); i >= 0 {
+		text = text[:i]
+	}
+	if upstream := nginxUpstream.FindStringSubmatch(parts[2]); upstream != nil {
+		text = fmt.Sprintf("%s upstream:%s", text, upstream[1])
+	}
+
+	alarms = []Alarm{{Msg: fmt.Sprintf("[%s] %s", parts[1], text),
+		Severity: severity}}
+	return
+}
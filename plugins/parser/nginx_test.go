@@ -0,0 +1,26 @@
+package parser
+
+import (
+	"github.com/funkygao/assert"
+	"testing"
+)
+
+func TestNginxErrorParser(t *testing.T) {
+	match, alarms := parseNginxError(`1.2.3.4 - - [08/Feb/2014:06:01:35 +0000] "GET /api HTTP/1.1" 200 12`)
+	assert.Equal(t, false, match)
+	assert.Equal(t, 0, len(alarms))
+
+	match, alarms = parseNginxError("2014/02/08 06:01:35 [notice] 1234#0: signal process started")
+	assert.Equal(t, true, match)
+	assert.Equal(t, 0, len(alarms))
+
+	match, alarms = parseNginxError(`2014/02/08 06:01:35 [error] 1234#0: *5678 connect() failed (111: Connection refused) while connecting to upstream, client: 1.2.3.4, server: royal, request: "GET /api HTTP/1.1", upstream: "http://127.0.0.1:9000/api", host: "royal"`)
+	assert.Equal(t, true, match)
+	assert.Equal(t, []Alarm{{Msg: "[error] connect() failed (111: Connection refused) while connecting to upstream upstream:127.0.0.1:9000",
+		Severity: 20}}, alarms)
+
+	match, alarms = parseNginxError("2014/02/08 06:01:35 [emerg] 1234#0: bind() to 0.0.0.0:80 failed (98: Address already in use)")
+	assert.Equal(t, true, match)
+	assert.Equal(t, []Alarm{{Msg: "[emerg] bind() to 0.0.0.0:80 failed (98: Address already in use)",
+		Severity: 1000}}, alarms)
+}
@@ -1,33 +1,79 @@
 /*
 Parser for some special message fields
 Currently soly for alarm
+
+A parser registers itself by name in its init(), the name is referenced by
+the 'parser' of an alarm worker field.
 */
 package parser
 
 import (
 	"errors"
+	"fmt"
+	"time"
 )
 
+// An alarm parsed out of a message field
+type Alarm struct {
+	Msg      string
+	Severity int
+}
+
+// Parser returning at most one alarm, empty alarm means nothing to alarm
 type ParseMsg func(msg string) (match bool, alarm string, severity int)
 
+// Parser returning any number of alarms with their own severity, match
+// with no alarms means nothing to alarm
+type ParseAlarms func(msg string) (match bool, alarms []Alarm)
+
 var (
 	ErrInvaidParser = errors.New("invalid parser type")
 
-	allParsers = map[string]ParseMsg{
-		"syslogngStats": parseSyslogNgStats,
-	}
+	allParsers = make(map[string]ParseAlarms)
 )
 
-func Parse(typ string, msg string) (match bool, alarm string, severity int, err error) {
+func Register(name string, parse ParseMsg) {
+	RegisterAlarms(name, func(msg string) (match bool, alarms []Alarm) {
+		match, alarm, severity := parse(msg)
+		if match && alarm != "" {
+			alarms = []Alarm{{Msg: alarm, Severity: severity}}
+		}
+		return
+	})
+}
+
+func RegisterAlarms(name string, parse ParseAlarms) {
+	if _, present := allParsers[name]; present {
+		panic(fmt.Sprintf("parser[%s] cannot register twice", name))
+	}
+
+	allParsers[name] = parse
+}
+
+func Registered(name string) bool {
+	_, present := allParsers[name]
+	return present
+}
+
+func Parse(typ string, msg string) (match bool, alarms []Alarm, err error) {
 	if typ == "" {
-		return false, "", 0, ErrInvaidParser
+		return false, nil, ErrInvaidParser
 	}
 
 	parse, present := allParsers[typ]
 	if !present {
-		return false, "", 0, ErrInvaidParser
+		return false, nil, ErrInvaidParser
 	}
 
-	match, alarm, severity = parse(msg)
+	match, alarms = parse(msg)
 	return
 }
+
+// 1 per second, at most 1000
+func durationSeverity(d time.Duration) int {
+	severity := int(d/time.Second) + 1
+	if severity > 1000 {
+		severity = 1000
+	}
+	return severity
+}
@@ -0,0 +1,44 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	phpError = regexp.MustCompile(`PHP (Fatal error|Catchable fatal error|Parse error|Warning|Notice|Deprecated|Strict Standards):\s+(.+?) in (\S+) on line (\d+)`)
+
+	// notice and the like match but don't alarm
+	phpErrorSeverity = map[string]int{
+		"Fatal error":           100,
+		"Parse error":           100,
+		"Catchable fatal error": 50,
+		"Warning":               5,
+	}
+)
+
+func init() {
+	RegisterAlarms("phpError", parsePhpError)
+}
+
+// Each error of a multi line message is an alarm
+func parsePhpError(msg string) (match bool, alarms []Alarm) {
+	errs := phpError.FindAllStringSubmatch(msg, -1)
+	if len(errs) == 0 {
+		return
+	}
+
+	match = true
+	for _, e := range errs {
+		severity, present := phpErrorSeverity[e[1]]
+		if !present {
+			continue
+		}
+
+		alarms = append(alarms, Alarm{Severity: severity,
+			Msg: fmt.Sprintf("%s: %s %s:%s", e[1], strings.TrimSpace(e[2]), e[3], e[4])})
+	}
+
+	return
+}
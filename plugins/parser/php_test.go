@@ -0,0 +1,24 @@
+package parser
+
+import (
+	"github.com/funkygao/assert"
+	"testing"
+)
+
+func TestPhpErrorParser(t *testing.T) {
+	match, alarms := parsePhpError("2014-02-08 06:01:35 [INFO] Update local version")
+	assert.Equal(t, false, match)
+	assert.Equal(t, 0, len(alarms))
+
+	match, alarms = parsePhpError("PHP Notice:  Undefined index: uid in /mnt/htdocs/royal/lib/User.php on line 12")
+	assert.Equal(t, true, match)
+	assert.Equal(t, 0, len(alarms))
+
+	msg := "PHP Fatal error:  Allowed memory size of 134217728 bytes exhausted (tried to allocate 72 bytes) in /mnt/htdocs/royal/lib/Model.php on line 123\nPHP Warning:  mysql_connect(): Too many connections in /mnt/htdocs/royal/lib/Db.php on line 45"
+	match, alarms = parsePhpError(msg)
+	assert.Equal(t, true, match)
+	assert.Equal(t, []Alarm{
+		{Msg: "Fatal error: Allowed memory size of 134217728 bytes exhausted (tried to allocate 72 bytes) /mnt/htdocs/royal/lib/Model.php:123", Severity: 100},
+		{Msg: "Warning: mysql_connect(): Too many connections /mnt/htdocs/royal/lib/Db.php:45", Severity: 5},
+	}, alarms)
+}
@@ -10,6 +10,10 @@ var (
 	syslogngDropped = regexp.MustCompile(`dropped=\'program\((.+?)\)=(\d+)\'`)
 )
 
+func init() {
+	Register("syslogngStats", parseSyslogNgStats)
+}
+
 func parseSyslogNgStats(msg string) (match bool, alarm string, severity int) {
 	const SYSLOGNG_STATS = "Log statistics; "
 
@@ -6,9 +6,29 @@ import (
 )
 
 func TestParse(t *testing.T) {
-	r, err := Parse("non-exist", "msg")
+	match, alarms, err := Parse("non-exist", "msg")
 	assert.Equal(t, ErrInvaidParser, err)
-	assert.Equal(t, "", r)
+	assert.Equal(t, false, match)
+	assert.Equal(t, 0, len(alarms))
+
+	match, alarms, err = Parse("syslogngStats", "Log statistics; dropped='program(/a.php)=3'")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, match)
+	assert.Equal(t, []Alarm{{Msg: " [/a.php]dropped:3", Severity: 1000}}, alarms)
+
+	match, alarms, _ = Parse("syslogngStats", "Log statistics; dropped='program(/a.php)=0'")
+	assert.Equal(t, true, match)
+	assert.Equal(t, 0, len(alarms))
+}
+
+func TestRegister(t *testing.T) {
+	assert.Equal(t, true, Registered("syslogngStats"))
+	assert.Equal(t, false, Registered("non-exist"))
+
+	defer func() {
+		assert.NotEqual(t, nil, recover())
+	}()
+	Register("syslogngStats", parseSyslogNgStats)
 }
 
 func TestSyslogStatsParser(t *testing.T) {
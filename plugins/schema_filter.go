@@ -0,0 +1,337 @@
+package plugins
+
+import (
+	"fmt"
+	"github.com/funkygao/als"
+	"github.com/funkygao/dpipe/engine"
+	conf "github.com/funkygao/jsconf"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	SCHEMA_ACTION_DROP     = "drop"
+	SCHEMA_ACTION_TAG      = "tag"
+	SCHEMA_ACTION_REINJECT = "reinject"
+
+	SCHEMA_INVALID_FIELD = "_invalid"
+)
+
+type schemaField struct {
+	name     string
+	typ      string // als.KEY_TYPE_*
+	required bool
+	hasMin   bool
+	min      float64 // for string it's the length
+	hasMax   bool
+	max      float64
+	enum     []string
+}
+
+func (this *schemaField) load(section *conf.Conf) {
+	this.name = section.String("name", "")
+	if this.name == "" {
+		panic("schema field must have 'name'")
+	}
+	this.typ = section.String("type", als.KEY_TYPE_STRING)
+	this.required = section.Bool("required", true)
+	this.hasMin = section.Interface("min", nil) != nil
+	this.min = section.Float("min", 0)
+	this.hasMax = section.Interface("max", nil) != nil
+	this.max = section.Float("max", 0)
+	this.enum = section.StringList("enum", nil)
+}
+
+// Returns violation reason, empty if conforming
+func (this *schemaField) check(msg *als.AlsMessage) string {
+	val, err := msg.FieldValue(this.name, this.typ)
+	if err != nil {
+		if !messageHasField(msg, this.name) {
+			if this.required {
+				return "missing"
+			}
+
+			return ""
+		}
+
+		return "type"
+	}
+
+	return this.validate(val)
+}
+
+func (this *schemaField) validate(val interface{}) string {
+	if this.hasMin || this.hasMax {
+		var f float64
+		switch v := val.(type) {
+		case int:
+			f = float64(v)
+		case float64:
+			f = v
+		case string:
+			f = float64(len(v))
+		}
+
+		if (this.hasMin && f < this.min) || (this.hasMax && f > this.max) {
+			return "range"
+		}
+	}
+
+	if len(this.enum) > 0 {
+		s := fmt.Sprintf("%v", val)
+		for _, e := range this.enum {
+			if s == e {
+				return ""
+			}
+		}
+
+		return "enum"
+	}
+
+	return ""
+}
+
+// Distinguish missing field from field of wrong type
+func messageHasField(msg *als.AlsMessage, name string) bool {
+	data, err := msg.Map()
+	if err != nil {
+		return false
+	}
+
+	var node interface{} = data
+	for _, key := range strings.Split(name, ".") {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return false
+		}
+
+		if node, ok = m[key]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+type schema struct {
+	camelName string
+	fields    []schemaField
+}
+
+func (this *schema) load(section *conf.Conf) {
+	this.camelName = section.String("camel_name", "")
+	if this.camelName == "" {
+		panic("schema must have 'camel_name'")
+	}
+
+	this.fields = make([]schemaField, 0, 10)
+	for i := 0; i < len(section.List("fields", nil)); i++ {
+		fieldSection, err := section.Section(fmt.Sprintf("fields[%d]", i))
+		if err != nil {
+			panic(err)
+		}
+
+		field := schemaField{}
+		field.load(fieldSection)
+		this.fields = append(this.fields, field)
+	}
+	if len(this.fields) == 0 {
+		panic(fmt.Sprintf("schema[%s] empty 'fields'", this.camelName))
+	}
+}
+
+// Returns the violations like 'uid:missing', 'level:range'
+func (this *schema) check(msg *als.AlsMessage) (violations []string) {
+	for _, field := range this.fields {
+		if reason := field.check(msg); reason != "" {
+			violations = append(violations, field.name+":"+reason)
+		}
+	}
+
+	return
+}
+
+// Validate packs against per log type schema
+type SchemaFilter struct {
+	ident        string
+	invalidIdent string
+	action       string
+	schemas      map[string]*schema // key is camelName
+
+	mu       sync.Mutex
+	counters map[string]map[string]int64 // camelName -> violation -> N
+}
+
+func (this *SchemaFilter) Init(config *conf.Conf) {
+	this.ident = config.String("ident", "")
+	if this.ident == "" {
+		panic("empty ident")
+	}
+	this.action = config.String("action", SCHEMA_ACTION_TAG)
+	switch this.action {
+	case SCHEMA_ACTION_DROP, SCHEMA_ACTION_TAG:
+	case SCHEMA_ACTION_REINJECT:
+		this.invalidIdent = config.String("invalid_ident", "")
+		if this.invalidIdent == "" {
+			panic("reinject action must have 'invalid_ident'")
+		}
+	default:
+		panic("invalid schema action: " + this.action)
+	}
+
+	this.counters = make(map[string]map[string]int64)
+	this.schemas = make(map[string]*schema)
+	for i := 0; i < len(config.List("schemas", nil)); i++ {
+		section, err := config.Section(fmt.Sprintf("schemas[%d]", i))
+		if err != nil {
+			panic(err)
+		}
+
+		s := new(schema)
+		s.load(section)
+		if _, present := this.schemas[s.camelName]; present {
+			panic("dup schema: " + s.camelName)
+		}
+		this.schemas[s.camelName] = s
+	}
+	if len(this.schemas) == 0 {
+		panic("empty 'schemas'")
+	}
+}
+
+func (this *SchemaFilter) Run(r engine.FilterRunner, h engine.PluginHelper) error {
+	var (
+		globals = engine.Globals()
+		pack    *engine.PipelinePack
+		ok      = true
+		count   = 0
+		inChan  = r.InChan()
+	)
+
+	h.RegisterHttpApi("/schema/{camelName}", func(w http.ResponseWriter,
+		req *http.Request, params map[string]interface{}) (interface{}, error) {
+		return this.handleHttpRequest(w, req, params)
+	}).Methods("GET", "PUT")
+
+LOOP:
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break LOOP
+			}
+
+			if globals.Debug {
+				globals.Println(*pack)
+			}
+
+			count += 1
+			this.handlePack(pack, r, h)
+			pack.Recycle()
+		}
+	}
+
+	globals.Printf("[%s]Total filtered: %d", r.Name(), count)
+
+	return nil
+}
+
+func (this *SchemaFilter) handlePack(p *engine.PipelinePack,
+	r engine.FilterRunner, h engine.PluginHelper) {
+	camelName := p.Logfile.CamelCaseName()
+	var violations []string
+	if s, present := this.schemas[camelName]; present {
+		violations = s.check(p.Message)
+		this.count(camelName, violations)
+	}
+
+	if len(violations) > 0 && this.action == SCHEMA_ACTION_DROP {
+		return
+	}
+
+	// generate new pack
+	pack := h.PipelinePack(p.MsgLoopCount)
+	if pack == nil {
+		h.Project(p.Project).Println("can't get pack in filter")
+		return
+	}
+
+	p.CopyTo(pack)
+	pack.Ident = this.ident
+	if len(violations) > 0 {
+		pack.Message.SetField(SCHEMA_INVALID_FIELD, violations)
+		if this.action == SCHEMA_ACTION_REINJECT {
+			pack.Ident = this.invalidIdent
+		}
+
+		project := h.Project(p.Project)
+		if project.ShowError {
+			project.Printf("[%s]invalid %v: %s", camelName, violations,
+				p.Message.Payload)
+		}
+	}
+
+	r.Inject(pack)
+}
+
+func (this *SchemaFilter) count(camelName string, violations []string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	counter, present := this.counters[camelName]
+	if !present {
+		counter = make(map[string]int64)
+		this.counters[camelName] = counter
+	}
+
+	counter["_total"] += 1
+	if len(violations) > 0 {
+		counter["_invalid"] += 1
+	}
+	for _, v := range violations {
+		counter[v] += 1
+	}
+}
+
+func (this *SchemaFilter) handleHttpRequest(w http.ResponseWriter,
+	req *http.Request, params map[string]interface{}) (interface{}, error) {
+	vars := mux.Vars(req)
+	camelName := vars["camelName"]
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	output := make(map[string]interface{})
+	switch req.Method {
+	case "GET":
+		for name, counter := range this.counters {
+			if camelName != "all" && camelName != name {
+				continue
+			}
+
+			c := make(map[string]int64, len(counter))
+			for k, v := range counter {
+				c[k] = v
+			}
+			output[name] = c
+		}
+
+	case "PUT":
+		if camelName == "all" {
+			this.counters = make(map[string]map[string]int64)
+		} else {
+			delete(this.counters, camelName)
+		}
+		output["msg"] = "ok"
+	}
+
+	return output, nil
+}
+
+func init() {
+	engine.RegisterPlugin("SchemaFilter", func() engine.Plugin {
+		return new(SchemaFilter)
+	})
+}
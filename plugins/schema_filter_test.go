@@ -0,0 +1,20 @@
+package plugins
+
+import (
+	"github.com/funkygao/assert"
+	"testing"
+)
+
+func TestSchemaFieldValidate(t *testing.T) {
+	f := schemaField{name: "level", hasMin: true, min: 1, hasMax: true, max: 100}
+	assert.Equal(t, "", f.validate(1))
+	assert.Equal(t, "range", f.validate(0))
+	assert.Equal(t, "range", f.validate(100.5))
+
+	f = schemaField{name: "action", enum: []string{"buy", "sell"}}
+	assert.Equal(t, "", f.validate("sell"))
+	assert.Equal(t, "enum", f.validate("steal"))
+
+	f = schemaField{name: "snsid", hasMax: true, max: 3}
+	assert.Equal(t, "range", f.validate("abcd"))
+}
@@ -15,6 +15,8 @@ import (
 type SelfSysInput struct {
 	stopChan chan bool
 	ident    string
+	index    *esName
+	typ      *esName
 }
 
 func (this *SelfSysInput) Init(config *conf.Conf) {
@@ -23,6 +25,9 @@ func (this *SelfSysInput) Init(config *conf.Conf) {
 	if this.ident == "" {
 		panic("empty ident")
 	}
+	this.index = newEsIndexName(config.String("index_prefix", INDEX_PREFIX),
+		config.String("index_pattern", "als"))
+	this.typ = newEsTypeName(config.String("type_pattern", "sys"))
 }
 
 func (this *SelfSysInput) Run(r engine.InputRunner, h engine.PluginHelper) error {
@@ -34,6 +39,7 @@ func (this *SelfSysInput) Run(r engine.InputRunner, h engine.PluginHelper) error
 		jsonString string
 		err        error
 		stopped    = false
+		project    = selfSysProject(h)
 	)
 
 	for !stopped {
@@ -57,24 +63,44 @@ func (this *SelfSysInput) Run(r engine.InputRunner, h engine.PluginHelper) error
 		}
 
 		pack = <-inChan
+		now := project.Now()
 		if err = pack.Message.FromLine(fmt.Sprintf("als,%d,%s",
-			time.Now().Unix(), jsonString)); err != nil {
+			now.Unix(), jsonString)); err != nil {
 			globals.Printf("invalid sys stat: %s\n", jsonString)
 
 			pack.Recycle()
 			continue
 		}
 
-		pack.Project = "als"
+		pack.Project = project.Name
 		pack.Ident = this.ident
-		pack.EsIndex = "fun_als"
-		pack.EsType = "sys"
+		pack.EsIndex, err = this.index.render(project, this.ident, "", now,
+			pack.Message)
+		if err == nil {
+			pack.EsType, err = this.typ.render(project, this.ident, "", now,
+				pack.Message)
+		}
+		if err != nil {
+			globals.Println(err)
+		}
 		r.Inject(pack)
 	}
 
 	return nil
 }
 
+// Project 'als' is optional, without it index and type render with the
+// plain name and the global timezone
+func selfSysProject(h engine.PluginHelper) *engine.ConfProject {
+	const name = "als"
+	if h.EngineConfig().HasProject(name) {
+		return h.Project(name)
+	}
+
+	return &engine.ConfProject{Name: name, IndexPrefix: name,
+		TimeZone: engine.Globals().TimeZone}
+}
+
 func (this *SelfSysInput) Stop() {
 	close(this.stopChan)
 }
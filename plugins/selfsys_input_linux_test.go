@@ -0,0 +1,18 @@
+package plugins
+
+import (
+	"github.com/funkygao/assert"
+	"github.com/funkygao/dpipe/engine"
+	"testing"
+)
+
+func TestSelfSysProjectFallback(t *testing.T) {
+	project := selfSysProject(engine.NewEngineConfig(nil))
+	assert.Equal(t, "als", project.Name)
+	assert.Equal(t, engine.Globals().TimeZone, project.Location())
+
+	index := newEsIndexName("", "{project}_sys")
+	name, err := index.render(project, "alsSysStat", "", project.Now(), nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "als_sys", name)
+}
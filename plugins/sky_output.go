@@ -1,22 +1,24 @@
 package plugins
 
 import (
-	"fmt"
 	"github.com/funkygao/als"
 	"github.com/funkygao/dpipe/engine"
 	conf "github.com/funkygao/jsconf"
-	sky "github.com/funkygao/skyapi"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type SkyOutput struct {
-	table           *sky.Table
 	uidField        string
 	uidFieldType    string
 	actionField     string
 	actionFieldType string
 	project         string
+
+	flushInterval time.Duration
+	sender        *skySender
 }
 
 func (this *SkyOutput) Init(config *conf.Conf) {
@@ -37,36 +39,57 @@ func (this *SkyOutput) Init(config *conf.Conf) {
 	}
 
 	this.project = config.String("project", "")
-	var (
-		host string = config.String("host", "localhost")
-		port int    = config.Int("port", 8585)
-	)
-	client := sky.NewClient(host)
-	client.Port = port
-
-	if !client.Ping() {
-		panic(fmt.Sprintf("sky server not running: %s:%d", host, port))
+	this.flushInterval = time.Duration(config.Int("flush_interval", 5)) * time.Second
+
+	// connect lazily, sky may be not up yet
+	this.sender = &skySender{
+		host:         config.String("host", "localhost"),
+		port:         config.Int("port", 8585),
+		tableName:    config.String("table", ""),
+		maxEvents:    config.Int("batch_size", 500),
+		maxRetries:   config.Int("max_retries", 3),
+		retryBackoff: time.Duration(config.Int("retry_backoff_ms", 500)) * time.Millisecond,
+		maxBackoff:   time.Duration(config.Int("max_backoff", 30)) * time.Second,
+		spoolDir:     config.String("spool_dir", "var/sky_spool"),
+
+		replayInterval: time.Duration(config.Int("spool_replay_interval", 60)) * time.Second,
+		replayMax:      config.Int("spool_replay_max", 10),
 	}
-
-	this.table, _ = client.GetTable(config.String("table", ""))
-	if this.table == nil {
-		panic("must create table in advance")
+	if this.sender.tableName == "" {
+		panic("empty table")
 	}
 
+	// the tables.cf of cmd/sky
+	if schemaFile := config.String("schema", ""); schemaFile != "" {
+		var err error
+		this.sender.schema, err = loadSkyTableSchema(schemaFile,
+			this.sender.tableName)
+		if err != nil {
+			panic(err)
+		}
+	}
 }
 
 func (this *SkyOutput) Run(r engine.OutputRunner, h engine.PluginHelper) error {
 	var (
-		ok      = true
-		pack    *engine.PipelinePack
-		inChan  = r.InChan()
-		globals = engine.Globals()
-		project = h.Project(this.project)
+		ok          = true
+		pack        *engine.PipelinePack
+		inChan      = r.InChan()
+		globals     = engine.Globals()
+		project     = h.Project(this.project)
+		flushTicker = time.NewTicker(this.flushInterval)
 	)
 
+	defer flushTicker.Stop()
+
+	this.sender.start()
+
 LOOP:
 	for ok {
 		select {
+		case <-flushTicker.C:
+			this.sender.flush()
+
 		case pack, ok = <-inChan:
 			if !ok {
 				break LOOP
@@ -81,6 +104,16 @@ LOOP:
 		}
 	}
 
+	// before shutdown, wait for the inflight batches sent or spooled
+	this.sender.stop()
+	globals.Printf("[%s]sent: %d, retried: %d, rejected: %d, spooled: %d, replayed: %d",
+		r.Name(),
+		atomic.LoadInt64(&this.sender.sentN),
+		atomic.LoadInt64(&this.sender.retriedN),
+		atomic.LoadInt64(&this.sender.rejectedN),
+		atomic.LoadInt64(&this.sender.spooledN),
+		atomic.LoadInt64(&this.sender.replayedN))
+
 	return nil
 }
 
@@ -120,18 +153,15 @@ func (this *SkyOutput) feedSky(project *engine.ConfProject,
 		return
 	}
 
-	event := sky.NewEvent(pack.Message.Time(), eventMap)
 	if this.actionFieldType == als.KEY_TYPE_INT {
-		event.Data["action"] = "action_" + strconv.Itoa(action.(int))
+		eventMap["action"] = "action_" + strconv.Itoa(action.(int))
 	} else {
-		event.Data["action"] = action
+		eventMap["action"] = action
 	}
 
 	// objectId is uid string
-	err = this.table.AddEvent(strconv.Itoa(uid.(int)), event, sky.Merge)
-	if err != nil && project.ShowError {
-		project.Println(err)
-	}
+	this.sender.add(skyEvent{ObjectId: strconv.Itoa(uid.(int)),
+		Timestamp: pack.Message.Time(), Data: eventMap})
 }
 
 func init() {
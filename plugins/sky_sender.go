@@ -0,0 +1,435 @@
+package plugins
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/funkygao/dpipe/engine"
+	conf "github.com/funkygao/jsconf"
+	sky "github.com/funkygao/skyapi"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const SKY_SPOOL_SUFFIX = ".events"
+
+var errSkyUnavailable = errors.New("sky unavailable")
+
+// An event to add to the sky table, json encoded in the spool
+type skyEvent struct {
+	ObjectId  string                 `json:"id"`
+	Timestamp time.Time              `json:"ts"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+// Events sent together, replayed from spoolFile if non-empty
+type skyBatch struct {
+	events    []skyEvent
+	spoolFile string
+}
+
+type skyProperty struct {
+	name      string
+	transient bool
+	dataType  string // integer, string, float, boolean, factor
+}
+
+// Table schema in the tables.cf format of cmd/sky
+type skyTableSchema struct {
+	name       string
+	properties []skyProperty
+}
+
+func loadSkyTableSchema(fn, tableName string) (*skyTableSchema, error) {
+	cf, err := conf.Load(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(cf.List("tables", nil)); i++ {
+		section, err := cf.Section(fmt.Sprintf("tables[%d]", i))
+		if err != nil {
+			return nil, err
+		}
+		if section.String("name", "") != tableName {
+			continue
+		}
+
+		schema := &skyTableSchema{name: tableName,
+			properties: make([]skyProperty, 0, 10)}
+		for j := 0; j < len(section.List("props", nil)); j++ {
+			prop, err := section.Section(fmt.Sprintf("props[%d]", j))
+			if err != nil {
+				return nil, err
+			}
+
+			schema.properties = append(schema.properties, skyProperty{
+				name:      prop.String("name", ""),
+				transient: prop.Bool("transient", true),
+				dataType:  prop.String("type", "")})
+		}
+		return schema, nil
+	}
+
+	return nil, fmt.Errorf("table %s not found in %s", tableName, fn)
+}
+
+// Batched event sender that connects to sky lazily. Failed events are
+// retried with exponential backoff, spooled to disk if sky is unreachable
+// and replayed once it's back.
+type skySender struct {
+	host         string
+	port         int
+	tableName    string
+	schema       *skyTableSchema // create the table if missing, nil means never
+	maxEvents    int
+	maxRetries   int
+	retryBackoff time.Duration
+	maxBackoff   time.Duration
+	spoolDir     string
+
+	replayInterval time.Duration // zero means never
+	replayMax      int           // max spool files each replay
+
+	// replaceable in tests
+	post      func(events []skyEvent) (failed []skyEvent, err error)
+	reachable func() bool
+
+	client *sky.Client
+	table  *sky.Table // nil till connected
+
+	mu         sync.Mutex
+	pending    []skyEvent
+	sendChan   chan skyBatch
+	wg         *sync.WaitGroup
+	quit       chan bool
+	replayDone chan bool
+
+	sentN     int64
+	retriedN  int64
+	rejectedN int64
+	spooledN  int64
+	replayedN int64
+}
+
+func (this *skySender) start() {
+	if this.spoolDir != "" {
+		if err := os.MkdirAll(this.spoolDir, 0755); err != nil {
+			panic(err)
+		}
+		recoverSpool(this.spoolDir, SKY_SPOOL_SUFFIX)
+	}
+	if this.post == nil {
+		this.post = this.postSky
+	}
+	if this.reachable == nil {
+		// own client, the table belongs to the sender goroutine
+		this.reachable = func() bool {
+			client := sky.NewClient(this.host)
+			client.Port = this.port
+			return client.Ping()
+		}
+	}
+
+	this.pending = make([]skyEvent, 0, this.maxEvents)
+	this.sendChan = make(chan skyBatch, 10)
+	this.wg = new(sync.WaitGroup)
+	this.wg.Add(1)
+	go func() {
+		defer this.wg.Done()
+
+		// sky table is not safe for concurrent use, single sender
+		for batch := range this.sendChan {
+			this.send(batch)
+		}
+	}()
+
+	this.quit = make(chan bool)
+	this.replayDone = make(chan bool)
+	go this.replayLoop()
+}
+
+// Flush pending events and wait for the inflight batches sent or spooled
+func (this *skySender) stop() {
+	close(this.quit)
+	<-this.replayDone
+
+	this.flush()
+	close(this.sendChan)
+	this.wg.Wait()
+}
+
+func (this *skySender) add(event skyEvent) {
+	this.mu.Lock()
+	this.pending = append(this.pending, event)
+	full := len(this.pending) >= this.maxEvents
+	this.mu.Unlock()
+
+	if full {
+		this.flush()
+	}
+}
+
+func (this *skySender) flush() {
+	this.mu.Lock()
+	events := this.pending
+	this.pending = make([]skyEvent, 0, this.maxEvents)
+	this.mu.Unlock()
+
+	if len(events) > 0 {
+		this.sendChan <- skyBatch{events: events}
+	}
+}
+
+func (this *skySender) send(batch skyBatch) {
+	var (
+		backoff = this.retryBackoff
+		globals = engine.Globals()
+		events  = batch.events
+	)
+
+	for attempt := 0; ; attempt++ {
+		failed, err := this.post(events)
+		if err == nil && len(failed) == 0 {
+			releaseSpool(batch.spoolFile, true)
+			return
+		}
+
+		if err == nil {
+			// partially failed
+			events = failed
+		}
+
+		if attempt >= this.maxRetries {
+			if err == nil && this.reachable() {
+				// sky is up but won't take them
+				atomic.AddInt64(&this.rejectedN, int64(len(events)))
+				globals.Printf("sky rejected %d events", len(events))
+				releaseSpool(batch.spoolFile, true)
+				return
+			}
+
+			if err != nil {
+				globals.Printf("sky batch of %d events: %v", len(events), err)
+			}
+			releaseSpool(batch.spoolFile, this.spool(events) == nil)
+			return
+		}
+
+		atomic.AddInt64(&this.retriedN, int64(len(events)))
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > this.maxBackoff {
+			backoff = this.maxBackoff
+		}
+	}
+}
+
+// Connect to sky and get the table, creating it from schema if missing
+func (this *skySender) connect() error {
+	if this.table != nil {
+		return nil
+	}
+
+	if this.client == nil {
+		this.client = sky.NewClient(this.host)
+		this.client.Port = this.port
+	}
+	if !this.client.Ping() {
+		return errSkyUnavailable
+	}
+
+	table, _ := this.client.GetTable(this.tableName)
+	if table == nil {
+		if this.schema == nil {
+			return fmt.Errorf("sky table %s not found", this.tableName)
+		}
+
+		table = sky.NewTable(this.tableName, this.client)
+		if err := this.client.CreateTable(table); err != nil {
+			return err
+		}
+		for _, p := range this.schema.properties {
+			if err := table.CreateProperty(sky.NewProperty(p.name, p.transient,
+				p.dataType)); err != nil {
+				return err
+			}
+		}
+		engine.Globals().Printf("sky table %s created with %d properties",
+			this.tableName, len(this.schema.properties))
+	}
+
+	this.table = table
+	return nil
+}
+
+// Returns the events failed to add, or error if sky is unreachable
+func (this *skySender) postSky(events []skyEvent) (failed []skyEvent, err error) {
+	if err = this.connect(); err != nil {
+		return
+	}
+
+	for _, e := range events {
+		if err := this.table.AddEvent(e.ObjectId, sky.NewEvent(e.Timestamp, e.Data),
+			sky.Merge); err != nil {
+			failed = append(failed, e)
+		}
+	}
+
+	if len(failed) == len(events) {
+		// maybe the connection is lost, reconnect next time
+		this.table = nil
+	}
+	atomic.AddInt64(&this.sentN, int64(len(events)-len(failed)))
+	return
+}
+
+func (this *skySender) spool(events []skyEvent) error {
+	globals := engine.Globals()
+	if this.spoolDir == "" {
+		globals.Printf("sky lost %d events: no spool_dir", len(events))
+		return errNoSpoolDir
+	}
+
+	fn := filepath.Join(this.spoolDir,
+		fmt.Sprintf("%d%s", time.Now().UnixNano(), SKY_SPOOL_SUFFIX))
+	// write then rename, so that replay never sees a half written file
+	tmp := fn + ".tmp"
+	err := writeSkySpool(tmp, events)
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		globals.Printf("sky lost %d events: %v", len(events), err)
+		return err
+	}
+
+	atomic.AddInt64(&this.spooledN, int64(len(events)))
+	return nil
+}
+
+func writeSkySpool(fn string, events []skyEvent) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w) // one event per line
+	for _, e := range events {
+		if err = encoder.Encode(e); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func loadSkySpool(fn string) (events []skyEvent, err error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for decoder.More() {
+		var e skyEvent
+		if err = decoder.Decode(&e); err != nil {
+			return
+		}
+		events = append(events, e)
+	}
+
+	return
+}
+
+// Replay runs aside the output loop, so that a slow sky never stalls intake
+func (this *skySender) replayLoop() {
+	defer close(this.replayDone)
+
+	if this.spoolDir == "" || this.replayInterval <= 0 {
+		return
+	}
+
+	var (
+		globals = engine.Globals()
+		ticker  = time.NewTicker(this.replayInterval)
+	)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.quit:
+			return
+
+		case <-ticker.C:
+			replayed, err := this.replaySpool(this.replayMax)
+			if err != nil {
+				if globals.Verbose {
+					globals.Printf("sky spool replay: %v", err)
+				}
+			} else if replayed > 0 {
+				globals.Printf("sky replayed %d spooled batches", replayed)
+			}
+		}
+	}
+}
+
+// Replay the spooled batches oldest first if sky is back, at most maxFiles
+// each time to avoid flooding a just recovered sky.
+// Undecodable files are moved aside so that they never block the rest.
+func (this *skySender) replaySpool(maxFiles int) (replayed int, err error) {
+	files := this.spooledFiles()
+	if len(files) == 0 {
+		return
+	}
+
+	if !this.reachable() {
+		return 0, errSkyUnavailable
+	}
+
+	sort.Strings(files)
+	for _, fn := range files {
+		if replayed >= maxFiles {
+			break
+		}
+
+		events, e := loadSkySpool(fn)
+		if e != nil {
+			moveBadSpool(fn, e)
+			continue
+		}
+
+		// removed only after its events are added or spooled again
+		batch := skyBatch{events: events}
+		if batch.spoolFile, err = claimSpool(fn); err != nil {
+			return
+		}
+
+		atomic.AddInt64(&this.replayedN, int64(len(events)))
+		this.sendChan <- batch
+		replayed += 1
+	}
+
+	return
+}
+
+func (this *skySender) spooledFiles() []string {
+	if this.spoolDir == "" {
+		return nil
+	}
+
+	files, _ := filepath.Glob(filepath.Join(this.spoolDir, "*"+SKY_SPOOL_SUFFIX))
+	return files
+}
@@ -0,0 +1,165 @@
+package plugins
+
+import (
+	"errors"
+	"github.com/funkygao/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Fake sky that records the added events, down till up is set
+type testSky struct {
+	sync.Mutex
+	up     bool
+	reject string // object id always failed
+	added  []string
+	posts  int
+}
+
+func (this *testSky) post(events []skyEvent) (failed []skyEvent, err error) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.posts++
+	if !this.up {
+		return nil, errSkyUnavailable
+	}
+	for _, e := range events {
+		if e.ObjectId == this.reject {
+			failed = append(failed, e)
+			continue
+		}
+		this.added = append(this.added, e.ObjectId)
+	}
+	return
+}
+
+func (this *testSky) reachable() bool {
+	this.Lock()
+	defer this.Unlock()
+	return this.up
+}
+
+func TestSkySenderBatch(t *testing.T) {
+	s := &testSky{up: true, reject: "bad"}
+	spoolDir, _ := ioutil.TempDir("", "sky_spool")
+	defer os.RemoveAll(spoolDir)
+	sender := &skySender{tableName: "rs_user", maxEvents: 2, maxRetries: 2,
+		retryBackoff: time.Millisecond, maxBackoff: time.Millisecond,
+		spoolDir: spoolDir, post: s.post, reachable: s.reachable}
+	sender.start()
+
+	for _, id := range []string{"1", "bad", "2"} {
+		sender.add(skyEvent{ObjectId: id, Timestamp: time.Now()})
+	}
+	sender.stop()
+
+	// 2 batches, the bad one retried and rejected since sky is up
+	assert.Equal(t, []string{"1", "2"}, s.added)
+	assert.Equal(t, 4, s.posts)
+	assert.Equal(t, int64(1), sender.rejectedN)
+	assert.Equal(t, 0, len(sender.spooledFiles()))
+}
+
+func TestSkySenderSpoolReplay(t *testing.T) {
+	s := &testSky{}
+	spoolDir, _ := ioutil.TempDir("", "sky_spool")
+	defer os.RemoveAll(spoolDir)
+	sender := &skySender{tableName: "rs_user", maxEvents: 2, maxRetries: 2,
+		retryBackoff: time.Millisecond, maxBackoff: time.Millisecond,
+		spoolDir: spoolDir, post: s.post, reachable: s.reachable}
+	sender.start()
+
+	data := map[string]interface{}{"action": "login", "level": float64(3)}
+	sender.add(skyEvent{ObjectId: "1", Timestamp: time.Unix(1391857296, 0),
+		Data: data})
+	sender.flush()
+
+	_, err := sender.replaySpool(10)
+	for err == nil && len(sender.spooledFiles()) == 0 {
+		time.Sleep(time.Millisecond)
+		_, err = sender.replaySpool(10)
+	}
+	assert.Equal(t, errSkyUnavailable, err)
+	files := sender.spooledFiles()
+	assert.Equal(t, 1, len(files))
+
+	events, err := loadSkySpool(files[0])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, int64(1391857296), events[0].Timestamp.Unix())
+	assert.Equal(t, data, events[0].Data)
+
+	// sky is back
+	s.Lock()
+	s.up = true
+	s.Unlock()
+	replayed, err := sender.replaySpool(10)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, replayed)
+	sender.stop()
+	assert.Equal(t, []string{"1"}, s.added)
+	assert.Equal(t, 0, len(sender.spooledFiles()))
+}
+
+func TestSkySenderNoSpool(t *testing.T) {
+	s := &testSky{}
+	sender := &skySender{tableName: "rs_user", maxEvents: 2, maxRetries: 2,
+		retryBackoff: time.Millisecond, maxBackoff: time.Millisecond,
+		reachable: s.reachable,
+		post: func(events []skyEvent) ([]skyEvent, error) {
+			return nil, errors.New("connection refused")
+		}}
+	sender.start()
+	sender.add(skyEvent{ObjectId: "1"})
+	sender.stop()
+	assert.Equal(t, int64(0), sender.spooledN)
+}
+
+func TestSkySenderReplayBadSpool(t *testing.T) {
+	s := &testSky{up: true}
+	spoolDir, _ := ioutil.TempDir("", "sky_spool")
+	defer os.RemoveAll(spoolDir)
+	sender := &skySender{tableName: "rs_user", maxEvents: 2, maxRetries: 2,
+		retryBackoff: time.Millisecond, maxBackoff: time.Millisecond,
+		spoolDir: spoolDir, post: s.post, reachable: s.reachable}
+	sender.start()
+
+	// the undecodable oldest file must not block the good one
+	bad := filepath.Join(spoolDir, "1"+SKY_SPOOL_SUFFIX)
+	ioutil.WriteFile(bad, []byte("{\"id\":\n"), 0644)
+	sender.spool([]skyEvent{{ObjectId: "1", Timestamp: time.Now()}})
+
+	replayed, err := sender.replaySpool(10)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, replayed)
+	sender.stop()
+
+	assert.Equal(t, []string{"1"}, s.added)
+	assert.Equal(t, 0, len(sender.spooledFiles()))
+	_, err = os.Stat(bad + SPOOL_BAD_SUFFIX)
+	assert.Equal(t, nil, err)
+}
+
+func TestSkySenderRecoverSpool(t *testing.T) {
+	spoolDir, _ := ioutil.TempDir("", "sky_spool")
+	defer os.RemoveAll(spoolDir)
+	s := &testSky{}
+	sender := &skySender{tableName: "rs_user", maxEvents: 2, spoolDir: spoolDir,
+		post: s.post, reachable: s.reachable}
+	sender.spool([]skyEvent{{ObjectId: "1", Timestamp: time.Now()}})
+
+	// killed while the replayed file is in flight
+	files := sender.spooledFiles()
+	_, err := claimSpool(files[0])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(sender.spooledFiles()))
+
+	sender.start()
+	sender.stop()
+	assert.Equal(t, files, sender.spooledFiles())
+}
@@ -0,0 +1,180 @@
+package plugins
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Built-in rules, can be replaced by a rules file with the same layout.
+// Rules are evaluated in order and the 1st match wins, the 1st sub match
+// if any is the version.
+const defaultUaRules = `{
+    "browsers": [
+        {"name": "Facebook", "regex": "FBAV/([\\d.]+)"},
+        {"name": "Edge", "regex": "Edge?/([\\d.]+)"},
+        {"name": "Opera", "regex": "OPR/([\\d.]+)"},
+        {"name": "Opera", "regex": "Opera.*Version/([\\d.]+)"},
+        {"name": "Opera", "regex": "Opera[/ ]([\\d.]+)"},
+        {"name": "UC Browser", "regex": "UCBrowser/([\\d.]+)"},
+        {"name": "Chrome", "regex": "(?:Chrome|CriOS)/([\\d.]+)"},
+        {"name": "Firefox", "regex": "(?:Firefox|FxiOS)/([\\d.]+)"},
+        {"name": "IE", "regex": "MSIE ([\\d.]+)"},
+        {"name": "IE", "regex": "Trident/.*rv:([\\d.]+)"},
+        {"name": "Safari", "regex": "Version/([\\d.]+).*Safari"},
+        {"name": "Android Browser", "regex": "Android.*AppleWebKit"}
+    ],
+    "os": [
+        {"name": "Windows Phone", "regex": "Windows Phone(?: OS)? ([\\d.]+)"},
+        {"name": "Windows", "regex": "Windows NT ([\\d.]+)"},
+        {"name": "iOS", "regex": "(?:iPhone|iPad|iPod).*? OS ([\\d_]+)"},
+        {"name": "Mac OS X", "regex": "Mac OS X ([\\d_.]+)"},
+        {"name": "Android", "regex": "Android ([\\d.]+)"},
+        {"name": "Chrome OS", "regex": "CrOS"},
+        {"name": "Linux", "regex": "Linux"}
+    ],
+    "devices": [
+        {"name": "spider", "regex": "(?i)bot|spider|crawl|slurp"},
+        {"name": "tablet", "regex": "iPad|Tablet|Kindle|Silk|Nexus (?:7|9|10)"},
+        {"name": "mobile", "regex": "Mobi|iPhone|iPod|Android|Windows Phone"}
+    ]
+}`
+
+type uaRule struct {
+	Name  string `json:"name"`
+	Regex string `json:"regex"`
+
+	re *regexp.Regexp
+}
+
+func (this *uaRule) match(ua string) (matched bool, version string) {
+	m := this.re.FindStringSubmatch(ua)
+	if m == nil {
+		return
+	}
+
+	matched = true
+	if len(m) > 1 {
+		version = strings.Replace(m[1], "_", ".", -1)
+	}
+	return
+}
+
+type uaRules struct {
+	Browsers []*uaRule `json:"browsers"`
+	Os       []*uaRule `json:"os"`
+	Devices  []*uaRule `json:"devices"`
+}
+
+func (this *uaRules) compile() (err error) {
+	for _, rules := range [][]*uaRule{this.Browsers, this.Os, this.Devices} {
+		for _, rule := range rules {
+			if rule.re, err = regexp.Compile(rule.Regex); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+type uaInfo struct {
+	browser        string
+	browserVersion string
+	os             string
+	osVersion      string
+	device         string // desktop, mobile, tablet, spider
+}
+
+// User agent parser with an LRU cache of the parsed results, not goroutine safe
+type uaParser struct {
+	file    string // empty means the built-in rules
+	modTime time.Time
+	rules   *uaRules
+	cache   *lruCache
+}
+
+func newUaParser(file string, cacheSize int) (this *uaParser, err error) {
+	this = &uaParser{file: file, cache: newLruCache(cacheSize)}
+	if file == "" {
+		this.rules, err = parseUaRules([]byte(defaultUaRules))
+		return
+	}
+
+	_, err = this.refresh()
+	return
+}
+
+func parseUaRules(data []byte) (rules *uaRules, err error) {
+	rules = new(uaRules)
+	if err = json.Unmarshal(data, rules); err != nil {
+		return
+	}
+
+	err = rules.compile()
+	return
+}
+
+// Reload the rules file if it changed, the old rules keep working on error
+func (this *uaParser) refresh() (reloaded bool, err error) {
+	if this.file == "" {
+		return
+	}
+
+	fi, err := os.Stat(this.file)
+	if err != nil {
+		return
+	}
+
+	if !fi.ModTime().After(this.modTime) {
+		return
+	}
+
+	data, err := ioutil.ReadFile(this.file)
+	if err != nil {
+		return
+	}
+
+	rules, err := parseUaRules(data)
+	if err != nil {
+		return
+	}
+
+	this.rules = rules
+	this.modTime = fi.ModTime()
+	this.cache.purge()
+	reloaded = true
+	return
+}
+
+func (this *uaParser) parse(ua string) *uaInfo {
+	if cached, present := this.cache.get(ua); present {
+		return cached.(*uaInfo)
+	}
+
+	info := &uaInfo{device: "desktop"}
+	for _, rule := range this.rules.Browsers {
+		if matched, version := rule.match(ua); matched {
+			info.browser, info.browserVersion = rule.Name, version
+			break
+		}
+	}
+	for _, rule := range this.rules.Os {
+		if matched, version := rule.match(ua); matched {
+			info.os, info.osVersion = rule.Name, version
+			break
+		}
+	}
+	for _, rule := range this.rules.Devices {
+		if matched, _ := rule.match(ua); matched {
+			info.device = rule.Name
+			break
+		}
+	}
+
+	this.cache.set(ua, info)
+	return info
+}
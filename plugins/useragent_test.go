@@ -0,0 +1,31 @@
+package plugins
+
+import (
+	"github.com/funkygao/assert"
+	"testing"
+)
+
+func TestUaParser(t *testing.T) {
+	p, err := newUaParser("", 10)
+	assert.Equal(t, nil, err)
+
+	info := p.parse("Mozilla/5.0 (Windows NT 6.1; WOW64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/33.0.1750.146 Safari/537.36")
+	assert.Equal(t, "Chrome", info.browser)
+	assert.Equal(t, "33.0.1750.146", info.browserVersion)
+	assert.Equal(t, "Windows", info.os)
+	assert.Equal(t, "6.1", info.osVersion)
+	assert.Equal(t, "desktop", info.device)
+
+	info = p.parse("Mozilla/5.0 (iPad; CPU OS 7_0_4 like Mac OS X) AppleWebKit/537.51.1 (KHTML, like Gecko) Version/7.0 Mobile/11B554a Safari/9537.53")
+	assert.Equal(t, "Safari", info.browser)
+	assert.Equal(t, "iOS", info.os)
+	assert.Equal(t, "7.0.4", info.osVersion)
+	assert.Equal(t, "tablet", info.device)
+
+	info = p.parse("Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)")
+	assert.Equal(t, "spider", info.device)
+
+	// cached
+	assert.Equal(t, info, p.parse("Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"))
+	assert.Equal(t, 3, p.cache.len())
+}
@@ -2,14 +2,12 @@ package plugins
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
+	"github.com/funkygao/als"
 	"github.com/funkygao/dpipe/engine"
-	"os"
-	"os/exec"
 	"regexp"
+	"strconv"
 	"strings"
-	"text/template"
 	"time"
 )
 
@@ -17,19 +15,37 @@ var (
 	normalizers = map[string]*regexp.Regexp{
 		"digit":       regexp.MustCompile(`\d+`),
 		"batch_token": regexp.MustCompile(`pre: .*; current: .*`),
+		"uuid":        regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`),
+		"hex":         regexp.MustCompile(`(?i)\b(0x[0-9a-f]+|[0-9a-f]{8,})\b`),
+		"ip":          regexp.MustCompile(`\b\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}(:\d+)?\b`),
+		"email":       regexp.MustCompile(`[\w.+-]+@[\w-]+(\.[\w-]+)+`),
 	}
 )
 
-func indexName(project *engine.ConfProject, indexPattern string,
-	date time.Time) (index string) {
-	const (
-		YM  = "@ym"
-		YMW = "@ymw"
-		YMD = "@ymd"
+// Register a named normalizer pattern, called only at plugin init
+func registerNormalizer(name, pattern string) error {
+	if _, present := normalizers[name]; present {
+		return fmt.Errorf("dup normalizer: %s", name)
+	}
 
-		INDEX_PREFIX = "fun_"
-	)
+	r, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	normalizers[name] = r
+	return nil
+}
 
+const (
+	YM  = "@ym"
+	YMW = "@ymw"
+	YMD = "@ymd"
+
+	INDEX_PREFIX = "fun_" // default prefix of all the index names
+)
+
+func indexName(indexPrefix string, project *engine.ConfProject,
+	indexPattern string, date time.Time) (index string) {
 	if strings.Contains(indexPattern, YM) {
 		prefix := project.IndexPrefix
 		fields := strings.SplitN(indexPattern, YM, 2)
@@ -40,60 +56,180 @@ func indexName(project *engine.ConfProject, indexPattern string,
 
 		switch indexPattern {
 		case YM:
-			index = fmt.Sprintf("%s%s_%d_%02d", INDEX_PREFIX, prefix,
+			index = fmt.Sprintf("%s%s_%d_%02d", indexPrefix, prefix,
 				date.Year(), int(date.Month()))
 		case YMW:
 			year, week := date.ISOWeek()
-			index = fmt.Sprintf("%s%s_%d_w%02d", INDEX_PREFIX, prefix,
+			index = fmt.Sprintf("%s%s_%d_w%02d", indexPrefix, prefix,
 				year, week)
 		case YMD:
-			index = fmt.Sprintf("%s%s_%d_%02d_%02d", INDEX_PREFIX, prefix,
+			index = fmt.Sprintf("%s%s_%d_%02d_%02d", indexPrefix, prefix,
 				date.Year(), int(date.Month()), date.Day())
 		}
 
 		return
 	}
 
-	index = INDEX_PREFIX + indexPattern
+	index = indexPrefix + indexPattern
 
 	return
 }
 
-// Use sendmail command instead of SMTP to send email
-func Sendmail(to string, subject string, body string) error {
-	if to == "" || subject == "" || body == "" {
-		return errors.New("empty mail params")
+// The reverse of indexName: the time period covered by a dated index.
+// ok is false if index is not produced by the pattern.
+func indexPeriod(indexPrefix string, project *engine.ConfProject,
+	indexPattern string, index string) (start, end time.Time, ok bool) {
+	var (
+		year, month, week, day int
+		n                      int
+		err                    error
+	)
+
+	// parse the trailing date part, then verify by round trip
+	switch {
+	case strings.HasSuffix(indexPattern, YMW):
+		if len(index) < len("2006_w01") {
+			return
+		}
+		n, err = fmt.Sscanf(index[len(index)-len("2006_w01"):], "%4d_w%2d",
+			&year, &week)
+		if err != nil || n != 2 || week < 1 || week > 53 {
+			return
+		}
+
+		// Jan 4th is always in ISO week 1
+		jan4 := time.Date(year, time.January, 4, 0, 0, 0, 0, project.Location())
+		monday := jan4.AddDate(0, 0, -((int(jan4.Weekday()) + 6) % 7))
+		start = monday.AddDate(0, 0, (week-1)*7)
+		end = start.AddDate(0, 0, 7)
+
+	case strings.HasSuffix(indexPattern, YMD):
+		if len(index) < len("2006_01_02") {
+			return
+		}
+		n, err = fmt.Sscanf(index[len(index)-len("2006_01_02"):], "%4d_%2d_%2d",
+			&year, &month, &day)
+		if err != nil || n != 3 {
+			return
+		}
+
+		start = time.Date(year, time.Month(month), day, 0, 0, 0, 0,
+			project.Location())
+		end = start.AddDate(0, 0, 1)
+
+	case strings.HasSuffix(indexPattern, YM):
+		if len(index) < len("2006_01") {
+			return
+		}
+		n, err = fmt.Sscanf(index[len(index)-len("2006_01"):], "%4d_%2d",
+			&year, &month)
+		if err != nil || n != 2 {
+			return
+		}
+
+		start = time.Date(year, time.Month(month), 1, 0, 0, 0, 0,
+			project.Location())
+		end = start.AddDate(0, 1, 0)
+
+	default:
+		// not a dated index
+		return
+	}
+
+	ok = indexName(indexPrefix, project, indexPattern, start) == index
+	return
+}
+
+// Start of the window of size d containing t, aligned in t's location
+func windowStart(t time.Time, d time.Duration) time.Time {
+	_, offset := t.Zone()
+	shift := time.Duration(offset) * time.Second
+	return t.Add(shift).Truncate(d).Add(-shift)
+}
+
+// A string template with {name} placeholders, e,g. {area}_{_log_info.uid}
+type fieldTemplate struct {
+	raw   string
+	parts []fieldTemplatePart
+}
+
+type fieldTemplatePart struct {
+	literal string
+	field   string // placeholder if non-empty
+}
+
+func newFieldTemplate(raw string) *fieldTemplate {
+	this := &fieldTemplate{raw: raw, parts: make([]fieldTemplatePart, 0, 5)}
+	for s := raw; s != ""; {
+		open := strings.Index(s, "{")
+		if open == -1 {
+			this.parts = append(this.parts, fieldTemplatePart{literal: s})
+			break
+		}
+
+		close := strings.Index(s[open:], "}")
+		if close == -1 {
+			panic("unclosed '{' in template: " + raw)
+		}
+		close += open
+
+		if open > 0 {
+			this.parts = append(this.parts, fieldTemplatePart{literal: s[:open]})
+		}
+		this.parts = append(this.parts, fieldTemplatePart{field: s[open+1 : close]})
+		s = s[close+1:]
 	}
 
-	type letterVar struct {
-		To, Subject, Body string
+	return this
+}
+
+func (this *fieldTemplate) fields() []string {
+	fields := make([]string, 0, len(this.parts))
+	for _, part := range this.parts {
+		if part.field != "" {
+			fields = append(fields, part.field)
+		}
 	}
 
-	const mailLetter = `From: dpipe <noreply@funplusgame.com>
-To: {{.To}}
-Subject: {{.Subject}}
-Importance: High
-X-Priority: 1 (Highest)
-X-MSMail-Priority: High
-——————————————————————
-{{.Body}}
-====
-dpipe
-`
-
-	data := letterVar{to, subject, body}
-	t := template.Must(template.New("letter").Parse(mailLetter))
-	wr := new(bytes.Buffer)
-	if err := t.Execute(wr, data); err != nil {
-		return err
+	return fields
+}
+
+// Render the template, fails if any placeholder can't be resolved
+func (this *fieldTemplate) render(resolve func(field string) (string,
+	error)) (string, error) {
+	var buf bytes.Buffer
+	for _, part := range this.parts {
+		if part.field == "" {
+			buf.WriteString(part.literal)
+			continue
+		}
+
+		val, err := resolve(part.field)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(val)
 	}
 
-	c1 := exec.Command("echo", wr.String())
-	c2 := exec.Command("sendmail", "-t")
-	c2.Stdin, _ = c1.StdoutPipe()
-	c2.Stdout = os.Stdout
-	c2.Start()
-	c1.Run()
-	c2.Wait()
-	return nil
+	return buf.String(), nil
+}
+
+// Message field value as string whatever its json type is
+func messageFieldString(msg *als.AlsMessage, name string) (string, error) {
+	val, err := msg.FieldValue(name, als.KEY_TYPE_STRING)
+	if err == nil {
+		return val.(string), nil
+	}
+
+	// json number
+	if val, e := msg.FieldValue(name, als.KEY_TYPE_FLOAT); e == nil {
+		return strconv.FormatFloat(val.(float64), 'f', -1, 64), nil
+	}
+
+	return "", err
+}
+
+// Send text mail through local sendmail command
+func Sendmail(to string, subject string, body string) error {
+	return newMailer().send(splitRecipients(to), subject, body, "")
 }
@@ -1,6 +1,8 @@
 package plugins
 
 import (
+	"errors"
+	"github.com/funkygao/als"
 	"github.com/funkygao/assert"
 	"github.com/funkygao/dpipe/engine"
 	"testing"
@@ -11,15 +13,120 @@ func BenchmarkIndexName(b *testing.B) {
 	date, _ := time.Parse("2006-01-02 15:04", "2011-01-19 22:15")
 	p := &engine.ConfProject{IndexPrefix: "rs"}
 	for i := 0; i < b.N; i++ {
-		indexName(p, "@ymw", date)
+		indexName(INDEX_PREFIX, p, "@ymw", date)
 	}
 }
 
 func TestIndexName(t *testing.T) {
 	date, _ := time.Parse("2006-01-02 15:04", "2011-01-19 22:15")
 	p := &engine.ConfProject{IndexPrefix: "rs"}
-	assert.Equal(t, "fun_rs_2011_01", indexName(p, "@ym", date))
-	assert.Equal(t, "fun_rs_2011_01_19", indexName(p, "@ymd", date))
-	assert.Equal(t, "fun_rs_2011_w03", indexName(p, "@ymw", date))
-	assert.Equal(t, "fun_foo", indexName(p, "foo", date))
+	assert.Equal(t, "fun_rs_2011_01", indexName(INDEX_PREFIX, p, "@ym", date))
+	assert.Equal(t, "fun_rs_2011_01_19", indexName(INDEX_PREFIX, p, "@ymd", date))
+	assert.Equal(t, "fun_rs_2011_w03", indexName(INDEX_PREFIX, p, "@ymw", date))
+	assert.Equal(t, "fun_foo", indexName(INDEX_PREFIX, p, "foo", date))
+}
+
+func TestFieldTemplate(t *testing.T) {
+	tpl := newFieldTemplate("{area}-{uid}_x")
+	assert.Equal(t, []string{"area", "uid"}, tpl.fields())
+
+	vals := map[string]string{"area": "us", "uid": "34"}
+	resolve := func(field string) (string, error) {
+		if val, present := vals[field]; present {
+			return val, nil
+		}
+		return "", errors.New("no " + field)
+	}
+	s, err := tpl.render(resolve)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "us-34_x", s)
+
+	delete(vals, "uid")
+	_, err = tpl.render(resolve)
+	assert.NotEqual(t, nil, err)
+
+	s, _ = newFieldTemplate("plain").render(resolve)
+	assert.Equal(t, "plain", s)
+}
+
+func TestIndexPeriod(t *testing.T) {
+	p := &engine.ConfProject{IndexPrefix: "rs"}
+	start, end, ok := indexPeriod(INDEX_PREFIX, p, "@ym", "fun_rs_2011_01")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, time.Date(2011, 1, 1, 0, 0, 0, 0, time.Local), start)
+	assert.Equal(t, time.Date(2011, 2, 1, 0, 0, 0, 0, time.Local), end)
+
+	start, end, ok = indexPeriod(INDEX_PREFIX, p, "@ymw", "fun_rs_2011_w03")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, time.Date(2011, 1, 17, 0, 0, 0, 0, time.Local), start)
+	assert.Equal(t, time.Date(2011, 1, 24, 0, 0, 0, 0, time.Local), end)
+
+	start, end, ok = indexPeriod(INDEX_PREFIX, p, "@ymd", "fun_rs_2011_01_19")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, time.Date(2011, 1, 20, 0, 0, 0, 0, time.Local), end)
+
+	_, _, ok = indexPeriod(INDEX_PREFIX, p, "@ym", "fun_ffs_2011_01")
+	assert.Equal(t, false, ok)
+	_, _, ok = indexPeriod(INDEX_PREFIX, p, "@ym", "fun_rs_2011_01_19")
+	assert.Equal(t, false, ok)
+	_, _, ok = indexPeriod(INDEX_PREFIX, p, "foo", "fun_foo")
+	assert.Equal(t, false, ok)
+}
+
+func TestIndexPeriodTimeZone(t *testing.T) {
+	loc := time.FixedZone("PST", -8*3600)
+	p := &engine.ConfProject{IndexPrefix: "rs", TimeZone: loc}
+	start, end, ok := indexPeriod(INDEX_PREFIX, p, "@ymd", "fun_rs_2011_01_19")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, time.Date(2011, 1, 19, 8, 0, 0, 0, time.UTC), start.UTC())
+	assert.Equal(t, time.Date(2011, 1, 20, 8, 0, 0, 0, time.UTC), end.UTC())
+
+	// index rolls at midnight of the project
+	date := time.Date(2011, 1, 20, 7, 0, 0, 0, time.UTC).In(p.Location())
+	assert.Equal(t, "fun_rs_2011_01_19", indexName(INDEX_PREFIX, p, "@ymd", date))
+}
+
+func TestWindowStart(t *testing.T) {
+	loc := time.FixedZone("CST", 8*3600)
+	now := time.Date(2014, 2, 10, 1, 30, 0, 0, loc)
+	assert.Equal(t, time.Date(2014, 2, 10, 0, 0, 0, 0, loc).Unix(),
+		windowStart(now, 24*time.Hour).Unix())
+	assert.Equal(t, time.Date(2014, 2, 10, 1, 0, 0, 0, loc).Unix(),
+		windowStart(now, time.Hour).Unix())
+	assert.Equal(t, time.Date(2014, 2, 10, 1, 30, 0, 0, loc).Unix(),
+		windowStart(now, 10*time.Second).Unix())
+}
+
+func TestEsName(t *testing.T) {
+	date, _ := time.Parse("2006-01-02 15:04", "2011-01-02 22:15")
+	p := &engine.ConfProject{IndexPrefix: "rs"}
+	name, err := newEsIndexName(INDEX_PREFIX, "@ym").render(p, "", "", date, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "fun_rs_2011_01", name)
+
+	name, _ = newEsIndexName("", "{project}_{ident}_{yyyy}{MM}{dd}{HH}").render(p,
+		"rsPay", "", date, nil)
+	assert.Equal(t, "rs_rspay_2011010222", name)
+
+	// 2011-01-02 is in ISO week 52 of 2010
+	name, _ = newEsIndexName("log_", "{project}_{yyyy}_w{ww}").render(p, "", "",
+		date, nil)
+	assert.Equal(t, "log_rs_2010_w52", name)
+
+	_, err = newEsIndexName("", "{area}").render(p, "", "", date, nil)
+	assert.NotEqual(t, nil, err)
+
+	name, _ = newEsTypeName("{camelName}_count").render(p, "", "PayLog", date, nil)
+	assert.Equal(t, "PayLog_count", name)
+
+	// message values never make a name ES rejects
+	msg := &als.AlsMessage{Area: "_US West/#1"}
+	name, _ = newEsIndexName("", "{area}_{yyyy}").render(p, "", "", date, msg)
+	assert.Equal(t, "us_west__1_2011", name)
+	name, _ = newEsTypeName("{area}").render(p, "", "", date, msg)
+	assert.Equal(t, "US_West__1", name)
+
+	msg.Area = "__"
+	_, err = newEsTypeName("{area}").render(p, "", "", date, msg)
+	assert.NotEqual(t, nil, err)
 }
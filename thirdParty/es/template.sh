@@ -63,6 +63,9 @@ curl -XPUT localhost:9200/_template/fun -d '
                     "type": "string",
                     "index": "not_analyzed"
                 },
+                "_loc": {
+                    "type": "geo_point"
+                },
                 "msg": {
                     "type": "string",
                     "index": "analyzed"
@@ -12,5 +12,8 @@ wget -N http://download.maxmind.com/download/geoip/database/asnum/GeoIPASNum.dat
 wget -N http://download.maxmind.com/download/geoip/database/asnum/GeoIPASNumv6.dat.gz
 gzip -df *.gz
 
-cp -f GeoIP.dat /opt/local/share/GeoIP/
-cp -f GeoLiteCity.dat /opt/local/share/GeoIP/
+# copy then rename, so that a running dpiped never opens a half written db
+for db in GeoIP.dat GeoLiteCity.dat GeoIPASNum.dat; do
+    cp -f $db /opt/local/share/GeoIP/$db.tmp
+    mv -f /opt/local/share/GeoIP/$db.tmp /opt/local/share/GeoIP/$db
+done